@@ -2,15 +2,20 @@ package datastoreadapter
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"cloud.google.com/go/datastore"
-	"github.com/casbin/casbin/model"
-	"github.com/casbin/casbin/persist"
+	"github.com/casbin/casbin/v2/model"
+	"github.com/casbin/casbin/v2/persist"
+	"google.golang.org/api/option"
 )
 
 const casbinKind = "casbin"
@@ -26,313 +31,2337 @@ type CasbinRule struct {
 	V5    string `datastore:"v5"`
 }
 
-// String version of the Casbin rule (CSV basically). Usable as a database key
+// String version of the Casbin rule (CSV basically). Usable as a database key.
+//
+// Commas and backslashes inside a field are escaped with a backslash, and
+// interior empty fields are kept, so that ParseString can restore the rule
+// exactly. Trailing empty fields are omitted. Whitespace is kept as is, like
+// in the stored fields, so " alice" and "alice" are different rules.
 func (cr *CasbinRule) String() string {
-	res := ""
-
-	appendOrTerminate := func(currentStr, strToAdd string) (string, bool) {
-		tmp := strings.TrimSpace(strToAdd)
-		if tmp == "" {
-			return currentStr, false
-		} else {
-			if currentStr == "" {
-				return tmp, true
-			} else {
-				return currentStr + "," + tmp, true
+	var sb strings.Builder
+	for i, field := range trimTrailingEmpty(cr.fields()) {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(fieldEscaper.Replace(field))
+	}
+	return sb.String()
+}
+
+// ParseString is the inverse of String. It parses a key name back into the
+// rule it was generated from.
+func ParseString(s string) *CasbinRule {
+	var fields []string
+	var sb strings.Builder
+	escaped := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case escaped:
+			sb.WriteByte(c)
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == ',':
+			fields = append(fields, sb.String())
+			sb.Reset()
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	if escaped {
+		// A dangling backslash can't come from String(); keep it literally.
+		sb.WriteByte('\\')
+	}
+	fields = append(fields, sb.String())
+
+	cr := &CasbinRule{}
+	targets := []*string{&cr.PType, &cr.V0, &cr.V1, &cr.V2, &cr.V3, &cr.V4, &cr.V5}
+	for i := 0; i < len(fields) && i < len(targets); i++ {
+		*targets[i] = fields[i]
+	}
+	return cr
+}
+
+var fieldEscaper = strings.NewReplacer(`\`, `\\`, `,`, `\,`)
+
+// fields returns the ptype followed by v0..v5.
+func (cr *CasbinRule) fields() []string {
+	return []string{cr.PType, cr.V0, cr.V1, cr.V2, cr.V3, cr.V4, cr.V5}
+}
+
+type Config struct {
+	// Datastore kind name.
+	// Optional. (Default: "casbin")
+	Kind string
+	// Store the rules of section "p", respectively "g", in their own kind
+	// instead, e.g. for separate TTL policies or index tuning. Loads query
+	// every kind; writes go to the kind of the rule's section. The model
+	// saved by SaveModelWithConfig, snapshots and the InsertionOrder counter
+	// stay in Kind.
+	// Optional. (Default: "", Kind is used)
+	PolicyKind   string
+	GroupingKind string
+	// Datastore namespace.
+	// Optional. (Default: "")
+	Namespace string
+	// Picks the namespace of each operation from its context, overriding
+	// Namespace. Lets one adapter serve many tenants; only the *Ctx methods
+	// can pass a meaningful context. A namespace set by ContextWithNamespace
+	// takes precedence.
+	// Optional. (Default: nil, Namespace is used)
+	NamespaceFunc func(ctx context.Context) string
+	// Stores the rules of the listed ptypes in their own namespace instead,
+	// e.g. to keep role and permission rules apart. Loads read all of the
+	// namespaces; writes go to the namespace of the rule's ptype.
+	// Optional. (Default: nil, every ptype uses the namespace above)
+	PTypeNamespaces map[string]string
+	// Picks the ancestor of rule entities, trading strongly consistent
+	// reads for write throughput: SingleAncestor, NoAncestor,
+	// ShardedAncestors or a custom strategy.
+	// Optional. (Default: SingleAncestor)
+	KeyStrategy KeyStrategy
+	// Number of entity groups to spread rules over, short for a KeyStrategy
+	// of ShardedAncestors{Shards: EntityGroupShards}: writes pick a group by
+	// a hash of the rule, and loads query all groups concurrently, merging
+	// their rules by sequence number with InsertionOrder. Ignored if
+	// KeyStrategy is set.
+	// Optional. (Default: 0, a single entity group)
+	EntityGroupShards int
+	// Whether loads are restricted to the ancestors of Config.KeyStrategy.
+	// Set it to false to also load rule entities written without the
+	// adapter's ancestor, e.g. bulk-loaded by another tool. Such loads are
+	// eventually consistent, and Config.SortOnLoad then needs its index
+	// without "ancestor: yes". Writes still use the ancestor, so removing an
+	// externally written rule only works if its key matches the adapter's.
+	// Optional. (Default: true)
+	RequireAncestor *bool
+	// Enables debug info to show database calls
+	Debug bool
+	// Destination of debug info and of errors from background work.
+	// Optional. (Default: the standard logger of the log package)
+	Logger *log.Logger
+
+	// Configures max time for long running operations like LoadPolicy,
+	// SavePolicy, RemoveFilteredPolicy. These may take seconds or minutes
+	LoadSaveFilterDeadline time.Duration
+	// Configures max time for quick incremental operations like AddPolicy
+	// and RemovePolicy. These largely take under 150ms
+	AddRemoveDeadline time.Duration
+	// Configures max time for every operation whose specific deadline above
+	// is left zero. Useful if the fast/slow distinction doesn't matter.
+	// Optional. (Default: 10 minutes for long running and 30 seconds for
+	// quick operations)
+	//
+	// NoDeadline, or any negative value, disables the respective timeout:
+	// operations then only end when the caller's context does, e.g. for
+	// long migrations. The caller must provide cancellation itself.
+	DefaultDeadline time.Duration
+
+	// Checks every rule before it is written by AddPolicy, AddPolicies or
+	// SavePolicy; a non-nil error aborts the write and is returned.
+	// Optional. (Default: nil, all rules are accepted)
+	ValidateRule func(ptype string, rule []string) error
+	// Called before every write of AddPolicy, AddPolicies, RemovePolicy,
+	// RemovePolicies, RemoveFilteredPolicy, RemoveFilteredPolicies,
+	// UpdatePolicy, UpdatePolicies, UpdateFilteredPolicies, SavePolicy,
+	// SavePolicyForPType, ReplacePolicy, SaveModelAndPolicy, PersistDelta,
+	// RenameSubject, UpdateField, DeleteByKeyName, DeletePType,
+	// ImportFromReader, Compact, Reindex and RestoreSnapshot, once the rules
+	// passed validation, e.g. to enforce invariants spanning several rules.
+	// A non-nil error aborts the write and is returned. SavePolicy calls it
+	// once per ptype of the model, RemoveFilteredPolicies once per filter,
+	// and ImportFromReader, Compact, Reindex and RestoreSnapshot once
+	// without a ptype.
+	// Optional. (Default: nil)
+	BeforeMutate func(ctx context.Context, m Mutation) error
+	// Called after every write BeforeMutate accepted, with the write's
+	// error, e.g. to invalidate caches. Writes staged by Begin count as
+	// done once staged.
+	// Optional. (Default: nil)
+	AfterMutate func(ctx context.Context, m Mutation, err error)
+	// Maps the fields of every rule as it is loaded into the model, e.g. to
+	// resolve stored IDs to the names enforced on; returning nil skips the
+	// rule. It gets the fields the model would get without it.
+	// ApplyPolicyDelta compares the model to the transformed rules.
+	// Optional. (Default: nil, rules are loaded as stored)
+	LoadTransform func(ptype string, fields []string) []string
+	// Maps the fields of every rule before it is written or looked up by
+	// AddPolicy, AddPolicies, RemovePolicy, RemovePolicies, UpdatePolicy,
+	// UpdatePolicies, SavePolicy and the like, e.g. to store IDs instead of
+	// the names enforced on. It should invert LoadTransform, so that rules
+	// round-trip. ValidateRule and BeforeMutate see the rules before the
+	// transform. The field values of filtered operations are matched
+	// against the stored rules as they are.
+	// Optional. (Default: nil, rules are stored as given)
+	SaveTransform func(ptype string, fields []string) []string
+	// Makes loads skip and log the rules the model rejects, e.g. with more
+	// fields than their ptype defines, loading all other rules, instead of
+	// failing on the first one. Casbin enforcers discard a load that fails,
+	// so the skipped rules aren't returned as an error; LoadPolicyWithReport
+	// reports them.
+	// Optional. (Default: false)
+	SoftLoad bool
+	// Publishes an event per changed rule after every successful write
+	// BeforeMutate sees, e.g. to a Cloud Pub/Sub topic for other services
+	// to invalidate their caches. Writes staged by Begin are published by
+	// Commit.
+	// Optional. (Default: nil, no events are published)
+	Publisher Publisher
+	// Maximum number of events passed to a single Publish call; bulk
+	// writes are published in batches of that size.
+	// Optional. (Default: 1000)
+	PublishBatchSize int
+	// Makes writes whose events fail to publish return the error, though
+	// the write persisted. Otherwise, the failure is only logged.
+	// Optional. (Default: false)
+	FailOnPublishError bool
+
+	// Storage layout of rules: StorageFormatFields or StorageFormatCSV.
+	// The CSV format is more compact for large, rarely queried policies,
+	// but filtered operations then read every rule of the ptype.
+	// Optional. (Default: StorageFormatFields)
+	StorageFormat string
+	// Prefixes key names with a short hash of the rule, e.g.
+	// "3fa1:p,alice,data1,read", so that writes of rules sharing a prefix,
+	// like many rules of one subject, spread over the key space instead of
+	// hitting one key range. Rules written before the option was changed
+	// stay under their old key names until SavePolicy rewrites them.
+	// Ignored with StorageFormatCSV, whose key names are hashes already.
+	// Optional. (Default: false, key names are the rules themselves)
+	HashPrefixKeys bool
+
+	// Orders loaded rules by ptype, then v0 to v5, so that LoadPolicy is
+	// deterministic. Requires a composite index, see README.md.
+	// Optional. (Default: false, rules load in Datastore's order)
+	SortOnLoad bool
+
+	// Loads only ptype and the first ProjectedFields of v0 to v5 with a
+	// projection query, saving bandwidth for models using fewer fields.
+	// Further fields load empty, so no stored rule may use them. Applies to
+	// LoadPolicy, LoadSectionPolicy and LoadPolicyArray, and needs a
+	// composite index, see README.md. Ignored with StorageFormatCSV,
+	// InsertionOrder and TTLProperty, which need whole entities.
+	// Optional. (Default: 0, whole entities are loaded)
+	ProjectedFields int
+	// Lets LoadSectionPolicy, LoadPolicyByField and LoadPolicyByRange fall
+	// back to loading every rule and filtering in memory, logging a warning,
+	// when their query fails for a missing composite index, e.g. while a
+	// newly created one is still building. The fallback is as expensive as
+	// LoadPolicy.
+	// Optional. (Default: false, the load fails)
+	IndexFallback bool
+	// Caps the rows each LoadPolicy query returns, as a guardrail against
+	// loading an unexpectedly large policy. LoadPolicy runs a query per
+	// namespace, kind and ancestor, see Config.KeyStrategy. A query reaching
+	// the cap, counting rows that are skipped afterwards like expired rules,
+	// logs a warning, as the policy may be incomplete, and makes the load a
+	// partial one: SavePolicy fails with ErrFiltered until a complete
+	// LoadPolicy, so it can't delete the rules left out. A query returning
+	// exactly the cap can't be told from a truncated one, so it counts too.
+	// Optional. (Default: 0, no limit)
+	LoadLimit int
+
+	// Records a seq property with every rule when it is first inserted,
+	// taken from a counter on the policy's root entity, and loads rules in
+	// that order. Rules stored without a seq load first. Takes precedence
+	// over SortOnLoad. Inserting then always runs in a transaction.
+	// Optional. (Default: false)
+	InsertionOrder bool
+
+	// Makes concurrent LoadPolicy calls for the same namespace share a
+	// single Datastore query, e.g. when many enforcers start at once. Each
+	// call still loads the rules into its own model.
+	// Optional. (Default: false)
+	SingleFlightLoad bool
+	// Caches the rules loaded by LoadPolicy for CacheTTL, per namespace,
+	// e.g. so that many enforcers of one tenant don't each query Datastore.
+	// Writes through the adapter, including failed ones, drop the cache of
+	// their namespace only, so a write for one tenant of NamespaceFunc keeps
+	// the others cached. Writes by other processes aren't noticed before
+	// the cache expires, see InvalidateCache.
+	// Optional. (Default: 0, nothing is cached)
+	CacheTTL time.Duration
+
+	// Lets loads read eventually consistent, possibly slightly stale data,
+	// which is faster and cheaper than the default strongly consistent
+	// ancestor queries. Writes and the reads inside their transactions are
+	// not affected. Suits e.g. adapters only used to load enforcers.
+	// Optional. (Default: false)
+	StaleReads bool
+
+	// Name of a property receiving the time each rule expires, TTL after it
+	// was last written, for a Datastore TTL policy on the kind to delete
+	// expired rules. Loads skip rules that expired but weren't deleted yet.
+	// SavePolicy doesn't rewrite unchanged rules, so it doesn't renew them.
+	// Optional. (Default: "", rules don't expire)
+	TTLProperty string
+	// Lifetime of rules written while TTLProperty is set.
+	TTL time.Duration
+	// Name of a property receiving the time each rule was first written,
+	// e.g. for audits. Writing a stored rule again keeps it, and SavePolicy
+	// doesn't rewrite unchanged rules, so it survives full saves. Writing
+	// then always runs in a transaction.
+	// Optional. (Default: "", not recorded)
+	CreatedProperty string
+	// Stores a checksum of its fields with every rule written, and verifies
+	// it on load to detect edits made outside the adapter: ChecksumSkip
+	// skips mismatching rules with a warning, ChecksumError fails the load
+	// with ErrChecksumMismatch. Rules without a checksum, e.g. written
+	// before it was enabled, are loaded.
+	// Optional. (Default: "", no checksums)
+	ChecksumAction string
+	// Handles rules saved by SavePolicy, SavePolicyForPType or ReplacePolicy
+	// that map to the same key as an earlier rule of the same save, e.g.
+	// because they differ only in trailing empty fields: DuplicateSkip
+	// stores the first and logs the others, DuplicateError fails the save
+	// with ErrDuplicateRule. Either way, the stored policy can't silently
+	// hold fewer rules than the saved model.
+	// Optional. (Default: DuplicateSkip)
+	DuplicateAction string
+	// Maximum estimated size in bytes of a rule entity. Writes of larger
+	// rules fail with ErrEntityTooLarge before reaching Datastore, which
+	// rejects entities above 1 MiB with a less helpful error.
+	// Optional. (Default: 1048572, Datastore's limit)
+	MaxEntitySize int
+	// Number of snapshots of the saved policy to keep. Every SavePolicy
+	// then also stores the whole policy, compressed, as a timestamped
+	// snapshot in the kind Kind+"_snapshot" of the base namespace, and
+	// deletes the oldest snapshots beyond SnapshotRetention; RestoreSnapshot
+	// rolls the policy back to one of them. Incremental writes like
+	// AddPolicy aren't snapshotted. A policy whose snapshot exceeds
+	// MaxEntitySize compressed can't be snapshotted.
+	// Optional. (Default: 0, no snapshots)
+	SnapshotRetention int
+
+	// Decides whether a failed Datastore call is retried.
+	// Optional. (Default: DefaultIsRetriable)
+	IsRetriable func(error) bool
+
+	// Returns the wait before retrying a failed, retriable Datastore call,
+	// or 0 for the default one, e.g. to read a hint of another form.
+	// Optional. (Default: nil, the wait the server asks for in the RetryInfo
+	// of the error's status details, if any; otherwise quota errors back off
+	// from 1s, ten times longer than other errors)
+	RetryAfter func(error) time.Duration
+
+	// Makes AddPolicy and AddPolicies insert rules instead of overwriting
+	// them: adding a rule that is already stored fails with an error
+	// matching ErrAlreadyExists, a RuleError for a single rule or a
+	// *RulesError listing the stored ones. Inserting then always runs in a
+	// transaction.
+	// Optional. (Default: false, rules are overwritten)
+	InsertOnly bool
+
+	// Called after every transaction committed by SavePolicy with the number
+	// of rule mutations done so far and in total, to report the progress of
+	// large saves, which are split into several transactions.
+	// Optional. (Default: nil)
+	OnProgress func(done, total int)
+
+	// Makes AddPolicies and RemovePolicies all-or-nothing: batches exceeding
+	// a single transaction fail with ErrTooManyMutations. Otherwise they are
+	// split into several transactions, and a failure leaves the chunks
+	// committed before it written.
+	// Optional. (Default: false, large batches are split)
+	BatchAtomic bool
+
+	// The number of gRPC connections of the client created by
+	// NewAdapterWithProject, to spread concurrent RPCs under high load; see
+	// README.md for recommended sizes. Ignored for clients passed in.
+	// Optional. (Default: 0, the client library's default)
+	ConnectionPoolSize int
+	// The maximum number of Datastore operations, queries, lookups and
+	// commits, the adapter has in flight at once; further ones wait for a
+	// slot or for their context to be done, applying backpressure under
+	// bursty load instead of overloading the entity group and connections.
+	// Retries of an operation give up its slot while backing off.
+	// Optional. (Default: 0, unlimited)
+	MaxConcurrency int
+
+	// Called after every operation, e.g. to record metrics per operation,
+	// kind and namespace.
+	// Optional. (Default: nil)
+	OnOperation func(op Operation)
+
+	// Rejects every write with ErrReadOnly, e.g. for replicas that must
+	// never modify the shared policy.
+	// Optional. (Default: false)
+	ReadOnly bool
+
+	// Makes RemoveFilteredPolicy and RemoveFilteredPolicies fail with
+	// ErrBroadDelete for a filter constraining nothing but the ptype, which
+	// would delete every rule of it, unless the context was returned by
+	// AllowBroadDeletes.
+	// Optional. (Default: false)
+	GuardBroadDeletes bool
+}
+
+// Adapter represents the GCP datastore adapter for policy storage.
+type Adapter struct {
+	// mu guards db, which is created lazily when factory is set, and
+	// filtered, which is set by partial loads.
+	mu       sync.Mutex
+	db       *datastore.Client
+	factory  func(ctx context.Context) (*datastore.Client, error)
+	filtered bool
+	config   Config
+
+	// stageMu guards staged, the mutations recorded since Begin.
+	stageMu sync.Mutex
+	staged  *staging
+
+	// loadMu guards loads, the LoadPolicy calls in flight by namespace.
+	loadMu sync.Mutex
+	loads  map[string]*loadCall
+
+	// cacheMu guards cache, the rules cached by namespace.
+	cacheMu sync.Mutex
+	cache   loadCache
+
+	// slots holds a value per Datastore operation in flight, if
+	// Config.MaxConcurrency limits them.
+	slots chan struct{}
+}
+
+// The casbin interfaces Adapter implements, checked at compile time.
+var (
+	_ persist.Adapter                 = (*Adapter)(nil)
+	_ persist.ContextAdapter          = (*Adapter)(nil)
+	_ persist.BatchAdapter            = (*Adapter)(nil)
+	_ persist.ContextBatchAdapter     = (*Adapter)(nil)
+	_ persist.UpdatableAdapter        = (*Adapter)(nil)
+	_ persist.ContextUpdatableAdapter = (*Adapter)(nil)
+)
+
+// logPrintln writes to the configured logger, or the standard one.
+func (a *Adapter) logPrintln(v ...interface{}) {
+	if a.config.Logger != nil {
+		a.config.Logger.Println(v...)
+		return
+	}
+	log.Println(v...)
+}
+
+// finalizer is the destructor for Adapter. Nobody is left to return an error
+// to, so it logs it.
+func finalizer(a *Adapter) {
+	if err := a.close(); err != nil {
+		a.logPrintln("[Close] finalizer failed to close the client:", err)
+	}
+}
+
+func (a *Adapter) close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.db == nil {
+		return nil
+	}
+	err := a.db.Close()
+	a.db = nil
+	return err
+}
+
+// Close closes the adapter's Datastore client. The adapter must not be used
+// afterwards, unless it was created by NewAdapterWithClientFactory, which
+// creates a new client on the next use.
+func (a *Adapter) Close() error {
+	return a.CloseCtx(context.Background())
+}
+
+// CloseCtx is like Close, but leaves the client open and returns the
+// context's error if ctx is already done.
+func (a *Adapter) CloseCtx(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if a.config.Debug {
+		a.logPrintln("[Close] called")
+	}
+	return a.close()
+}
+
+// client returns the Datastore client, creating it with the factory first if
+// needed.
+func (a *Adapter) client(ctx context.Context) (*datastore.Client, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.db == nil && a.factory != nil {
+		db, err := a.factory(ctx)
+		if err != nil {
+			return nil, err
+		}
+		a.db = db
+	}
+	return a.db, nil
+}
+
+// NoDeadline disables a deadline of Config.
+const NoDeadline time.Duration = -1
+
+// withDeadline is context.WithTimeout, except that a negative d adds no
+// deadline to ctx.
+func withDeadline(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d < 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// withDefaults returns config with default values filled in.
+func withDefaults(config Config) Config {
+	if strings.TrimSpace(config.Kind) == "" {
+		config.Kind = casbinKind
+	}
+	// Namespace default value of "" is okay
+	// Debug default value of false is okay
+	if config.StorageFormat == "" {
+		config.StorageFormat = StorageFormatFields
+	}
+	if config.LoadSaveFilterDeadline == 0 {
+		config.LoadSaveFilterDeadline = config.DefaultDeadline
+	}
+	if config.LoadSaveFilterDeadline == 0 {
+		config.LoadSaveFilterDeadline = time.Minute * 10
+	}
+	if config.AddRemoveDeadline == 0 {
+		config.AddRemoveDeadline = config.DefaultDeadline
+	}
+	if config.AddRemoveDeadline == 0 {
+		config.AddRemoveDeadline = time.Second * 30
+	}
+	if config.KeyStrategy == nil {
+		config.KeyStrategy = SingleAncestor{}
+		if config.EntityGroupShards > 1 {
+			config.KeyStrategy = ShardedAncestors{Shards: config.EntityGroupShards}
+		}
+	}
+	if config.DuplicateAction == "" {
+		config.DuplicateAction = DuplicateSkip
+	}
+	if config.RequireAncestor == nil {
+		requireAncestor := true
+		config.RequireAncestor = &requireAncestor
+	}
+	if config.MaxEntitySize <= 0 {
+		config.MaxEntitySize = maxEntitySize
+	}
+	if config.PublishBatchSize <= 0 {
+		config.PublishBatchSize = defaultPublishBatchSize
+	}
+	return config
+}
+
+// ForApp returns a Config isolating the rules of app from those of other
+// apps sharing the project: they are stored in the namespace app, with the
+// kind "casbin_" + app. app must be a valid namespace name, of at most 100
+// letters, digits, dots, dashes and underscores. Further options can be set
+// on the returned Config; setting Namespace, NamespaceFunc or Kind undoes
+// the isolation.
+func ForApp(app string) Config {
+	return Config{Kind: casbinKind + "_" + app, Namespace: app}
+}
+
+// EffectiveConfig returns the adapter's configuration with the defaults
+// applied, e.g. the kind and deadlines in use. Maps and functions are shared
+// with the adapter and must not be modified.
+func (a *Adapter) EffectiveConfig() Config {
+	return a.config
+}
+
+// NewAdapter is the constructor for Adapter. A valid datastore client must be provided;
+// it panics if db is nil.
+//
+// Besides persist.Adapter, the returned adapter implements persist.ContextAdapter,
+// whose methods propagate the caller's context into Datastore calls.
+func NewAdapter(db *datastore.Client) *Adapter {
+	return NewAdapterWithConfig(db, Config{})
+}
+
+// NewAdapter is the constructor for Adapter. A valid datastore client must be provided;
+// it panics if db is nil.
+func NewAdapterWithConfig(db *datastore.Client, config Config) *Adapter {
+	if db == nil {
+		panic("datastoreadapter: nil *datastore.Client; pass a client from datastore.NewClient, " +
+			"or use NewAdapterWithProject or NewAdapterWithClientFactory to create it on first use")
+	}
+	return newAdapter(db, config)
+}
+
+// newAdapter returns an Adapter using db, which may be nil if the client is
+// created by a factory, with config.
+func newAdapter(db *datastore.Client, config Config) *Adapter {
+	config = withDefaults(config)
+
+	a := &Adapter{
+		db:     db,
+		config: config,
+	}
+	if config.MaxConcurrency > 0 {
+		a.slots = make(chan struct{}, config.MaxConcurrency)
+	}
+
+	// Call the destructor when the object is released.
+	runtime.SetFinalizer(a, finalizer)
+
+	return a
+}
+
+// NewAdapterWithClientFactory is the constructor for an Adapter creating its
+// Datastore client with factory on first use instead of receiving a ready
+// one. The client is closed by Close. If factory fails, the operation that
+// needed the client fails and the next one calls factory again.
+func NewAdapterWithClientFactory(factory func(ctx context.Context) (*datastore.Client, error), config Config) *Adapter {
+	if factory == nil {
+		panic("datastoreadapter: nil client factory")
+	}
+	a := newAdapter(nil, config)
+	a.factory = factory
+	return a
+}
+
+// NewAdapterWithProject is the constructor for an Adapter creating its
+// Datastore client for projectID with opts on first use, like
+// NewAdapterWithClientFactory. Config.ConnectionPoolSize adds a
+// gRPC connection pool option to opts.
+func NewAdapterWithProject(projectID string, config Config, opts ...option.ClientOption) *Adapter {
+	opts = append([]option.ClientOption(nil), opts...)
+	if config.ConnectionPoolSize > 0 {
+		opts = append(opts, option.WithGRPCConnectionPool(config.ConnectionPoolSize))
+	}
+	return NewAdapterWithClientFactory(func(ctx context.Context) (*datastore.Client, error) {
+		return datastore.NewClient(ctx, projectID, opts...)
+	}, config)
+}
+
+// namespace returns the namespace to use for an operation running with ctx.
+func (a *Adapter) namespace(ctx context.Context) string {
+	if ns, ok := ctx.Value(ptypeNamespaceKey{}).(string); ok {
+		return ns
+	}
+	return a.baseNamespace(ctx)
+}
+
+// baseNamespace returns the namespace of ptypes without an entry in
+// Config.PTypeNamespaces.
+func (a *Adapter) baseNamespace(ctx context.Context) string {
+	if ns, ok := NamespaceFromContext(ctx); ok {
+		return ns
+	}
+	if a.config.NamespaceFunc != nil {
+		return a.config.NamespaceFunc(ctx)
+	}
+	return a.config.Namespace
+}
+
+// ptypeNamespaceKey is the context key of the namespace picked for a ptype
+// by ptypeContext.
+type ptypeNamespaceKey struct{}
+
+// ptypeKindKey is the context key of the kind picked for a ptype by
+// ptypeContext.
+type ptypeKindKey struct{}
+
+// ptypeContext returns ctx with the namespace and kind of ptype's rules, for
+// operations on a single ptype. They replace those of ctx, so that a
+// context picked for another ptype can't leak into ptype's keys.
+func (a *Adapter) ptypeContext(ctx context.Context, ptype string) context.Context {
+	if len(a.config.PTypeNamespaces) > 0 {
+		ns, ok := a.config.PTypeNamespaces[ptype]
+		if !ok {
+			ns = a.baseNamespace(ctx)
+		}
+		ctx = context.WithValue(ctx, ptypeNamespaceKey{}, ns)
+	}
+	if a.config.PolicyKind != "" || a.config.GroupingKind != "" {
+		kind := a.sectionKind(ptype)
+		if kind == "" {
+			kind = a.config.Kind
+		}
+		ctx = context.WithValue(ctx, ptypeKindKey{}, kind)
+	}
+	return ctx
+}
+
+// sectionKind returns the kind configured for the section of ptype, see
+// Config.PolicyKind and Config.GroupingKind, or "" if it uses Config.Kind.
+func (a *Adapter) sectionKind(ptype string) string {
+	switch {
+	case strings.HasPrefix(ptype, "p"):
+		return a.config.PolicyKind
+	case strings.HasPrefix(ptype, "g"):
+		return a.config.GroupingKind
+	}
+	return ""
+}
+
+// kind returns the kind of the rules of ctx.
+func (a *Adapter) kind(ctx context.Context) string {
+	if kind, ok := ctx.Value(ptypeKindKey{}).(string); ok {
+		return kind
+	}
+	return a.config.Kind
+}
+
+// namespaceContexts returns a context for each namespace and kind storing
+// rules, starting with ctx for the base namespace and Config.Kind.
+func (a *Adapter) namespaceContexts(ctx context.Context) []context.Context {
+	ctxs := []context.Context{ctx}
+	if len(a.config.PTypeNamespaces) > 0 {
+		seen := map[string]bool{a.namespace(ctx): true}
+		var namespaces []string
+		for _, ns := range a.config.PTypeNamespaces {
+			if !seen[ns] {
+				seen[ns] = true
+				namespaces = append(namespaces, ns)
 			}
 		}
+		sort.Strings(namespaces)
+		for _, ns := range namespaces {
+			ctxs = append(ctxs, context.WithValue(ctx, ptypeNamespaceKey{}, ns))
+		}
+	}
+
+	var all []context.Context
+	for _, ctx := range ctxs {
+		all = append(all, a.kindContexts(ctx)...)
+	}
+	return all
+}
+
+// kindContexts returns a context for each kind storing rules in the
+// namespace of ctx, starting with ctx for Config.Kind.
+func (a *Adapter) kindContexts(ctx context.Context) []context.Context {
+	ctxs := []context.Context{ctx}
+	seen := map[string]bool{a.config.Kind: true}
+	for _, kind := range []string{a.config.PolicyKind, a.config.GroupingKind} {
+		if kind != "" && !seen[kind] {
+			seen[kind] = true
+			ctxs = append(ctxs, context.WithValue(ctx, ptypeKindKey{}, kind))
+		}
+	}
+	return ctxs
+}
+
+// routed reports whether rule, found in the namespace and kind of ctx, is
+// stored where its ptype belongs.
+func (a *Adapter) routed(ctx context.Context, rule *CasbinRule) bool {
+	ptypeCtx := a.ptypeContext(ctx, rule.PType)
+	return a.namespace(ptypeCtx) == a.namespace(ctx) && a.kind(ptypeCtx) == a.kind(ctx)
+}
+
+// Datastore works most consistently if all data is inside an entity group.
+// Kinda weird, but this is how you enable ACID (instead of eventual).
+// See: https://cloud.google.com/datastore/docs/articles/balancing-strong-and-eventual-consistency-with-google-cloud-datastore#ancestor-query-and-entity-group
+func (a *Adapter) pseudoRootKey(ctx context.Context) *datastore.Key {
+	key := datastore.IDKey(a.kind(ctx), 1, nil)
+	key.Namespace = a.namespace(ctx)
+	return key
+}
+
+// ruleKey returns the key of the entity storing line, in the namespace and
+// kind of its ptype, under the ancestor picked by Config.KeyStrategy, which
+// is of the same kind.
+func (a *Adapter) ruleKey(ctx context.Context, line *CasbinRule) *datastore.Key {
+	ctx = a.ptypeContext(ctx, line.PType)
+	key := datastore.NameKey(a.kind(ctx), a.keyName(line), a.keyStrategy().Ancestor(a.pseudoRootKey(ctx), line))
+	key.Namespace = a.namespace(ctx)
+	return key
+}
+
+// newQuery returns the query every other query builds on: all entities of
+// the configured kind in the namespace and under the ancestor of ctx. It has
+// no property filter, so Datastore serves it, and any equality filters added
+// to it, from built-in indexes. Besides the rules, it matches the pseudo root
+// entity holding the Config.InsertionOrder counter, which has no ptype;
+// results must go through rulesOnly unless a filter or order on ptype
+// excludes it.
+func (a *Adapter) newQuery(ctx context.Context) *datastore.Query {
+	return a.withAncestor(ctx, datastore.NewQuery(a.kind(ctx)).Namespace(a.namespace(ctx)))
+}
+
+// withAncestor restricts query to the ancestor of ctx, if any.
+func (a *Adapter) withAncestor(ctx context.Context, query *datastore.Query) *datastore.Query {
+	if ancestor := a.ancestor(ctx); ancestor != nil {
+		return query.Ancestor(ancestor)
+	}
+	return query
+}
+
+func (a *Adapter) LoadPolicy(model model.Model) error {
+	return a.LoadPolicyCtx(context.Background(), model)
+}
+
+// LoadPolicyCtx loads all policy rules from the storage. Cancelling ctx
+// aborts the in-flight Datastore query.
+func (a *Adapter) LoadPolicyCtx(ctx context.Context, model model.Model) (err error) {
+	defer a.observe(ctx, "LoadPolicy", time.Now(), &err)
+	_, err = a.loadPolicy(ctx, model)
+	return err
+}
+
+// LoadReport reports the rules a load skipped.
+type LoadReport struct {
+	// Loaded is the number of rules loaded into the model.
+	Loaded int
+	// Skipped are the stored rules not loaded, with the reason: rules of a
+	// ptype the model doesn't define, matching ErrUndefinedPType, and with
+	// Config.SoftLoad, rules the model rejected.
+	Skipped []RuleError
+}
+
+// LoadPolicyWithReport is LoadPolicyCtx, also reporting the rules it
+// skipped. Skipped rules are also logged.
+func (a *Adapter) LoadPolicyWithReport(ctx context.Context, model model.Model) (report LoadReport, err error) {
+	defer a.observe(ctx, "LoadPolicy", time.Now(), &err)
+	return a.loadPolicy(ctx, model)
+}
+
+// loadPolicy implements LoadPolicyCtx and LoadPolicyWithReport.
+func (a *Adapter) loadPolicy(ctx context.Context, model model.Model) (report LoadReport, err error) {
+	if a.config.Debug {
+		a.logPrintln("[LoadPolicy] called - getting all db entries")
+	}
+
+	var load loadFunc = func() ([]*CasbinRule, bool, error) {
+		var limited int32
+		ctx := context.WithValue(ctx, loadLimitKey{}, &limited)
+		rules, err := a.queryNamespaces(ctx, func(ctx context.Context) *datastore.Query {
+			query := a.projected(a.newQuery(ctx))
+			if a.config.LoadLimit > 0 {
+				query = query.Limit(a.config.LoadLimit)
+			}
+			return query
+		})
+		return rules, atomic.LoadInt32(&limited) != 0, err
+	}
+	if a.config.CacheTTL > 0 {
+		uncached := load
+		load = func() ([]*CasbinRule, bool, error) {
+			return a.cachedLoad(a.baseNamespace(ctx), uncached)
+		}
+	}
+	var rules []*CasbinRule
+	var truncated bool
+	if a.config.SingleFlightLoad {
+		rules, truncated, err = a.sharedLoad(ctx, a.namespace(ctx), load)
+	} else {
+		rules, truncated, err = load()
+	}
+	if err != nil {
+		return LoadReport{}, err
+	}
+	if err := a.loadReported(rules, model, &report); err != nil {
+		return report, err
+	}
+	if truncated {
+		a.logPrintln("[LoadPolicy] warning: a query returned Config.LoadLimit rows; the policy may be incomplete")
+	}
+	a.setFiltered(truncated)
+	return report, nil
+}
+
+// loadFunc runs LoadPolicy's queries and returns the rules found and
+// whether any query was truncated by Config.LoadLimit.
+type loadFunc func() (rules []*CasbinRule, truncated bool, err error)
+
+// loadLimitKey is the context key of the flag, an *int32, that getRules
+// sets when a query returns Config.LoadLimit rows.
+type loadLimitKey struct{}
+
+// IsFiltered reports whether the last load was a partial one, like
+// LoadSectionPolicy or LoadPolicyByField. SavePolicy fails with ErrFiltered
+// until the next LoadPolicy.
+func (a *Adapter) IsFiltered() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.filtered
+}
+
+func (a *Adapter) setFiltered(filtered bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.filtered = filtered
+}
+
+// LoadSectionPolicy loads only the rules of one section ("p" or "g") into
+// model, leaving the model's other sections untouched. This makes it possible
+// to fetch e.g. the RBAC role hierarchy without the permission rules. The
+// query, a range over ptype within the policy's entity group, is only served
+// from a composite index on ptype, see README.md.
+func (a *Adapter) LoadSectionPolicy(ctx context.Context, model model.Model, sec string) (err error) {
+	defer a.observe(ctx, "LoadSectionPolicy", time.Now(), &err)
+	if a.config.Debug {
+		a.logPrintln("[LoadSectionPolicy] called:", sec)
+	}
+	if sec == "" {
+		return ErrInvalidSection
+	}
+
+	// Every ptype of a section starts with the section name, so a range
+	// query over the prefix selects exactly that section.
+	if a.config.Debug {
+		a.logPrintln("[LoadSectionPolicy] filters:", fmt.Sprintf("ptype >= %q, ptype < %q", sec, prefixEnd(sec)))
+	}
+	rules, err := a.queryNamespaces(ctx, func(ctx context.Context) *datastore.Query {
+		return a.sectionQuery(ctx, sec)
+	})
+	if a.indexFallback(err) {
+		a.logPrintln("[LoadSectionPolicy] falling back to filtering a full load in memory:", err)
+		rules, err = a.fallbackRules(ctx, a.queryNamespaces, func(rule *CasbinRule) bool {
+			return strings.HasPrefix(rule.PType, sec)
+		})
+	}
+	if err != nil {
+		return err
+	}
+	if err := a.loadLines(rules, model); err != nil {
+		return err
+	}
+	a.setFiltered(true)
+	return nil
+}
+
+// LoadPolicyByField loads only the rules of ptype whose field at fieldIndex
+// (0 for v0 up to 5 for v5) equals value, e.g. all rules touching one
+// resource, without reading the whole policy.
+func (a *Adapter) LoadPolicyByField(ctx context.Context, ptype string, fieldIndex int, value string, model model.Model) (err error) {
+	defer a.observe(a.ptypeContext(ctx, ptype), "LoadPolicyByField", time.Now(), &err)
+	if a.config.Debug {
+		a.logPrintln("[LoadPolicyByField] called:", ptype, fieldIndex, value)
+	}
+	if fieldIndex < 0 || fieldIndex > 5 {
+		return fmt.Errorf("%w: %d", ErrInvalidFieldIndex, fieldIndex)
+	}
+	ctx = a.ptypeContext(ctx, ptype)
+
+	if a.csvFormat() {
+		ctx, cancel := withDeadline(ctx, a.config.LoadSaveFilterDeadline)
+		defer cancel()
+		var rules []*CasbinRule
+		if _, rules, err = a.findFiltered(ctx, ptype, fieldIndex, value); err == nil {
+			err = a.loadLines(rules, model)
+		}
+	} else {
+		var rules []*CasbinRule
+		rules, err = a.queryAncestors(ctx, func(ctx context.Context) *datastore.Query {
+			return a.filteredQuery(ctx, ptype, fieldIndex, value)
+		})
+		if a.indexFallback(err) {
+			a.logPrintln("[LoadPolicyByField] falling back to filtering a full load in memory:", err)
+			rules, err = a.fallbackRules(ctx, a.queryAncestors, func(rule *CasbinRule) bool {
+				return rule.PType == ptype && matchesFilter(rule, fieldIndex, value)
+			})
+		}
+		if err == nil {
+			err = a.loadLines(rules, model)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	a.setFiltered(true)
+	return nil
+}
+
+// LoadPolicyByRange loads only the rules of ptype whose field at fieldIndex
+// (0 for v0 up to 5 for v5) lies between min and max, inclusive, e.g. rules
+// encoding a time or a number in that field; an empty bound leaves that end
+// of the range open. Values compare as strings, byte by byte, so numbers
+// must be zero-padded to a fixed width to compare as numbers. Datastore
+// serves the query, an equality filter on ptype with an inequality filter on
+// the field, only from a composite index on ptype and the field, see
+// README.md; without it, the load fails with an error matching
+// ErrMissingIndex, unless Config.IndexFallback is set. With
+// StorageFormatCSV, the rules of ptype are filtered in memory. Datastore
+// requires the field to be the first sort order of such a query, so
+// Config.SortOnLoad sorts the rules in memory instead.
+func (a *Adapter) LoadPolicyByRange(ctx context.Context, ptype string, fieldIndex int, min, max string, model model.Model) (err error) {
+	defer a.observe(a.ptypeContext(ctx, ptype), "LoadPolicyByRange", time.Now(), &err)
+	if a.config.Debug {
+		a.logPrintln("[LoadPolicyByRange] called:", ptype, fieldIndex, min, max)
+	}
+	if fieldIndex < 0 || fieldIndex > 5 {
+		return fmt.Errorf("%w: %d", ErrInvalidFieldIndex, fieldIndex)
+	}
+	ctx = context.WithValue(a.ptypeContext(ctx, ptype), memorySortKey{}, true)
+
+	inRange := func(rule *CasbinRule) bool {
+		value := rule.fields()[1+fieldIndex]
+		return rule.PType == ptype && (min == "" || value >= min) && (max == "" || value <= max)
+	}
+	var rules []*CasbinRule
+	if a.csvFormat() {
+		rules, err = a.fallbackRules(ctx, a.queryAncestors, inRange)
+	} else {
+		rules, err = a.queryAncestors(ctx, func(ctx context.Context) *datastore.Query {
+			return a.rangeQuery(ctx, ptype, fieldIndex, min, max)
+		})
+		if a.indexFallback(err) {
+			a.logPrintln("[LoadPolicyByRange] falling back to filtering a full load in memory:", err)
+			rules, err = a.fallbackRules(ctx, a.queryAncestors, inRange)
+		} else if isMissingIndex(err) {
+			err = fmt.Errorf("%w: %v", ErrMissingIndex, err)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if err := a.loadLines(rules, model); err != nil {
+		return err
+	}
+	a.setFiltered(true)
+	return nil
+}
+
+// sectionQuery returns LoadSectionPolicy's query of the rules of section sec.
+func (a *Adapter) sectionQuery(ctx context.Context, sec string) *datastore.Query {
+	return a.projected(a.newQuery(ctx).Filter("ptype >=", sec).Filter("ptype <", prefixEnd(sec)))
+}
+
+// rangeQuery returns LoadPolicyByRange's query of the rules of ptype whose
+// field at fieldIndex lies between min and max.
+func (a *Adapter) rangeQuery(ctx context.Context, ptype string, fieldIndex int, min, max string) *datastore.Query {
+	field := fmt.Sprintf("v%d", fieldIndex)
+	query := BuildFilterQuery(a.newQuery(ctx), ptype, 0)
+	if min != "" {
+		query = query.Filter(field+" >=", min)
+	}
+	if max != "" {
+		query = query.Filter(field+" <=", max)
+	}
+	return query
+}
+
+// LoadPolicyAcrossNamespaces loads the rules stored in each of namespaces
+// into model, e.g. for a view spanning several tenants. transform, if not
+// nil, maps the tokens of every rule of namespace ns before it is added, e.g.
+// to prefix subjects with the tenant; returning nil drops the rule. The
+// namespaces are read as a whole, in every kind storing rules, regardless
+// of Config.NamespaceFunc and Config.PTypeNamespaces. Like other partial
+// loads, it makes SavePolicy fail with ErrFiltered until the next
+// LoadPolicy.
+func (a *Adapter) LoadPolicyAcrossNamespaces(ctx context.Context, namespaces []string, model model.Model,
+	transform func(ns string, rule []string) []string) (err error) {
+
+	defer a.observe(ctx, "LoadPolicyAcrossNamespaces", time.Now(), &err)
+	if a.config.Debug {
+		a.logPrintln("[LoadPolicyAcrossNamespaces] called:", namespaces)
+	}
+
+	for _, ns := range namespaces {
+		var rules []*CasbinRule
+		for _, ctx := range a.kindContexts(context.WithValue(ctx, ptypeNamespaceKey{}, ns)) {
+			found, err := a.queryAncestors(ctx, func(ctx context.Context) *datastore.Query {
+				return a.projected(a.newQuery(ctx))
+			})
+			if err != nil {
+				return err
+			}
+			for _, line := range found {
+				if a.kind(a.ptypeContext(ctx, line.PType)) == a.kind(ctx) {
+					rules = append(rules, line)
+				}
+			}
+		}
+		for _, line := range rules {
+			if !definesPType(model, line.PType) {
+				a.logPrintln("[LoadPolicyAcrossNamespaces] skipping rule with a ptype the model doesn't define:", line.String())
+				continue
+			}
+			tokens := a.modelLine(line, model)
+			if tokens == nil {
+				continue
+			}
+			tokens = tokens[1:]
+			if transform != nil {
+				if tokens = transform(ns, tokens); tokens == nil {
+					continue
+				}
+			}
+			if err := persist.LoadPolicyArray(append([]string{line.PType}, tokens...), model); err != nil {
+				return err
+			}
+		}
+	}
+	a.setFiltered(true)
+	return nil
+}
+
+// projected restricts query to the properties selected by
+// Config.ProjectedFields, if it applies. Projected properties can't have
+// equality filters, so only queries filtering by ptype ranges qualify.
+func (a *Adapter) projected(query *datastore.Query) *datastore.Query {
+	n := a.config.ProjectedFields
+	if n <= 0 || n >= 6 || a.csvFormat() || a.config.InsertionOrder || a.config.TTLProperty != "" || a.config.ChecksumAction != "" {
+		return query
+	}
+	return query.Project([]string{"ptype", "v0", "v1", "v2", "v3", "v4"}[:n+1]...)
+}
+
+// queryNamespaces runs the query made by build for each namespace storing
+// rules and returns the rules found where their ptype belongs.
+func (a *Adapter) queryNamespaces(ctx context.Context, build func(ctx context.Context) *datastore.Query) ([]*CasbinRule, error) {
+	ctx = a.recordSeqs(ctx)
+	ctxs := a.namespaceContexts(ctx)
+	if len(ctxs) == 1 {
+		return a.queryAncestors(ctx, build)
+	}
+
+	var all []*CasbinRule
+	for _, ctx := range ctxs {
+		rules, err := a.queryAncestors(ctx, build)
+		if err != nil {
+			return nil, err
+		}
+		for _, rule := range rules {
+			if a.routed(ctx, rule) {
+				all = append(all, rule)
+			}
+		}
+	}
+	a.sortMerged(ctx, all)
+	return all, nil
+}
+
+// queryAncestors runs the query made by build for each ancestor storing rules
+// in the namespace of ctx, see Config.KeyStrategy, or once without ancestor
+// unless Config.RequireAncestor, and returns the rules found. The queries of
+// several ancestors run concurrently.
+func (a *Adapter) queryAncestors(ctx context.Context, build func(ctx context.Context) *datastore.Query) ([]*CasbinRule, error) {
+	ctx = a.recordSeqs(ctx)
+	ctxs := a.queryContexts(ctx)
+	if len(ctxs) == 1 {
+		return a.queryRules(ctxs[0], build(ctxs[0]))
+	}
+
+	// Queries are built up front, so that build needn't be safe for
+	// concurrent use.
+	queries := make([]*datastore.Query, len(ctxs))
+	for i, ctx := range ctxs {
+		queries[i] = build(ctx)
+	}
+	results := make([][]*CasbinRule, len(ctxs))
+	errs := make([]error, len(ctxs))
+	var wg sync.WaitGroup
+	for i, ctx := range ctxs {
+		wg.Add(1)
+		go func(i int, ctx context.Context) {
+			defer wg.Done()
+			results[i], errs[i] = a.queryRules(ctx, queries[i])
+		}(i, ctx)
+	}
+	wg.Wait()
+
+	var all []*CasbinRule
+	for i, rules := range results {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		all = append(all, rules...)
+	}
+	a.sortMerged(ctx, all)
+	return all, nil
+}
+
+// queryContexts returns a context for each ancestor storing rules in the
+// namespace of ctx, or a single one without ancestor unless
+// Config.RequireAncestor.
+func (a *Adapter) queryContexts(ctx context.Context) []context.Context {
+	if !*a.config.RequireAncestor {
+		// A nil ancestor lifts the restriction, see withAncestor.
+		return []context.Context{context.WithValue(ctx, ancestorKey{}, (*datastore.Key)(nil))}
+	}
+	return a.ancestorContexts(ctx)
+}
+
+// memorySortKey is the context key marking queries that Config.SortOnLoad
+// sorts in memory, as Datastore can't order them by all rule fields.
+type memorySortKey struct{}
+
+// queryRules runs query and returns the resulting rules.
+func (a *Adapter) queryRules(ctx context.Context, query *datastore.Query) ([]*CasbinRule, error) {
+	var rules []*CasbinRule
+
+	query = a.readQuery(ctx, query)
+
+	ctx, cancel := withDeadline(ctx, a.config.LoadSaveFilterDeadline)
+	defer cancel()
+	err := a.retry(ctx, func(db *datastore.Client) error {
+		var err error
+		rules, err = a.getRules(ctx, db, query)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if a.config.SortOnLoad && !a.config.InsertionOrder && a.memorySort(ctx) {
+		sortRules(rules)
+	}
+
+	return rules, nil
+}
+
+// readQuery returns query with the options of every read of rules: eventual
+// consistency with Config.StaleReads and the orders of Config.SortOnLoad.
+func (a *Adapter) readQuery(ctx context.Context, query *datastore.Query) *datastore.Query {
+	if a.config.StaleReads {
+		query = query.EventualConsistency()
+	}
+	return a.ordered(ctx, query)
+}
+
+// ordered returns query ordered by all rule fields, if Config.SortOnLoad
+// has Datastore sort the queries of ctx.
+func (a *Adapter) ordered(ctx context.Context, query *datastore.Query) *datastore.Query {
+	if !a.config.SortOnLoad || a.config.InsertionOrder || a.memorySort(ctx) {
+		return query
+	}
+	// Ranges over ptype, like LoadSectionPolicy's, require ptype to be the
+	// first order.
+	for _, field := range []string{"ptype", "v0", "v1", "v2", "v3", "v4", "v5"} {
+		query = query.Order(field)
+	}
+	return query
+}
+
+// memorySort reports whether Config.SortOnLoad sorts the rules queried with
+// ctx in memory: with StorageFormatCSV, the fields aren't indexed, so
+// Datastore can't order by them, and ctx may be marked by memorySortKey.
+func (a *Adapter) memorySort(ctx context.Context) bool {
+	return a.csvFormat() || ctx.Value(memorySortKey{}) != nil
+}
+
+// indexFallback reports whether a filtered load failing with err falls back
+// to a full load, see Config.IndexFallback.
+func (a *Adapter) indexFallback(err error) bool {
+	return a.config.IndexFallback && isMissingIndex(err)
+}
+
+// fallbackRules runs LoadPolicy's query, without projection, with query and
+// returns the rules keep accepts.
+func (a *Adapter) fallbackRules(ctx context.Context,
+	query func(ctx context.Context, build func(ctx context.Context) *datastore.Query) ([]*CasbinRule, error),
+	keep func(rule *CasbinRule) bool) ([]*CasbinRule, error) {
+
+	rules, err := query(ctx, a.newQuery)
+	if err != nil {
+		return nil, err
+	}
+	n := 0
+	for _, rule := range rules {
+		if keep(rule) {
+			rules[n] = rule
+			n++
+		}
+	}
+	return rules[:n], nil
+}
+
+// LoadPolicyArray returns all stored rules grouped by ptype, split into
+// policy rules (section "p") and grouping rules (section "g"), without
+// needing a model. Trailing empty fields are dropped from every rule.
+func (a *Adapter) LoadPolicyArray(ctx context.Context) (pRules map[string][][]string, gRules map[string][][]string, err error) {
+	defer a.observe(ctx, "LoadPolicyArray", time.Now(), &err)
+	if a.config.Debug {
+		a.logPrintln("[LoadPolicyArray] called")
+	}
+
+	rules, err := a.queryNamespaces(ctx, func(ctx context.Context) *datastore.Query {
+		return a.projected(a.newQuery(ctx))
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pRules = make(map[string][][]string)
+	gRules = make(map[string][][]string)
+	for _, rule := range rules {
+		tokens := trimTrailingEmpty(rule.fields()[1:])
+		switch {
+		case strings.HasPrefix(rule.PType, "p"):
+			pRules[rule.PType] = append(pRules[rule.PType], tokens)
+		case strings.HasPrefix(rule.PType, "g"):
+			gRules[rule.PType] = append(gRules[rule.PType], tokens)
+		}
+	}
+	return pRules, gRules, nil
+}
+
+// ForEachRule calls fn with every stored rule, streaming the rules from
+// Datastore as they are read instead of loading them all first, e.g. to
+// populate custom structures or validate the stored policy without a model.
+// An error returned by fn stops the iteration and is returned. Rules are
+// read with LoadPolicy's queries, including Config.ProjectedFields and the
+// orders of Config.SortOnLoad, and skipped like LoadPolicy skips them, see
+// Config.TTLProperty and Config.ChecksumAction. Unlike LoadPolicy, it
+// doesn't merge the results of several queries, e.g. of
+// Config.KeyStrategy's ancestors, into one order, nor sort them by
+// Config.InsertionOrder, as that needs all rules in memory. A read retried
+// after a transient failure resumes after the last rule passed to fn.
+func (a *Adapter) ForEachRule(ctx context.Context, fn func(rule *CasbinRule) error) (err error) {
+	defer a.observe(ctx, "ForEachRule", time.Now(), &err)
+	if a.config.Debug {
+		a.logPrintln("[ForEachRule] called")
+	}
+
+	ctx, cancel := withDeadline(ctx, a.config.LoadSaveFilterDeadline)
+	defer cancel()
+
+	for _, ctx := range a.namespaceContexts(ctx) {
+		for _, ctx := range a.queryContexts(ctx) {
+			build := func() *datastore.Query {
+				return a.readQuery(ctx, a.projected(a.newQuery(ctx)))
+			}
+			err := a.streamRules(ctx, build, func(rule *CasbinRule) error {
+				if !a.routed(ctx, rule) {
+					return nil
+				}
+				return fn(rule)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// loadLines loads lines into model. Lines whose ptype the model doesn't
+// define are skipped with a warning, so that a model/storage drift doesn't
+// prevent loading the rest of the policy.
+func (a *Adapter) loadLines(lines []*CasbinRule, model model.Model) error {
+	return a.loadReported(lines, model, &LoadReport{})
+}
+
+// loadReported is loadLines, recording the loaded and skipped rules in
+// report. With Config.SoftLoad, rules the model rejects are skipped instead
+// of failing the load.
+func (a *Adapter) loadReported(lines []*CasbinRule, model model.Model, report *LoadReport) error {
+	for _, l := range lines {
+		if !definesPType(model, l.PType) {
+			a.logPrintln("[LoadPolicy] skipping rule with a ptype the model doesn't define:", l.String())
+			report.Skipped = append(report.Skipped, RuleError{Rule: l, Err: ErrUndefinedPType})
+			continue
+		}
+		line := a.modelLine(l, model)
+		if line == nil {
+			continue
+		}
+		if err := persist.LoadPolicyArray(line, model); err != nil {
+			if !a.config.SoftLoad {
+				return err
+			}
+			a.logPrintln("[LoadPolicy] skipping rule the model rejects:", l.String(), err)
+			report.Skipped = append(report.Skipped, RuleError{Rule: l, Err: err})
+			continue
+		}
+		report.Loaded++
+	}
+
+	return nil
+}
+
+// modelLine returns the ptype of line followed by its tokens as they are
+// loaded into model, after Config.LoadTransform, or nil if the transform
+// skips the rule.
+func (a *Adapter) modelLine(line *CasbinRule, model model.Model) []string {
+	tokens := policyLine(*line, model)
+	if a.config.LoadTransform == nil {
+		return tokens
+	}
+	fields := a.config.LoadTransform(line.PType, tokens[1:])
+	if fields == nil {
+		return nil
+	}
+	return append([]string{line.PType}, fields...)
+}
+
+// definesPType reports whether model has an assertion for ptype.
+func definesPType(model model.Model, ptype string) bool {
+	if ptype == "" {
+		return false
+	}
+	_, ok := model[ptype[:1]][ptype]
+	return ok
+}
+
+// prefixEnd returns the exclusive upper bound of the range of strings
+// starting with prefix. Section names are ASCII, so bumping the last byte
+// is enough.
+func prefixEnd(prefix string) string {
+	b := []byte(prefix)
+	b[len(b)-1]++
+	return string(b)
+}
+
+func (a *Adapter) SavePolicy(model model.Model) error {
+	return a.SavePolicyCtx(context.Background(), model)
+}
+
+// SavePolicyCtx replaces all stored policy rules with the rules of model. It
+// fails with ErrFiltered after a partial load, see IsFiltered.
+func (a *Adapter) SavePolicyCtx(ctx context.Context, model model.Model) error {
+	_, err := a.SavePolicyWithResult(ctx, model)
+	return err
+}
+
+// SaveResult reports what a SavePolicyWithResult call changed in the storage.
+type SaveResult struct {
+	// Added is the number of rules written that weren't stored before.
+	Added int
+	// Deleted is the number of stored rules that were removed.
+	Deleted int
+	// Unchanged is the number of rules that were already stored as is.
+	Unchanged int
+}
+
+// Changed reports whether the save modified the storage at all.
+func (r SaveResult) Changed() bool {
+	return r.Added > 0 || r.Deleted > 0
+}
+
+// SavePolicyWithResult is SavePolicyCtx, additionally reporting how many rules
+// were added, deleted or left unchanged. Only the difference between the
+// stored rules and model is written: rules stored as is aren't rewritten, so
+// they keep their metadata, see ContextWithMeta, and creation time, see
+// Config.CreatedProperty. It is written in a single transaction if it fits,
+// i.e. has less than 500 mutations; otherwise in several, so that an error
+// may leave it partially written. Cancelling ctx then lets the transaction
+// being committed finish, bounded by Config.AddRemoveDeadline, and stops
+// before the next one. A save stopped after committing some transactions
+// fails with a *PartialError, see ErrPartiallyApplied, telling how much was
+// applied; saving again completes it. The result and the published events
+// then cover the applied part.
+func (a *Adapter) SavePolicyWithResult(ctx context.Context, model model.Model) (result SaveResult, err error) {
+	defer a.observe(ctx, "SavePolicy", time.Now(), &err)
+	return a.savePolicy(ctx, "SavePolicy", model, false)
+}
+
+// savePolicy implements SavePolicyWithResult and, if withModel is set,
+// SaveModelAndPolicy, op being the name of the method called.
+func (a *Adapter) savePolicy(ctx context.Context, op string, model model.Model, withModel bool) (result SaveResult, err error) {
+	if err := a.checkWritable(); err != nil {
+		return SaveResult{}, err
+	}
+	if a.IsFiltered() {
+		return SaveResult{}, ErrFiltered
+	}
+
+	ctx, cancel := withDeadline(ctx, a.config.LoadSaveFilterDeadline)
+	defer cancel()
+	if a.config.Debug {
+		a.logPrintln("[SavePolicy] called:", op)
+	}
+
+	// order keeps the model's order of the rules for Config.InsertionOrder.
+	wanted := make(map[string]*CasbinRule)
+	var order []string
+
+	// Only the rules the save changed are published, including those of
+	// ptypes missing from model.
+	var ms []Mutation
+	var d saveDiff
+	defer func() {
+		a.afterMutations(ctx, ms, func() []PolicyEvent { return a.diffEvents(ctx, d) }, &err)
+	}()
+	for _, sec := range []string{"p", "g"} {
+		for ptype, ast := range model[sec] {
+			for _, rule := range ast.Policy {
+				if err := a.validateRule(ptype, rule); err != nil {
+					return SaveResult{}, err
+				}
+				line := a.storedLine(ptype, rule)
+				if order, err = a.addWanted(wanted, order, &line); err != nil {
+					return SaveResult{}, err
+				}
+			}
+			m := Mutation{Op: op, PType: ptype, Rules: ast.Policy}
+			if err := a.beforeMutate(ctx, m); err != nil {
+				return SaveResult{}, err
+			}
+			ms = append(ms, m)
+		}
+	}
+
+	if withModel {
+		d, err = a.saveWithModel(ctx, wanted, order, model.ToText())
+	} else {
+		d, err = a.saveRules(ctx, wanted, order, a.storedRules)
+	}
+	if err != nil || a.config.SnapshotRetention <= 0 {
+		return d.result, err
+	}
+	lines := make([]*CasbinRule, len(order))
+	for i, name := range order {
+		lines[i] = wanted[name]
+	}
+	if err := a.writeSnapshot(ctx, lines); err != nil {
+		return d.result, fmt.Errorf("datastoreadapter: policy saved, but not its snapshot: %w", err)
+	}
+	return d.result, nil
+}
+
+// addWanted adds line to wanted, the rules to save by key name, and its key
+// name to order, the order to put new rules in. A line whose key name is
+// already wanted is handled per Config.DuplicateAction.
+func (a *Adapter) addWanted(wanted map[string]*CasbinRule, order []string, line *CasbinRule) ([]string, error) {
+	name := a.keyName(line)
+	if dup, ok := wanted[name]; ok {
+		if a.config.DuplicateAction == DuplicateError {
+			return order, fmt.Errorf("%w: %q and %q", ErrDuplicateRule, dup.fields(), line.fields())
+		}
+		a.logPrintln("[SavePolicy] skipping duplicate rule:", line.String())
+		return order, nil
+	}
+	wanted[name] = line
+	return append(order, name), nil
+}
+
+// saveRules replaces the rules returned by stored, reading within tx unless
+// it is nil, with wanted, the rules to save by key name, putting new rules
+// in order, and returns the difference written. A save that fits a single
+// transaction is atomic. Larger ones are split into chunks, each committed
+// on its own; if one fails, the difference the chunks before it wrote is
+// returned with the *PartialError.
+func (a *Adapter) saveRules(ctx context.Context, wanted map[string]*CasbinRule, order []string,
+	stored func(ctx context.Context, db *datastore.Client, tx *datastore.Transaction) ([]*datastore.Key, []*CasbinRule, error)) (saveDiff, error) {
+
+	var d saveDiff
+	err := a.retry(ctx, func(db *datastore.Client) error {
+		_, err := db.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+			// Looking the stored rules up inside the transaction guarantees
+			// that rules written concurrently are either seen here or make
+			// the commit fail, so no stragglers survive.
+			keys, rules, err := stored(ctx, db, tx)
+			if err != nil {
+				return err
+			}
+			d = a.diff(ctx, keys, rules, wanted, order)
+			if d.mutations() > maxPutsPerTx {
+				return errChunked
+			}
+
+			if len(d.deleteKeys) > 0 {
+				if err := tx.DeleteMulti(d.deleteKeys); err != nil {
+					return rulesError(err, d.deleted)
+				}
+			}
+			if len(d.putKeys) == 0 {
+				return nil
+			}
+			return a.putRules(ctx, tx, d.putKeys, d.putLines, false)
+		})
+		return err
+	})
+	switch err {
+	case nil:
+		a.reportProgress(d.mutations(), d.mutations())
+	case errChunked:
+		if a.config.Debug {
+			a.logPrintln("[SavePolicy] saving", d.mutations(), "mutations in chunks")
+		}
+		err = a.retry(ctx, func(db *datastore.Client) error {
+			keys, rules, err := stored(ctx, db, nil)
+			d = a.diff(ctx, keys, rules, wanted, order)
+			return err
+		})
+		if err == nil {
+			var applied saveDiff
+			if applied, err = a.saveChunked(ctx, d); err != nil {
+				// The chunks committed before the failure stay written.
+				return applied, err
+			}
+		}
+	}
+	if err != nil {
+		return saveDiff{}, err
 	}
 
-	res, added := appendOrTerminate(res, cr.PType)
-	if !added {
-		return res
+	if a.config.Debug {
+		a.logPrintln("[SavePolicy] done:", d.result.Added, "added,", d.result.Deleted, "deleted,", d.result.Unchanged, "unchanged")
 	}
+	return d, nil
+}
 
-	res, added = appendOrTerminate(res, cr.V0)
-	if !added {
-		return res
-	}
+// SavePolicyForPType replaces the stored rules of ptype with rules, leaving
+// the other ptypes untouched. Like SavePolicy, it writes only the
+// difference, in one transaction unless it is too large for one.
+func (a *Adapter) SavePolicyForPType(ctx context.Context, ptype string, rules [][]string) (err error) {
+	defer a.observe(a.ptypeContext(ctx, ptype), "SavePolicyForPType", time.Now(), &err)
+	_, err = a.replacePType(ctx, "SavePolicyForPType", ptype, rules)
+	return err
+}
 
-	res, added = appendOrTerminate(res, cr.V1)
-	if !added {
-		return res
+// ReplacePolicy is SavePolicyForPType, additionally returning the rules it
+// added and removed, e.g. to notify other instances or write an audit log.
+// Trailing empty fields are dropped from every returned rule. Like
+// SavePolicy, a replacement too large for one transaction is written in
+// several, so that an error may leave it partially written.
+func (a *Adapter) ReplacePolicy(ctx context.Context, ptype string, newRules [][]string) (added, removed [][]string, err error) {
+	defer a.observe(a.ptypeContext(ctx, ptype), "ReplacePolicy", time.Now(), &err)
+	d, err := a.replacePType(ctx, "ReplacePolicy", ptype, newRules)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, line := range d.putLines {
+		added = append(added, trimTrailingEmpty(line.fields()[1:]))
+	}
+	for _, line := range append(d.deleted, d.overwritten...) {
+		removed = append(removed, trimTrailingEmpty(line.fields()[1:]))
 	}
+	return added, removed, nil
+}
 
-	res, added = appendOrTerminate(res, cr.V2)
-	if !added {
-		return res
+// replacePType replaces the stored rules of ptype with rules for the method
+// op and returns the difference it wrote.
+func (a *Adapter) replacePType(ctx context.Context, op string, ptype string, rules [][]string) (d saveDiff, err error) {
+	if err := a.checkWritable(); err != nil {
+		return saveDiff{}, err
 	}
 
-	res, added = appendOrTerminate(res, cr.V3)
-	if !added {
-		return res
+	ctx, cancel := withDeadline(a.ptypeContext(ctx, ptype), a.config.LoadSaveFilterDeadline)
+	defer cancel()
+	if a.config.Debug {
+		a.logPrintln("[ReplacePolicy] called:", ptype, len(rules), "rules")
 	}
 
-	res, added = appendOrTerminate(res, cr.V4)
-	if !added {
-		return res
+	wanted := make(map[string]*CasbinRule)
+	var order []string
+	for _, rule := range rules {
+		if err := a.validateRule(ptype, rule); err != nil {
+			return saveDiff{}, err
+		}
+		line := a.storedLine(ptype, rule)
+		if order, err = a.addWanted(wanted, order, &line); err != nil {
+			return saveDiff{}, err
+		}
+	}
+	m := Mutation{Op: op, PType: ptype, Rules: rules}
+	if err := a.beforeMutate(ctx, m); err != nil {
+		return saveDiff{}, err
 	}
+	defer a.afterMutations(ctx, []Mutation{m}, func() []PolicyEvent { return a.diffEvents(ctx, d) }, &err)
 
-	res, added = appendOrTerminate(res, cr.V5)
-	return res
+	return a.saveRules(ctx, wanted, order, func(ctx context.Context, db *datastore.Client, tx *datastore.Transaction) ([]*datastore.Key, []*CasbinRule, error) {
+		return a.findFilteredTx(ctx, db, tx, ptype, 0)
+	})
 }
 
-type Config struct {
-	// Datastore kind name.
-	// Optional. (Default: "casbin")
-	Kind string
-	// Datastore namespace.
-	// Optional. (Default: "")
-	Namespace string
-	// Enables debug info to show database calls
-	Debug bool
-
-	// Configures max time for long running operations like LoadPolicy,
-	// SavePolicy, RemoveFilteredPolicy. These may take seconds or minutes
-	LoadSaveFilterDeadline time.Duration
-	// Configures max time for quick incremental operations like AddPolicy
-	// and RemovePolicy. These largely take under 150ms
-	AddRemoveDeadline time.Duration
+// errChunked aborts the transaction of a save too large for it.
+var errChunked = errors.New("datastoreadapter: save needs chunking")
+
+// saveDiff is what SavePolicy needs to write.
+type saveDiff struct {
+	deleteKeys []*datastore.Key
+	deleted    []*CasbinRule
+	// overwritten are the stored rules replaced by a put under their key.
+	overwrittenKeys []*datastore.Key
+	overwritten     []*CasbinRule
+	putKeys         []*datastore.Key
+	putLines        []*CasbinRule
+	result          SaveResult
 }
 
-// adapter represents the GCP datastore adapter for policy storage.
-type adapter struct {
-	db     *datastore.Client
-	config Config
+// prefix returns the part of d written by its first deletes deletes and
+// puts puts, the order saveChunked writes them in.
+func (d saveDiff) prefix(deletes, puts int) saveDiff {
+	p := saveDiff{
+		deleteKeys: d.deleteKeys[:deletes],
+		deleted:    d.deleted[:deletes],
+		putKeys:    d.putKeys[:puts],
+		putLines:   d.putLines[:puts],
+	}
+	put := make(map[string]bool, puts)
+	for _, key := range p.putKeys {
+		put[key.Name] = true
+	}
+	for i, key := range d.overwrittenKeys {
+		if put[key.Name] {
+			p.overwrittenKeys = append(p.overwrittenKeys, key)
+			p.overwritten = append(p.overwritten, d.overwritten[i])
+		}
+	}
+	p.result = SaveResult{Added: puts, Deleted: deletes + len(p.overwritten), Unchanged: d.result.Unchanged}
+	return p
 }
 
-// finalizer is the destructor for adapter.
-func finalizer(a *adapter) {
-	a.close()
+// diffEvents returns the events of the rules d removed and added, see
+// changeEvents.
+func (a *Adapter) diffEvents(ctx context.Context, d saveDiff) []PolicyEvent {
+	removed := append(append([]*CasbinRule(nil), d.deleted...), d.overwritten...)
+	return a.changeEvents(ctx, removed, d.putLines)
 }
 
-func (a *adapter) close() {
-	a.db.Close()
+func (d saveDiff) mutations() int {
+	return len(d.deleteKeys) + len(d.putKeys)
 }
 
-// NewAdapter is the constructor for Adapter. A valid datastore client must be provided.
-func NewAdapter(db *datastore.Client) persist.Adapter {
-	return NewAdapterWithConfig(db, Config{})
+// storedRules returns all stored rules and their keys, reading within tx
+// unless it is nil.
+func (a *Adapter) storedRules(ctx context.Context, db *datastore.Client, tx *datastore.Transaction) ([]*datastore.Key, []*CasbinRule, error) {
+	var keys []*datastore.Key
+	var stored []*CasbinRule
+	for _, ctx := range a.scopeContexts(ctx) {
+		query := a.newQuery(ctx)
+		if tx != nil {
+			query = query.Transaction(tx)
+		}
+		var rules []*CasbinRule
+		found, err := db.GetAll(ctx, query, &rules)
+		if err != nil {
+			return nil, nil, err
+		}
+		found, rules = rulesOnly(found, rules)
+		keys = append(keys, found...)
+		stored = append(stored, rules...)
+	}
+	return keys, stored, nil
 }
 
-// NewAdapter is the constructor for Adapter. A valid datastore client must be provided.
-func NewAdapterWithConfig(db *datastore.Client, config Config) persist.Adapter {
-	// Initializing config default values
-	if strings.TrimSpace(config.Kind) == "" {
-		config.Kind = casbinKind
-	}
-	// Namespace default value of "" is okay
-	// Debug default value of false is okay
-	if config.LoadSaveFilterDeadline == 0 {
-		config.LoadSaveFilterDeadline = time.Minute * 10
+// diff compares the stored rules with wanted, the rules to save by key name,
+// and returns the mutations turning the former into the latter. New rules
+// are put in order.
+func (a *Adapter) diff(ctx context.Context, keys []*datastore.Key, stored []*CasbinRule, wanted map[string]*CasbinRule, order []string) saveDiff {
+	var d saveDiff
+	unchanged := make(map[string]bool)
+	for i, key := range keys {
+		line, ok := wanted[key.Name]
+		if ok && !key.Equal(a.ruleKey(a.ptypeContext(ctx, line.PType), line)) {
+			// Stored outside the namespace of its ptype or the ancestor
+			// picked by Config.KeyStrategy.
+			ok = false
+		}
+		switch {
+		case ok && *line == *stored[i]:
+			unchanged[key.Name] = true
+			d.result.Unchanged++
+		case ok:
+			// Same key but different fields (written by an older
+			// version); the put overwrites it.
+			d.overwrittenKeys = append(d.overwrittenKeys, key)
+			d.overwritten = append(d.overwritten, stored[i])
+			d.result.Deleted++
+		default:
+			d.deleteKeys = append(d.deleteKeys, key)
+			d.deleted = append(d.deleted, stored[i])
+			d.result.Deleted++
+		}
 	}
-	if config.AddRemoveDeadline == 0 {
-		config.AddRemoveDeadline = time.Second * 30
+	if a.config.Debug {
+		a.logPrintln("[SavePolicy] keys to drop:", d.deleteKeys)
 	}
 
-	a := &adapter{
-		db:     db,
-		config: config,
+	for _, name := range order {
+		if unchanged[name] {
+			continue
+		}
+		d.putKeys = append(d.putKeys, a.ruleKey(a.ptypeContext(ctx, wanted[name].PType), wanted[name]))
+		d.putLines = append(d.putLines, wanted[name])
 	}
+	d.result.Added = len(d.putKeys)
+	return d
+}
 
-	// Call the destructor when the object is released.
-	runtime.SetFinalizer(a, finalizer)
+// saveChunked writes d in transactions of at most maxMutationsPerTx
+// mutations, reporting progress after each, and returns the part of d it
+// wrote.
+func (a *Adapter) saveChunked(ctx context.Context, d saveDiff) (saveDiff, error) {
+	total := d.mutations()
+	done := 0
+
+	keys, rules := d.deleteKeys, d.deleted
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > maxMutationsPerTx {
+			n = maxMutationsPerTx
+		}
+		if err := a.deleteChunked(ctx, keys[:n], rules[:n], nil); err != nil {
+			return d.prefix(done, 0), partial(err, done, total)
+		}
+		keys, rules = keys[n:], rules[n:]
+		done += n
+		a.reportProgress(done, total)
+	}
 
-	return a
+	puts := 0
+	err := a.putChunked(ctx, d.putKeys, d.putLines, false, func(n int) {
+		done += n
+		puts += n
+		a.reportProgress(done, total)
+	})
+	return d.prefix(len(d.deleteKeys), puts), partial(err, done, total)
 }
 
-// Datastore works most consistently if all data is inside an entity group.
-// Kinda weird, but this is how you enable ACID (instead of eventual).
-// See: https://cloud.google.com/datastore/docs/articles/balancing-strong-and-eventual-consistency-with-google-cloud-datastore#ancestor-query-and-entity-group
-func (a *adapter) pseudoRootKey() *datastore.Key {
-	key := datastore.IDKey(a.config.Kind, 1, nil)
-	key.Namespace = a.config.Namespace
-	return key
+// partial returns err as a *PartialError if done of total mutations were
+// applied before it, else unchanged.
+func partial(err error, done, total int) error {
+	if err == nil || done == 0 {
+		return err
+	}
+	return &PartialError{Done: done, Total: total, Err: err}
 }
 
-func (a *adapter) newQuery() *datastore.Query {
-	return datastore.NewQuery(a.config.Kind).Namespace(a.config.Namespace).Filter("ptype >", "").Ancestor(a.pseudoRootKey())
+// putChunked puts lines under keys using one transaction per maxPutsPerTx
+// rules, calling chunkDone, if set, with the number of rules of every
+// committed chunk. Chunks committed before a failure stay written. A
+// cancelled ctx stops it between chunks, see chunkContext.
+func (a *Adapter) putChunked(ctx context.Context, keys []*datastore.Key, lines []*CasbinRule, insert bool, chunkDone func(n int)) error {
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > maxPutsPerTx {
+			n = maxPutsPerTx
+		}
+		chunk, chunkLines := keys[:n], lines[:n]
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		chunkCtx, cancel := a.chunkContext(ctx)
+		err := a.retry(chunkCtx, func(db *datastore.Client) error {
+			_, err := db.RunInTransaction(chunkCtx, func(tx *datastore.Transaction) error {
+				return a.putRules(chunkCtx, tx, chunk, chunkLines, insert)
+			})
+			return insertConflict(err, chunkLines)
+		})
+		cancel()
+		if err != nil {
+			return err
+		}
+		keys, lines = keys[n:], lines[n:]
+		if chunkDone != nil {
+			chunkDone(n)
+		}
+	}
+	return nil
 }
 
-func (a *adapter) LoadPolicy(model model.Model) error {
-	var rules []*CasbinRule
-	if a.config.Debug {
-		log.Println("[LoadPolicy] called - getting all db entries")
+// reportProgress calls Config.OnProgress, if set.
+func (a *Adapter) reportProgress(done, total int) {
+	if a.config.OnProgress != nil {
+		a.config.OnProgress(done, total)
 	}
+}
 
-	ctx, cancel := context.WithTimeout(
-		context.Background(), a.config.LoadSaveFilterDeadline)
-	defer cancel()
-	query := a.newQuery()
-	_, err := a.db.GetAll(ctx, query, &rules)
+func (a *Adapter) AddPolicy(sec string, ptype string, rule []string) error {
+	return a.AddPolicyCtx(context.Background(), sec, ptype, rule)
+}
 
-	if err != nil {
+// AddPolicyCtx adds a policy rule to the storage.
+func (a *Adapter) AddPolicyCtx(ctx context.Context, sec string, ptype string, rule []string) (err error) {
+	defer a.observe(a.ptypeContext(ctx, ptype), "AddPolicy", time.Now(), &err)
+	return a.addPolicy(ctx, ptype, rule)
+}
+
+// addPolicy implements AddPolicyCtx, without observing it, so that
+// AddPoliciesCtx can take it for a single rule.
+func (a *Adapter) addPolicy(ctx context.Context, ptype string, rule []string) (err error) {
+	if err := a.checkWritable(); err != nil {
+		return err
+	}
+	if err := a.validateRule(ptype, rule); err != nil {
+		return err
+	}
+	m := Mutation{Op: "AddPolicy", PType: ptype, Rules: [][]string{rule}}
+	if err := a.beforeMutate(ctx, m); err != nil {
 		return err
 	}
+	defer a.afterMutate(ctx, m, &err)
+
+	ctx, cancel := withDeadline(a.ptypeContext(ctx, ptype), a.config.AddRemoveDeadline)
+	defer cancel()
+
+	line := a.storedLine(ptype, rule)
+	key := a.ruleKey(ctx, &line)
 
-	for _, l := range rules {
-		loadPolicyLine(*l, model)
+	if a.config.Debug {
+		a.logPrintln("[AddPolicy] called:", line.String())
+	}
+	if a.stage(ctx, key, &line, false) {
+		return nil
 	}
 
-	return nil
+	return a.retry(ctx, func(db *datastore.Client) error {
+		if !a.config.InsertionOrder && !a.config.InsertOnly && a.config.CreatedProperty == "" {
+			_, err := db.Put(ctx, key, a.entity(ctx, &line))
+			return err
+		}
+		lines := []*CasbinRule{&line}
+		_, err := db.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+			return a.putRules(ctx, tx, []*datastore.Key{key}, lines, a.config.InsertOnly)
+		})
+		return insertConflict(err, lines)
+	})
+}
+
+func (a *Adapter) RemovePolicy(sec string, ptype string, rule []string) error {
+	return a.RemovePolicyCtx(context.Background(), sec, ptype, rule)
+}
+
+// RemovePolicyCtx removes a policy rule from the storage.
+func (a *Adapter) RemovePolicyCtx(ctx context.Context, sec string, ptype string, rule []string) (err error) {
+	defer a.observe(a.ptypeContext(ctx, ptype), "RemovePolicy", time.Now(), &err)
+	return a.removePolicy(ctx, ptype, rule)
 }
 
-func (a *adapter) SavePolicy(model model.Model) error {
-	ctx, cancel := context.WithTimeout(
-		context.Background(), a.config.LoadSaveFilterDeadline)
+// removePolicy implements RemovePolicyCtx, without observing it, so that
+// RemovePoliciesCtx can take it for a single rule.
+func (a *Adapter) removePolicy(ctx context.Context, ptype string, rule []string) (err error) {
+	if err := a.checkWritable(); err != nil {
+		return err
+	}
+	m := Mutation{Op: "RemovePolicy", PType: ptype, Rules: [][]string{rule}}
+	if err := a.beforeMutate(ctx, m); err != nil {
+		return err
+	}
+	defer a.afterMutate(ctx, m, &err)
+
+	ctx, cancel := withDeadline(a.ptypeContext(ctx, ptype), a.config.AddRemoveDeadline)
 	defer cancel()
+
+	line := a.storedLine(ptype, rule)
+	key := a.ruleKey(ctx, &line)
+
 	if a.config.Debug {
-		log.Println("[SavePolicy] called")
+		a.logPrintln("[RemovePolicy] called:", line.String())
+	}
+	if a.stage(ctx, key, &line, true) {
+		return nil
 	}
 
-	// Drop all casbin entities
-	keys, err := a.db.GetAll(ctx, a.newQuery().KeysOnly(), nil)
-	if err != nil {
-		return err
+	return a.retry(ctx, func(db *datastore.Client) error {
+		return db.Delete(ctx, key)
+	})
+}
+
+func (a *Adapter) RemoveFilteredPolicy(sec string, ptype string,
+	fieldIndex int, fieldValues ...string) error {
+	return a.RemoveFilteredPolicyCtx(context.Background(), sec, ptype, fieldIndex, fieldValues...)
+}
+
+// RemoveFilteredPolicyCtx removes policy rules that match the filter from the storage.
+func (a *Adapter) RemoveFilteredPolicyCtx(ctx context.Context, sec string, ptype string,
+	fieldIndex int, fieldValues ...string) error {
+	_, err := a.RemoveFilteredPolicyWithResult(ctx, sec, ptype, fieldIndex, fieldValues...)
+	return err
+}
+
+// RemoveFilteredPolicyWithResult is RemoveFilteredPolicyCtx, also returning
+// the removed rules without their trailing empty fields, e.g. to publish
+// revocations. They are read in the transaction deleting them, so they are
+// exactly the rules deleted, even under concurrent writes.
+func (a *Adapter) RemoveFilteredPolicyWithResult(ctx context.Context, sec string, ptype string,
+	fieldIndex int, fieldValues ...string) (removed [][]string, err error) {
+	defer a.observe(a.ptypeContext(ctx, ptype), "RemoveFilteredPolicy", time.Now(), &err)
+
+	if err := a.checkWritable(); err != nil {
+		return nil, err
+	}
+	if err := a.checkBroadDelete(ctx, ptype, fieldIndex, fieldValues...); err != nil {
+		return nil, err
 	}
+	m := Mutation{Op: "RemoveFilteredPolicy", PType: ptype, Filter: &FilterSpec{FieldIndex: fieldIndex, FieldValues: fieldValues}}
+	if err := a.beforeMutate(ctx, m); err != nil {
+		return nil, err
+	}
+	defer a.afterMutate(ctx, m, &err)
 	if a.config.Debug {
-		log.Println("[SavePolicy] keys to drop:", keys)
+		a.logPrintln("[RemoveFilteredPolicy] called")
 	}
 
-	var lines []*CasbinRule
+	ctx, cancel := withDeadline(a.ptypeContext(ctx, ptype), a.config.LoadSaveFilterDeadline)
+	defer cancel()
+
+	// Querying inside the transaction makes the delete atomic with it: rules
+	// added or changed concurrently either are seen here or abort the commit.
+	var deleted []*CasbinRule
+	err = a.retry(ctx, func(db *datastore.Client) error {
+		_, err := db.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+			keys, rules, err := a.findFilteredTx(ctx, db, tx, ptype, fieldIndex, fieldValues...)
+			deleted = rules
+			if err != nil || len(keys) == 0 {
+				return err
+			}
+			return rulesError(tx.DeleteMulti(keys), rules)
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	for ptype, ast := range model["p"] {
-		for _, rule := range ast.Policy {
-			line := savePolicyLine(ptype, rule)
-			lines = append(lines, &line)
-		}
+	removed = make([][]string, len(deleted))
+	for i, rule := range deleted {
+		removed[i] = trimTrailingEmpty(rule.fields()[1:])
 	}
+	return removed, nil
+}
 
-	for ptype, ast := range model["g"] {
-		for _, rule := range ast.Policy {
-			line := savePolicyLine(ptype, rule)
-			lines = append(lines, &line)
-		}
+// FindBySubject returns every stored rule, of any ptype, with a field equal
+// to subject, e.g. to show what a user can do and which roles they have.
+// Every returned rule starts with its ptype, like the lines of a policy
+// file, and has its trailing empty fields dropped. Rules are sorted by
+// ptype, then fields. Each of v0 to v5 is queried on its own, from
+// Datastore's built-in indexes; with StorageFormatCSV, all rules are read
+// and filtered in memory instead.
+func (a *Adapter) FindBySubject(ctx context.Context, subject string) (result [][]string, err error) {
+	defer a.observe(ctx, "FindBySubject", time.Now(), &err)
+	if a.config.Debug {
+		a.logPrintln("[FindBySubject] called:", subject)
 	}
 
-	ancestor := a.pseudoRootKey()
-	_, err = a.db.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
-		if err = tx.DeleteMulti(keys); err != nil {
-			return err
-		}
-		if a.config.Debug {
-			log.Println("[SavePolicy] keys deleted")
-		}
+	ctx, cancel := withDeadline(ctx, a.config.LoadSaveFilterDeadline)
+	defer cancel()
 
-		for _, line := range lines {
-			name := line.String()
-			key := datastore.NameKey(a.config.Kind, name, ancestor)
-			key.Namespace = a.config.Namespace
-			_, err := tx.Put(key, line)
-			if err != nil {
+	seen := make(map[CasbinRule]bool)
+	var found []*CasbinRule
+	for _, ctx := range a.scopeContexts(ctx) {
+		queries := []*datastore.Query{a.newQuery(ctx)}
+		if !a.csvFormat() {
+			queries = queries[:0]
+			for _, field := range []string{"v0", "v1", "v2", "v3", "v4", "v5"} {
+				queries = append(queries, a.newQuery(ctx).Filter(field+" =", subject))
+			}
+		}
+		for _, query := range queries {
+			var rules []*CasbinRule
+			err := a.retry(ctx, func(db *datastore.Client) error {
+				var err error
+				rules, err = a.getRules(ctx, db, query)
 				return err
+			})
+			if err != nil {
+				return nil, err
+			}
+			for _, rule := range rules {
+				if seen[*rule] || !a.routed(ctx, rule) || !hasField(rule, subject) {
+					continue
+				}
+				seen[*rule] = true
+				found = append(found, rule)
 			}
 		}
+	}
 
-		return nil
-	})
+	sortRules(found)
+	result = make([][]string, len(found))
+	for i, rule := range found {
+		result[i] = trimTrailingEmpty(rule.fields())
+	}
+	return result, nil
+}
 
-	return err
+// hasField reports whether one of v0 to v5 of rule equals value.
+func hasField(rule *CasbinRule, value string) bool {
+	for _, field := range rule.fields()[1:] {
+		if field == value {
+			return true
+		}
+	}
+	return false
 }
 
-func (a *adapter) AddPolicy(sec string, ptype string, rule []string) error {
-	ctx, cancel := context.WithTimeout(
-		context.Background(), a.config.AddRemoveDeadline)
-	defer cancel()
+// QueryPolicy returns the rules of ptype matching a filter with the semantics
+// of RemoveFilteredPolicy, without loading the rest of the policy. Like
+// LoadPolicy, it skips expired rules and handles rules failing their
+// checksum per Config.ChecksumAction. Trailing empty fields are dropped from
+// every rule.
+func (a *Adapter) QueryPolicy(ctx context.Context, ptype string, fieldIndex int, fieldValues ...string) (result [][]string, err error) {
+	defer a.observe(a.ptypeContext(ctx, ptype), "QueryPolicy", time.Now(), &err)
+	if a.config.Debug {
+		a.logPrintln("[QueryPolicy] called:", ptype, fieldIndex, fieldValues)
+	}
 
-	line := savePolicyLine(ptype, rule)
-	name := line.String()
-	key := datastore.NameKey(a.config.Kind, name, a.pseudoRootKey())
-	key.Namespace = a.config.Namespace
+	ctx, cancel := withDeadline(a.ptypeContext(ctx, ptype), a.config.LoadSaveFilterDeadline)
+	defer cancel()
 
-	if a.config.Debug {
-		log.Println("[AddPolicy] called:", name)
+	_, rules, err := a.findFiltered(ctx, ptype, fieldIndex, fieldValues...)
+	if err != nil {
+		return nil, err
 	}
 
-	_, err := a.db.Put(ctx, key, &line)
-	return err
+	result = make([][]string, len(rules))
+	for i, rule := range rules {
+		result[i] = trimTrailingEmpty(rule.fields()[1:])
+	}
+	return result, nil
 }
 
-func (a *adapter) RemovePolicy(sec string, ptype string, rule []string) error {
-	ctx, cancel := context.WithTimeout(
-		context.Background(), a.config.AddRemoveDeadline)
+// DeleteByKeyName deletes the rule entity with the raw key name name, e.g.
+// a corrupt or orphaned entity whose fields no longer match its key. Deleting
+// a missing entity is not an error. The entity is looked for in the
+// namespace of the ptype the name starts with, see Config.PTypeNamespaces,
+// under every ancestor of Config.KeyStrategy.
+func (a *Adapter) DeleteByKeyName(ctx context.Context, name string) (err error) {
+	rule := ParseString(a.trimKeyPrefix(name))
+	ptype := rule.PType
+	defer a.observe(a.ptypeContext(ctx, ptype), "DeleteByKeyName", time.Now(), &err)
+	if err := a.checkWritable(); err != nil {
+		return err
+	}
+	m := Mutation{Op: "DeleteByKeyName", PType: ptype, Rules: [][]string{trimTrailingEmpty(rule.fields()[1:])}}
+	if err := a.beforeMutate(ctx, m); err != nil {
+		return err
+	}
+	defer a.afterMutate(ctx, m, &err)
+
+	ctx, cancel := withDeadline(a.ptypeContext(ctx, ptype), a.config.AddRemoveDeadline)
 	defer cancel()
 
-	line := savePolicyLine(ptype, rule)
-	name := line.String()
-	key := datastore.NameKey(a.config.Kind, name, a.pseudoRootKey())
-	key.Namespace = a.config.Namespace
+	if a.config.Debug {
+		a.logPrintln("[DeleteByKeyName] called:", name)
+	}
+
+	var keys []*datastore.Key
+	for _, ancestor := range a.keyStrategy().Ancestors(a.pseudoRootKey(ctx)) {
+		key := datastore.NameKey(a.kind(ctx), name, ancestor)
+		key.Namespace = a.namespace(ctx)
+		keys = append(keys, key)
+	}
+	return a.retry(ctx, func(db *datastore.Client) error {
+		return db.DeleteMulti(ctx, keys)
+	})
+}
 
+// DeletePType deletes every stored rule of ptype, e.g. of a deprecated
+// permission type, and returns how many were deleted. The rules are queried
+// first and then deleted in chunked transactions, so rules of ptype added
+// concurrently may survive. A delete failing after some chunks returns their
+// count with a *PartialError, see ErrPartiallyApplied. Unlike a filtered
+// remove, it isn't stopped by Config.GuardBroadDeletes.
+func (a *Adapter) DeletePType(ctx context.Context, ptype string) (deleted int, err error) {
+	defer a.observe(a.ptypeContext(ctx, ptype), "DeletePType", time.Now(), &err)
+	if err := a.checkWritable(); err != nil {
+		return 0, err
+	}
+	m := Mutation{Op: "DeletePType", PType: ptype}
+	if err := a.beforeMutate(ctx, m); err != nil {
+		return 0, err
+	}
+	defer a.afterMutate(ctx, m, &err)
 	if a.config.Debug {
-		log.Println("[RemovePolicy] called:", name)
+		a.logPrintln("[DeletePType] called:", ptype)
 	}
 
-	return a.db.Delete(ctx, key)
+	ctx, cancel := withDeadline(a.ptypeContext(ctx, ptype), a.config.LoadSaveFilterDeadline)
+	defer cancel()
+
+	keys, rules, err := a.findFiltered(ctx, ptype, 0)
+	if err != nil {
+		return 0, err
+	}
+	err = a.deleteChunked(ctx, keys, rules, func(n int) {
+		deleted += n
+	})
+	return deleted, partial(err, deleted, len(keys))
 }
 
-func (a *adapter) RemoveFilteredPolicy(sec string, ptype string,
-	fieldIndex int, fieldValues ...string) error {
+// FilterSpec is a single filter of RemoveFilteredPolicies, with the same
+// meaning as the fieldIndex and fieldValues arguments of RemoveFilteredPolicy.
+type FilterSpec struct {
+	FieldIndex  int
+	FieldValues []string
+}
+
+func (a *Adapter) RemoveFilteredPolicies(sec string, ptype string, filters []FilterSpec) error {
+	return a.RemoveFilteredPoliciesCtx(context.Background(), sec, ptype, filters)
+}
 
+// RemoveFilteredPoliciesCtx removes the policy rules matching any of filters.
+// The matching keys of all filters are collected first and then deleted in
+// chunked transactions, which saves one round trip per filter compared to
+// calling RemoveFilteredPolicy repeatedly.
+func (a *Adapter) RemoveFilteredPoliciesCtx(ctx context.Context, sec string, ptype string, filters []FilterSpec) (err error) {
+	defer a.observe(a.ptypeContext(ctx, ptype), "RemoveFilteredPolicies", time.Now(), &err)
+	if err := a.checkWritable(); err != nil {
+		return err
+	}
+	ms := make([]Mutation, len(filters))
+	for i, filter := range filters {
+		if err := a.checkBroadDelete(ctx, ptype, filter.FieldIndex, filter.FieldValues...); err != nil {
+			return err
+		}
+		ms[i] = Mutation{Op: "RemoveFilteredPolicies", PType: ptype, Filter: &filters[i]}
+		if err := a.beforeMutate(ctx, ms[i]); err != nil {
+			return err
+		}
+	}
+	defer a.afterMutations(ctx, ms, nil, &err)
 	if a.config.Debug {
-		log.Println("[RemoveFilteredPolicy] called")
+		a.logPrintln("[RemoveFilteredPolicies] called:", len(filters), "filters")
 	}
 
-	ctx, cancel := context.WithTimeout(
-		context.Background(), a.config.LoadSaveFilterDeadline)
+	ctx, cancel := withDeadline(a.ptypeContext(ctx, ptype), a.config.LoadSaveFilterDeadline)
 	defer cancel()
 
+	// The same entity may match several filters; it must only be deleted once.
+	seen := make(map[string]bool)
+	var keys []*datastore.Key
 	var rules []*CasbinRule
+	for _, filter := range filters {
+		found, foundRules, err := a.findFiltered(ctx, ptype, filter.FieldIndex, filter.FieldValues...)
+		if err != nil {
+			return err
+		}
+		for i, key := range found {
+			if !seen[key.Name] {
+				seen[key.Name] = true
+				keys = append(keys, key)
+				rules = append(rules, foundRules[i])
+			}
+		}
+	}
 
-	selector := make(map[string]interface{})
-	selector["ptype"] = ptype
+	return a.deleteChunked(ctx, keys, rules, nil)
+}
 
-	if fieldIndex <= 0 && 0 < fieldIndex+len(fieldValues) {
-		if fieldValues[0-fieldIndex] != "" {
-			selector["v0"] = fieldValues[0-fieldIndex]
+// filteredQuery builds the query selecting the rules of ptype whose fields,
+// starting at fieldIndex, equal fieldValues. Empty values match anything.
+func (a *Adapter) filteredQuery(ctx context.Context, ptype string, fieldIndex int, fieldValues ...string) *datastore.Query {
+	query := BuildFilterQuery(a.newQuery(ctx), ptype, fieldIndex, fieldValues...)
+	if a.config.Debug {
+		var filters []string
+		for _, f := range fieldFilters(ptype, fieldIndex, fieldValues...) {
+			filters = append(filters, fmt.Sprintf("%s = %q", f.property, f.value))
 		}
+		a.logPrintln("[filteredQuery] fieldIndex:", fieldIndex, "fieldValues:", fmt.Sprintf("%q", fieldValues),
+			"filters:", strings.Join(filters, ", "))
 	}
-	if fieldIndex <= 1 && 1 < fieldIndex+len(fieldValues) {
-		if fieldValues[1-fieldIndex] != "" {
-			selector["v1"] = fieldValues[1-fieldIndex]
-		}
+	return query
+}
+
+// BuildFilterQuery returns base restricted to the rules of ptype whose
+// fields, starting at fieldIndex (0 for v0 up to 5 for v5), equal
+// fieldValues, with the semantics of RemoveFilteredPolicy: empty values
+// match anything, and values past v5 are ignored. It adds only equality
+// filters, so Datastore serves the query from built-in indexes unless base
+// needs a composite one. Rules stored with StorageFormatCSV have no field
+// properties, so the query only matches rules stored with
+// StorageFormatFields.
+func BuildFilterQuery(base *datastore.Query, ptype string, fieldIndex int, fieldValues ...string) *datastore.Query {
+	query := base
+	for _, f := range fieldFilters(ptype, fieldIndex, fieldValues...) {
+		query = query.Filter(f.property+" =", f.value)
 	}
-	if fieldIndex <= 2 && 2 < fieldIndex+len(fieldValues) {
-		if fieldValues[2-fieldIndex] != "" {
-			selector["v2"] = fieldValues[2-fieldIndex]
+	return query
+}
+
+// fieldFilter is an equality filter on a rule property.
+type fieldFilter struct {
+	property, value string
+}
+
+// fieldFilters returns the filters of BuildFilterQuery, ordered by property.
+func fieldFilters(ptype string, fieldIndex int, fieldValues ...string) []fieldFilter {
+	filters := []fieldFilter{{"ptype", ptype}}
+	for i, value := range fieldValues {
+		if field := fieldIndex + i; field >= 0 && field <= 5 && value != "" {
+			filters = append(filters, fieldFilter{fmt.Sprintf("v%d", field), value})
 		}
 	}
-	if fieldIndex <= 3 && 3 < fieldIndex+len(fieldValues) {
-		if fieldValues[3-fieldIndex] != "" {
-			selector["v3"] = fieldValues[3-fieldIndex]
+	return filters
+}
+
+// maxMutationsPerTx is the maximum number of mutations Datastore accepts in
+// a single commit.
+const maxMutationsPerTx = 500
+
+// maxPutsPerTx is the maximum number of rules put in a single commit; one
+// mutation is kept for the Config.InsertionOrder counter.
+const maxPutsPerTx = maxMutationsPerTx - 1
+
+// deleteChunked deletes keys, the entities of rules, using one transaction
+// per maxMutationsPerTx keys, calling chunkDone, if set, with the number of
+// keys of every committed chunk. Chunks committed before a failure stay
+// deleted.
+func (a *Adapter) deleteChunked(ctx context.Context, keys []*datastore.Key, rules []*CasbinRule, chunkDone func(n int)) error {
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > maxMutationsPerTx {
+			n = maxMutationsPerTx
 		}
-	}
-	if fieldIndex <= 4 && 4 < fieldIndex+len(fieldValues) {
-		if fieldValues[4-fieldIndex] != "" {
-			selector["v4"] = fieldValues[4-fieldIndex]
+		chunk, chunkRules := keys[:n], rules[:n]
+		keys, rules = keys[n:], rules[n:]
+
+		if err := ctx.Err(); err != nil {
+			return err
 		}
-	}
-	if fieldIndex <= 5 && 5 < fieldIndex+len(fieldValues) {
-		if fieldValues[5-fieldIndex] != "" {
-			selector["v5"] = fieldValues[5-fieldIndex]
+		chunkCtx, cancel := a.chunkContext(ctx)
+		err := a.retry(chunkCtx, func(db *datastore.Client) error {
+			_, err := db.RunInTransaction(chunkCtx, func(tx *datastore.Transaction) error {
+				return rulesError(tx.DeleteMulti(chunk), chunkRules)
+			})
+			return err
+		})
+		cancel()
+		if err != nil {
+			return err
 		}
+		if chunkDone != nil {
+			chunkDone(n)
+		}
+	}
+	return nil
+}
+
+// maxKeyNameLen is the maximum size in bytes of a Datastore key name.
+const maxKeyNameLen = 1500
+
+// allowBroadDeletesKey is the context key set by AllowBroadDeletes.
+type allowBroadDeletesKey struct{}
+
+// AllowBroadDeletes returns a copy of ctx that lets filtered deletes remove
+// every rule of a ptype despite Config.GuardBroadDeletes.
+func AllowBroadDeletes(ctx context.Context) context.Context {
+	return context.WithValue(ctx, allowBroadDeletesKey{}, true)
+}
+
+// checkBroadDelete returns ErrBroadDelete if the filter constrains nothing
+// but the ptype, Config.GuardBroadDeletes is set and ctx doesn't allow it.
+func (a *Adapter) checkBroadDelete(ctx context.Context, ptype string, fieldIndex int, fieldValues ...string) error {
+	if !a.config.GuardBroadDeletes || !unconstrained(fieldIndex, fieldValues...) {
+		return nil
+	}
+	if allowed, _ := ctx.Value(allowBroadDeletesKey{}).(bool); allowed {
+		return nil
 	}
+	return fmt.Errorf("%w: the filter matches every rule of %q", ErrBroadDelete, ptype)
+}
 
-	query := a.newQuery()
-	for k, v := range selector {
-		query = query.Filter(fmt.Sprintf("%s =", k), v)
+// checkWritable returns ErrReadOnly if the adapter is configured read-only.
+func (a *Adapter) checkWritable() error {
+	if a.config.ReadOnly {
+		return ErrReadOnly
 	}
+	return nil
+}
 
-	keys, err := a.db.GetAll(ctx, query, &rules)
-	if err != nil {
-		switch err {
-		case datastore.ErrNoSuchEntity:
-			return nil
-		default:
-			return err
-		}
+// validateRule checks that the rule has a ptype and its key name fits
+// Datastore's limit, then runs the configured ValidateRule hook, if any.
+func (a *Adapter) validateRule(ptype string, rule []string) error {
+	if ptype == "" {
+		// Loads couldn't tell the rule from other entities, see newQuery.
+		return ErrEmptyPType
+	}
+	line := a.storedLine(ptype, rule)
+	if name := a.keyName(&line); len(name) > maxKeyNameLen {
+		return fmt.Errorf("%w: %d bytes, the limit is %d", ErrKeyTooLong, len(name), maxKeyNameLen)
 	}
+	if a.config.ValidateRule == nil {
+		return nil
+	}
+	return a.config.ValidateRule(ptype, rule)
+}
 
-	return a.db.DeleteMulti(ctx, keys)
+// storedLine returns rule as it is stored, after Config.SaveTransform.
+func (a *Adapter) storedLine(ptype string, rule []string) CasbinRule {
+	if a.config.SaveTransform != nil {
+		rule = a.config.SaveTransform(ptype, append([]string(nil), rule...))
+	}
+	return savePolicyLine(ptype, rule)
 }
 
 func savePolicyLine(ptype string, rule []string) CasbinRule {
@@ -362,47 +2391,40 @@ func savePolicyLine(ptype string, rule []string) CasbinRule {
 	return line
 }
 
-func loadPolicyLine(line CasbinRule, model model.Model) {
-	key := line.PType
-	sec := key[:1]
-
-	tokens := []string{}
-	if line.V0 != "" {
-		tokens = append(tokens, line.V0)
-	} else {
-		goto LineEnd
-	}
-
-	if line.V1 != "" {
-		tokens = append(tokens, line.V1)
-	} else {
-		goto LineEnd
-	}
-
-	if line.V2 != "" {
-		tokens = append(tokens, line.V2)
-	} else {
-		goto LineEnd
-	}
+// loadPolicyLine adds line to model. The rule gets as many tokens as the
+// model's definition of its ptype has fields, so interior and trailing empty
+// fields are restored; without a definition, trailing empty fields are
+// dropped. Extra non-empty fields, like conditional role parameters, are kept.
+func loadPolicyLine(line CasbinRule, model model.Model) error {
+	return persist.LoadPolicyArray(policyLine(line, model), model)
+}
 
-	if line.V3 != "" {
-		tokens = append(tokens, line.V3)
-	} else {
-		goto LineEnd
+// policyLine returns the ptype of line followed by its tokens, as
+// loadPolicyLine adds them to model. It allocates once per rule, which
+// matters when loading large policies.
+func policyLine(line CasbinRule, model model.Model) []string {
+	fields := line.fields()
+	n := len(trimTrailingEmpty(fields[1:]))
+	if arity := fieldCount(model, line.PType[:1], line.PType); arity > n && arity < len(fields) {
+		n = arity
 	}
+	return fields[:1+n]
+}
 
-	if line.V4 != "" {
-		tokens = append(tokens, line.V4)
-	} else {
-		goto LineEnd
+// trimTrailingEmpty returns fields without its trailing empty strings.
+func trimTrailingEmpty(fields []string) []string {
+	n := len(fields)
+	for n > 0 && fields[n-1] == "" {
+		n--
 	}
+	return fields[:n]
+}
 
-	if line.V5 != "" {
-		tokens = append(tokens, line.V5)
-	} else {
-		goto LineEnd
+// fieldCount returns the number of fields of ptype as defined by model, or 0
+// if model doesn't define ptype.
+func fieldCount(model model.Model, sec, ptype string) int {
+	if ast, ok := model[sec][ptype]; ok {
+		return len(ast.Tokens)
 	}
-
-LineEnd:
-	model[sec][key].Policy = append(model[sec][key].Policy, tokens)
+	return 0
 }
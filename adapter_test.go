@@ -2,28 +2,90 @@ package datastoreadapter
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
 	"os"
+	"reflect"
 	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"testing/quick"
+	"time"
 
 	"cloud.google.com/go/datastore"
-	"github.com/casbin/casbin"
+	"github.com/casbin/casbin/v2"
+	"github.com/casbin/casbin/v2/model"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 var testProjectID = os.Getenv("TEST_CASBIN_DATASTORE_PROJECT_ID")
 
-func getDatastore() *datastore.Client {
-	ctx := context.Background()
-	ds, err := datastore.NewClient(ctx, testProjectID)
+var (
+	probeOnce sync.Once
+	// probeErr is why no Datastore is available to the tests, if it isn't.
+	probeErr error
+)
+
+// getDatastore returns a client of the project set by
+// TEST_CASBIN_DATASTORE_PROJECT_ID, or of the emulator at
+// DATASTORE_EMULATOR_HOST. It skips tb if neither is set or reachable,
+// so that go test runs the unit tests alone without them.
+func getDatastore(tb testing.TB) *datastore.Client {
+	tb.Helper()
+	probeOnce.Do(func() { probeErr = probeDatastore() })
+	if probeErr != nil {
+		tb.Skip("Datastore unavailable:", probeErr)
+	}
+
+	ds, err := datastore.NewClient(context.Background(), testDatastoreProject())
 	if err != nil {
-		panic(err)
+		tb.Fatal(err)
 	}
+	tb.Cleanup(func() { ds.Close() })
 	return ds
 }
 
+// testDatastoreProject returns the project the tests use.
+func testDatastoreProject() string {
+	if testProjectID != "" {
+		return testProjectID
+	}
+	if id := os.Getenv("DATASTORE_PROJECT_ID"); id != "" {
+		return id
+	}
+	// The emulator accepts any project.
+	return "casbin-test"
+}
+
+// probeDatastore checks once that Datastore answers, so that a missing
+// emulator skips the tests quickly instead of failing each on a timeout.
+func probeDatastore() error {
+	if testProjectID == "" && os.Getenv("DATASTORE_EMULATOR_HOST") == "" {
+		return errors.New("set DATASTORE_EMULATOR_HOST or TEST_CASBIN_DATASTORE_PROJECT_ID")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ds, err := datastore.NewClient(ctx, testDatastoreProject())
+	if err != nil {
+		return err
+	}
+	defer ds.Close()
+	err = ds.Get(ctx, datastore.NameKey("casbin_probe", "probe", nil), &CasbinRule{})
+	if err == datastore.ErrNoSuchEntity {
+		return nil
+	}
+	return err
+}
+
 func testGetPolicy(e *casbin.Enforcer, wants [][]string, onFail func(actual, wants [][]string)) {
-	actual := e.GetPolicy()
+	actual, err := e.GetPolicy()
+	if err != nil {
+		panic(err)
+	}
 	if !SamePolicy(actual, wants) {
 		sortPolicy(actual)
 		sortPolicy(wants)
@@ -65,12 +127,100 @@ func SamePolicy(a, b [][]string) bool {
 	return true
 }
 
+func TestCasbinRuleString(t *testing.T) {
+	tests := []struct {
+		rule CasbinRule
+		want string
+	}{
+		{CasbinRule{PType: "p", V0: "alice", V1: "data1", V2: "read"}, "p,alice,data1,read"},
+		{CasbinRule{PType: "g", V0: "alice", V1: "data2_admin"}, "g,alice,data2_admin"},
+		{CasbinRule{PType: "p", V0: "a,b", V1: "c"}, `p,a\,b,c`},
+		{CasbinRule{PType: "p", V0: `a\`, V1: "c"}, `p,a\\,c`},
+		{CasbinRule{PType: "p", V0: "alice", V2: "read"}, "p,alice,,read"},
+		{CasbinRule{PType: "p", V0: " alice ", V1: " ", V2: "read"}, "p, alice , ,read"},
+		{CasbinRule{PType: "p", V0: "alice", V1: " "}, "p,alice, "},
+		{CasbinRule{}, ""},
+	}
+	for _, tt := range tests {
+		if got := tt.rule.String(); got != tt.want {
+			t.Errorf("%#v.String() = %q, wants %q", tt.rule, got, tt.want)
+		}
+		if got := ParseString(tt.want); *got != tt.rule {
+			t.Errorf("ParseString(%q) = %#v, wants %#v", tt.want, *got, tt.rule)
+		}
+	}
+}
+
+func TestWhitespaceFields(t *testing.T) {
+	ctx := context.Background()
+	a := &Adapter{config: withDefaults(Config{})}
+
+	// The key and the stored fields keep whitespace alike, so a padded rule
+	// is stored under a key of its own and loads back unchanged.
+	padded := savePolicyLine("p", []string{" alice", "data1 ", " "})
+	plain := savePolicyLine("p", []string{"alice", "data1"})
+	if padded.V0 != " alice" || padded.V1 != "data1 " || padded.V2 != " " {
+		t.Errorf("got %#v, wants the fields unchanged", padded)
+	}
+	if a.ruleKey(ctx, &padded).Equal(a.ruleKey(ctx, &plain)) {
+		t.Error("Expected padded and plain rules to have different keys")
+	}
+	if got := ParseString(a.ruleKey(ctx, &padded).Name); *got != padded {
+		t.Errorf("got %#v from the key, wants %#v", *got, padded)
+	}
+}
+
+func TestCasbinRuleRoundTrip(t *testing.T) {
+	roundTrip := func(rule CasbinRule) bool {
+		return *ParseString(rule.String()) == rule
+	}
+	if err := quick.Check(roundTrip, &quick.Config{MaxCount: 10000}); err != nil {
+		t.Error(err)
+	}
+
+	// Random strings rarely contain the characters that need escaping, so
+	// also check rules built only from them.
+	special := func(a, b, c []bool) bool {
+		pick := func(bits []bool) string {
+			var sb strings.Builder
+			for _, bit := range bits {
+				if bit {
+					sb.WriteString(",")
+				} else {
+					sb.WriteString(`\`)
+				}
+			}
+			return sb.String()
+		}
+		return roundTrip(CasbinRule{PType: "p", V0: pick(a), V2: pick(b), V5: pick(c)})
+	}
+	if err := quick.Check(special, nil); err != nil {
+		t.Error(err)
+	}
+}
+
 func initPolicy(t *testing.T, config Config) {
 	// Because the DB is empty at first,
 	// so we need to load the policy from the file adapter (.CSV) first.
 	e, _ := casbin.NewEnforcer("examples/rbac_model.conf", "examples/rbac_policy.csv")
 
-	a := NewAdapterWithConfig(getDatastore(), config)
+	// Every test starts from the example policy alone and leaves nothing
+	// behind.
+	ds := getDatastore(t)
+	clean := func() {
+		for _, kind := range []string{config.Kind, config.PolicyKind, config.GroupingKind} {
+			if kind == "" {
+				continue
+			}
+			if err := ClearNamespace(context.Background(), ds, kind, config.Namespace); err != nil {
+				t.Fatalf("Expected ClearNamespace() to be successful; got %v", err)
+			}
+		}
+	}
+	clean()
+	t.Cleanup(clean)
+
+	a := NewAdapterWithConfig(ds, config)
 	// This is a trick to save the current policy to the DB.
 	// We can't call e.SavePolicy() because the adapter in the enforcer is still the file adapter.
 	// The current policy means the policy in the Casbin enforcer (aka in memory).
@@ -105,7 +255,7 @@ func TestAdapter(t *testing.T) {
 	// Now the DB has policy, so we can provide a normal use case.
 	// Create an adapter and an enforcer.
 	// NewEnforcer() will load the policy automatically.
-	a := NewAdapterWithConfig(getDatastore(), config)
+	a := NewAdapterWithConfig(getDatastore(t), config)
 	e, _ := casbin.NewEnforcer("examples/rbac_model.conf", a)
 	testGetPolicy(e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}}, func(actual, wants [][]string) {
 		t.Error("got: ", actual, ", wants ", wants)
@@ -181,7 +331,7 @@ func TestAdapter(t *testing.T) {
 }
 
 func TestDeleteFilteredAdapter(t *testing.T) {
-	a := NewAdapter(getDatastore())
+	a := NewAdapter(getDatastore(t))
 	e, _ := casbin.NewEnforcer("examples/rbac_tenant_service.conf", a)
 
 	e.AddPolicy("domain1", "alice", "data3", "read", "accept", "service1")
@@ -214,27 +364,1297 @@ func TestDeleteFilteredAdapter(t *testing.T) {
 	})
 }
 
+func TestRemoveFilteredPolicyWithResult(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	removed, err := a.RemoveFilteredPolicyWithResult(context.Background(), "p", "p", 0, "data2_admin")
+	if err != nil {
+		t.Fatalf("Expected RemoveFilteredPolicyWithResult() to be successful; got %v", err)
+	}
+	if want := [][]string{{"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}}; !SamePolicy(removed, want) {
+		t.Errorf("got %q removed, wants %q", removed, want)
+	}
+
+	removed, err = a.RemoveFilteredPolicyWithResult(context.Background(), "p", "p", 0, "data2_admin")
+	if err != nil {
+		t.Fatalf("Expected RemoveFilteredPolicyWithResult() to be successful; got %v", err)
+	}
+	if len(removed) != 0 {
+		t.Errorf("got %q removed, wants none", removed)
+	}
+}
+
 func TestConfig(t *testing.T) {
 	config := Config{Kind: "casbin_test", Namespace: "unittest"}
 	initPolicy(t, config)
 
 	// Use a difference kind name.
-	a := NewAdapterWithConfig(getDatastore(), Config{Kind: "casbin_test_xx", Namespace: "unittest"})
+	a := NewAdapterWithConfig(getDatastore(t), Config{Kind: "casbin_test_xx", Namespace: "unittest"})
 	e, _ := casbin.NewEnforcer("examples/rbac_model.conf", a)
 	testGetPolicy(e, [][]string{}, func(actual, wants [][]string) {
 		t.Error("got: ", actual, ", wants ", wants)
 	})
 
 	// Use a difference namespace.
-	a = NewAdapterWithConfig(getDatastore(), Config{Kind: "casbin_test", Namespace: "unittest_xx"})
+	a = NewAdapterWithConfig(getDatastore(t), Config{Kind: "casbin_test", Namespace: "unittest_xx"})
+	e, _ = casbin.NewEnforcer("examples/rbac_model.conf", a)
+	testGetPolicy(e, [][]string{}, func(actual, wants [][]string) {
+		t.Error("got: ", actual, ", wants ", wants)
+	})
+
+	a = NewAdapterWithConfig(getDatastore(t), config)
 	e, _ = casbin.NewEnforcer("examples/rbac_model.conf", a)
+	testGetPolicy(e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}}, func(actual, wants [][]string) {
+		t.Error("got: ", actual, ", wants ", wants)
+	})
+}
+
+func TestContextAdapter(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf")
+
+	if err := a.LoadPolicyCtx(context.Background(), e.GetModel()); err != nil {
+		t.Errorf("Expected LoadPolicyCtx() to be successful; got %v", err)
+	}
+	testGetPolicy(e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}}, func(actual, wants [][]string) {
+		t.Error("got: ", actual, ", wants ", wants)
+	})
+
+	// A cancelled context must abort the Datastore calls.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	e.ClearPolicy()
+	if err := a.LoadPolicyCtx(ctx, e.GetModel()); err == nil {
+		t.Errorf("Expected LoadPolicyCtx() to fail with a cancelled context")
+	}
+	if err := a.AddPolicyCtx(ctx, "p", "p", []string{"alice", "data1", "write"}); err == nil {
+		t.Errorf("Expected AddPolicyCtx() to fail with a cancelled context")
+	}
+}
+
+func TestLoadSectionPolicy(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf")
+
+	if err := a.LoadSectionPolicy(context.Background(), e.GetModel(), "g"); err != nil {
+		t.Errorf("Expected LoadSectionPolicy() to be successful; got %v", err)
+	}
 	testGetPolicy(e, [][]string{}, func(actual, wants [][]string) {
 		t.Error("got: ", actual, ", wants ", wants)
 	})
+	grouping, _ := e.GetGroupingPolicy()
+	if !SamePolicy(grouping, [][]string{{"alice", "data2_admin"}}) {
+		t.Error("got: ", grouping, ", wants ", [][]string{{"alice", "data2_admin"}})
+	}
+}
+
+func TestRemoveFilteredPolicies(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf", a)
+
+	// "data2_admin" matches two rules and the second filter overlaps the first.
+	err := a.RemoveFilteredPolicies("p", "p", []FilterSpec{
+		{FieldIndex: 0, FieldValues: []string{"alice"}},
+		{FieldIndex: 0, FieldValues: []string{"data2_admin"}},
+		{FieldIndex: 1, FieldValues: []string{"data2", "read"}},
+	})
+	if err != nil {
+		t.Errorf("Expected RemoveFilteredPolicies() to be successful; got %v", err)
+	}
+	if err := e.LoadPolicy(); err != nil {
+		t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(e, [][]string{{"bob", "data2", "write"}}, func(actual, wants [][]string) {
+		t.Error("got: ", actual, ", wants ", wants)
+	})
+}
+
+func TestSaveEmptyPolicy(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf")
+
+	// Saving an empty model clears the store, and doing it again is a no-op.
+	for i := 0; i < 2; i++ {
+		if err := a.SavePolicy(e.GetModel()); err != nil {
+			t.Errorf("Expected SavePolicy() to be successful; got %v", err)
+		}
+	}
 
-	a = NewAdapterWithConfig(getDatastore(), config)
 	e, _ = casbin.NewEnforcer("examples/rbac_model.conf", a)
+	testGetPolicy(e, [][]string{}, func(actual, wants [][]string) {
+		t.Error("got: ", actual, ", wants ", wants)
+	})
+	grouping, _ := e.GetGroupingPolicy()
+	if len(grouping) != 0 {
+		t.Error("got: ", grouping, ", wants ", [][]string{})
+	}
+}
+
+func TestDefaultDeadline(t *testing.T) {
+	tests := []struct {
+		config                      Config
+		wantLoadSave, wantAddRemove time.Duration
+	}{
+		{Config{}, 10 * time.Minute, 30 * time.Second},
+		{Config{DefaultDeadline: time.Minute}, time.Minute, time.Minute},
+		{Config{DefaultDeadline: time.Minute, AddRemoveDeadline: time.Second}, time.Minute, time.Second},
+		{Config{LoadSaveFilterDeadline: time.Hour}, time.Hour, 30 * time.Second},
+		{Config{DefaultDeadline: NoDeadline}, NoDeadline, NoDeadline},
+		{Config{DefaultDeadline: NoDeadline, AddRemoveDeadline: time.Second}, NoDeadline, time.Second},
+	}
+	for _, tt := range tests {
+		got := withDefaults(tt.config)
+		if got.LoadSaveFilterDeadline != tt.wantLoadSave || got.AddRemoveDeadline != tt.wantAddRemove {
+			t.Errorf("withDefaults(%+v) deadlines = %v, %v; wants %v, %v", tt.config,
+				got.LoadSaveFilterDeadline, got.AddRemoveDeadline, tt.wantLoadSave, tt.wantAddRemove)
+		}
+	}
+
+	ctx, cancel := withDeadline(context.Background(), NoDeadline)
+	defer cancel()
+	if _, ok := ctx.Deadline(); ok {
+		t.Errorf("Expected NoDeadline not to set a deadline")
+	}
+	ctx, cancel = withDeadline(context.Background(), time.Minute)
+	defer cancel()
+	if _, ok := ctx.Deadline(); !ok {
+		t.Errorf("Expected a positive deadline to be set")
+	}
+}
+
+func TestEffectiveConfig(t *testing.T) {
+	a := newAdapter(nil, Config{Namespace: "unittest", DefaultDeadline: time.Minute})
+	got := a.EffectiveConfig()
+	if got.Kind != casbinKind || got.Namespace != "unittest" || got.StorageFormat != StorageFormatFields {
+		t.Errorf("got kind %q, namespace %q and format %q", got.Kind, got.Namespace, got.StorageFormat)
+	}
+	if got.LoadSaveFilterDeadline != time.Minute || got.AddRemoveDeadline != time.Minute {
+		t.Errorf("got deadlines %v, %v; wants 1m0s", got.LoadSaveFilterDeadline, got.AddRemoveDeadline)
+	}
+	if _, ok := got.KeyStrategy.(SingleAncestor); !ok {
+		t.Errorf("got key strategy %T, wants SingleAncestor", got.KeyStrategy)
+	}
+}
+
+func TestNilClient(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), "nil *datastore.Client") {
+			t.Errorf("got %v, wants a panic naming the nil client", r)
+		}
+	}()
+	NewAdapter(nil)
+}
+
+func TestForApp(t *testing.T) {
+	config := ForApp("billing")
+	config.Debug = true
+	got := newAdapter(nil, config).EffectiveConfig()
+	if got.Kind != "casbin_billing" || got.Namespace != "billing" || !got.Debug {
+		t.Errorf("got kind %q, namespace %q and debug %v", got.Kind, got.Namespace, got.Debug)
+	}
+	if other := ForApp("payroll"); other.Kind == config.Kind || other.Namespace == config.Namespace {
+		t.Errorf("got %+v, wants it isolated from %+v", other, config)
+	}
+}
+
+func TestSavePolicyWithResult(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	e.EnableAutoSave(false)
+
+	// Saving the loaded policy again is a no-op.
+	result, err := a.SavePolicyWithResult(context.Background(), e.GetModel())
+	if err != nil {
+		t.Fatalf("Expected SavePolicyWithResult() to be successful; got %v", err)
+	}
+	if result.Changed() || result.Unchanged != 5 {
+		t.Errorf("got %+v, wants 5 unchanged rules", result)
+	}
+
+	e.AddPolicy("alice", "data1", "write")
+	e.RemovePolicy("bob", "data2", "write")
+	result, err = a.SavePolicyWithResult(context.Background(), e.GetModel())
+	if err != nil {
+		t.Fatalf("Expected SavePolicyWithResult() to be successful; got %v", err)
+	}
+	if want := (SaveResult{Added: 1, Deleted: 1, Unchanged: 4}); result != want {
+		t.Errorf("got %+v, wants %+v", result, want)
+	}
+
+	if err := e.LoadPolicy(); err != nil {
+		t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(e, [][]string{{"alice", "data1", "read"}, {"alice", "data1", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}}, func(actual, wants [][]string) {
+		t.Error("got: ", actual, ", wants ", wants)
+	})
+}
+
+func TestSavePolicyForPType(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+	defer initPolicy(t, config)
+
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	rules := [][]string{{"alice", "data1", "read"}, {"bob", "data1", "write"}}
+	if err := a.SavePolicyForPType(context.Background(), "p", rules); err != nil {
+		t.Fatalf("Expected SavePolicyForPType() to be successful; got %v", err)
+	}
+
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	testGetPolicy(e, rules, func(actual, wants [][]string) {
+		t.Error("got: ", actual, ", wants ", wants)
+	})
+	// The g rules are left untouched.
+	if ok, _ := e.HasGroupingPolicy("alice", "data2_admin"); !ok {
+		t.Error("Expected the grouping policy to be kept")
+	}
+}
+
+func TestReplacePolicy(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+	defer initPolicy(t, config)
+
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	rules := [][]string{{"alice", "data1", "read"}, {"bob", "data1", "write"}}
+	added, removed, err := a.ReplacePolicy(context.Background(), "p", rules)
+	if err != nil {
+		t.Fatalf("Expected ReplacePolicy() to be successful; got %v", err)
+	}
+	if !SamePolicy(added, [][]string{{"bob", "data1", "write"}}) {
+		t.Errorf("got %v added, wants bob's new rule", added)
+	}
+	wants := [][]string{{"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}}
+	if !SamePolicy(removed, wants) {
+		t.Errorf("got %v removed, wants %v", removed, wants)
+	}
+
+	// Replacing with the same rules changes nothing.
+	added, removed, err = a.ReplacePolicy(context.Background(), "p", rules)
+	if err != nil || len(added) != 0 || len(removed) != 0 {
+		t.Errorf("got %v added, %v removed and %v, wants no change", added, removed, err)
+	}
+}
+
+func TestAddWantedDuplicates(t *testing.T) {
+	first := savePolicyLine("p", []string{"alice", "data1", "read"})
+	dup := savePolicyLine("p", []string{"alice", "data1", "read", ""})
+
+	a := &Adapter{config: withDefaults(Config{Logger: log.New(ioutil.Discard, "", 0)})}
+	wanted := make(map[string]*CasbinRule)
+	order, err := a.addWanted(wanted, nil, &first)
+	if err == nil {
+		order, err = a.addWanted(wanted, order, &dup)
+	}
+	if err != nil || len(order) != 1 || wanted[order[0]] != &first {
+		t.Errorf("got %v and %v, wants only the first rule", order, err)
+	}
+
+	a.config.DuplicateAction = DuplicateError
+	wanted = make(map[string]*CasbinRule)
+	order, _ = a.addWanted(wanted, nil, &first)
+	if _, err := a.addWanted(wanted, order, &dup); !errors.Is(err, ErrDuplicateRule) {
+		t.Errorf("got %v, wants %v", err, ErrDuplicateRule)
+	}
+}
+
+func TestLoadPolicyLine(t *testing.T) {
+	m, err := model.NewModelFromFile("examples/rbac_tenant_service.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The p definition has 6 fields; interior and trailing empties survive.
+	lines := []CasbinRule{
+		{PType: "p", V0: "domain1", V1: "alice", V3: "read", V4: "accept"},
+		{PType: "g", V0: "alice", V1: "admin"},
+	}
+	for _, line := range lines {
+		if err := loadPolicyLine(line, m); err != nil {
+			t.Fatalf("Expected loadPolicyLine() to be successful; got %v", err)
+		}
+	}
+
+	want := [][]string{{"domain1", "alice", "", "read", "accept", ""}}
+	if got := m["p"]["p"].Policy; !SamePolicy(got, want) || len(got[0]) != 6 {
+		t.Errorf("got %q, wants %q", got, want)
+	}
+	want = [][]string{{"alice", "admin"}}
+	if got := m["g"]["g"].Policy; !SamePolicy(got, want) {
+		t.Errorf("got %q, wants %q", got, want)
+	}
+	if ok, _ := m.HasPolicy("g", "g", []string{"alice", "admin"}); !ok {
+		t.Errorf("loaded rule is missing from the policy index")
+	}
+}
+
+func TestSortOnLoad(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+
+	config.SortOnLoad = true
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf", a)
+
+	actual, _ := e.GetPolicy()
+	wants := [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}}
+	if fmt.Sprint(actual) != fmt.Sprint(wants) {
+		t.Error("got: ", actual, ", wants ", wants)
+	}
+}
+
+func TestDeleteByKeyName(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	if err := a.DeleteByKeyName(context.Background(), "p,bob,data2,write"); err != nil {
+		t.Errorf("Expected DeleteByKeyName() to be successful; got %v", err)
+	}
+	// Deleting a missing entity succeeds as well.
+	if err := a.DeleteByKeyName(context.Background(), "p,nobody"); err != nil {
+		t.Errorf("Expected DeleteByKeyName() to be successful; got %v", err)
+	}
+
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	testGetPolicy(e, [][]string{{"alice", "data1", "read"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}}, func(actual, wants [][]string) {
+		t.Error("got: ", actual, ", wants ", wants)
+	})
+}
+
+func TestDeletePType(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	deleted, err := a.DeletePType(context.Background(), "p")
+	if err != nil {
+		t.Fatalf("Expected DeletePType() to be successful; got %v", err)
+	}
+	if deleted != 4 {
+		t.Errorf("got %d rules deleted, wants 4", deleted)
+	}
+	if deleted, _ := a.DeletePType(context.Background(), "p"); deleted != 0 {
+		t.Errorf("got %d rules deleted again, wants 0", deleted)
+	}
+
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	testGetPolicy(e, [][]string{}, func(actual, wants [][]string) {
+		t.Error("got: ", actual, ", wants ", wants)
+	})
+	if rules, _ := e.GetGroupingPolicy(); len(rules) != 1 {
+		t.Errorf("got grouping policy %v, wants it kept", rules)
+	}
+}
+
+type testTenantKey struct{}
+
+func TestNamespaceFunc(t *testing.T) {
+	initPolicy(t, Config{Kind: "casbin_test", Namespace: "unittest"})
+
+	a := NewAdapterWithConfig(getDatastore(t), Config{
+		Kind: "casbin_test",
+		NamespaceFunc: func(ctx context.Context) string {
+			tenant, _ := ctx.Value(testTenantKey{}).(string)
+			return tenant
+		},
+	})
+
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf")
+	ctx := context.WithValue(context.Background(), testTenantKey{}, "unittest")
+	if err := a.LoadPolicyCtx(ctx, e.GetModel()); err != nil {
+		t.Errorf("Expected LoadPolicyCtx() to be successful; got %v", err)
+	}
 	testGetPolicy(e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}}, func(actual, wants [][]string) {
 		t.Error("got: ", actual, ", wants ", wants)
 	})
+
+	e.ClearPolicy()
+	ctx = context.WithValue(context.Background(), testTenantKey{}, "unittest_xx")
+	if err := a.LoadPolicyCtx(ctx, e.GetModel()); err != nil {
+		t.Errorf("Expected LoadPolicyCtx() to be successful; got %v", err)
+	}
+	testGetPolicy(e, [][]string{}, func(actual, wants [][]string) {
+		t.Error("got: ", actual, ", wants ", wants)
+	})
+}
+
+func TestValidateRule(t *testing.T) {
+	errInvalid := errors.New("control character in rule")
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+
+	config.ValidateRule = func(ptype string, rule []string) error {
+		for _, field := range rule {
+			if strings.ContainsAny(field, "\n\r\t") {
+				return errInvalid
+			}
+		}
+		return nil
+	}
+	a := NewAdapterWithConfig(getDatastore(t), config)
+
+	bad := []string{"alice", "data1\n", "write"}
+	if err := a.AddPolicy("p", "p", bad); err != errInvalid {
+		t.Errorf("AddPolicy() got %v, wants %v", err, errInvalid)
+	}
+	if err := a.AddPolicies("p", "p", [][]string{{"bob", "data1", "read"}, bad}); err != errInvalid {
+		t.Errorf("AddPolicies() got %v, wants %v", err, errInvalid)
+	}
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	e.GetModel().AddPolicy("p", "p", bad)
+	if err := a.SavePolicy(e.GetModel()); err != errInvalid {
+		t.Errorf("SavePolicy() got %v, wants %v", err, errInvalid)
+	}
+
+	// Nothing was written.
+	if err := e.LoadPolicy(); err != nil {
+		t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}}, func(actual, wants [][]string) {
+		t.Error("got: ", actual, ", wants ", wants)
+	})
+}
+
+func TestLoadPolicyByField(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf")
+
+	if err := a.LoadPolicyByField(context.Background(), "p", 1, "data2", e.GetModel()); err != nil {
+		t.Errorf("Expected LoadPolicyByField() to be successful; got %v", err)
+	}
+	testGetPolicy(e, [][]string{{"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}}, func(actual, wants [][]string) {
+		t.Error("got: ", actual, ", wants ", wants)
+	})
+
+	if err := a.LoadPolicyByField(context.Background(), "p", 6, "x", e.GetModel()); err == nil {
+		t.Errorf("got no error, wants an error")
+	}
+}
+
+func TestLoadPolicyByRange(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+
+	// Without the composite index, the rules are filtered in memory.
+	config.IndexFallback = true
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf")
+
+	if err := a.LoadPolicyByRange(context.Background(), "p", 0, "b", "data2_admin", e.GetModel()); err != nil {
+		t.Fatalf("Expected LoadPolicyByRange() to be successful; got %v", err)
+	}
+	testGetPolicy(e, [][]string{{"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}}, func(actual, wants [][]string) {
+		t.Error("got: ", actual, ", wants ", wants)
+	})
+
+	e.ClearPolicy()
+	if err := a.LoadPolicyByRange(context.Background(), "p", 2, "", "read", e.GetModel()); err != nil {
+		t.Fatalf("Expected LoadPolicyByRange() to be successful; got %v", err)
+	}
+	testGetPolicy(e, [][]string{{"alice", "data1", "read"}, {"data2_admin", "data2", "read"}}, func(actual, wants [][]string) {
+		t.Error("got: ", actual, ", wants ", wants)
+	})
+
+	if err := a.LoadPolicyByRange(context.Background(), "p", 6, "a", "b", e.GetModel()); !errors.Is(err, ErrInvalidFieldIndex) {
+		t.Errorf("got %v, wants %v", err, ErrInvalidFieldIndex)
+	}
+
+	// Range queries can't be ordered by every field, so they sort in memory.
+	config.SortOnLoad = true
+	a = NewAdapterWithConfig(getDatastore(t), config)
+	e.ClearPolicy()
+	if err := a.LoadPolicyByRange(context.Background(), "p", 2, "read", "write", e.GetModel()); err != nil {
+		t.Fatalf("Expected LoadPolicyByRange() to be successful; got %v", err)
+	}
+	policy, _ := e.GetPolicy()
+	wants := [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}}
+	if !reflect.DeepEqual(policy, wants) {
+		t.Errorf("got %v, wants %v", policy, wants)
+	}
+}
+
+func TestLoadUndefinedPType(t *testing.T) {
+	m, err := model.NewModelFromFile("examples/rbac_model.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &Adapter{config: Config{Logger: log.New(ioutil.Discard, "", 0)}}
+	lines := []*CasbinRule{
+		{PType: "p", V0: "alice", V1: "data1", V2: "read"},
+		{PType: "p2", V0: "alice", V1: "data1"},
+		{PType: "x", V0: "alice"},
+		{V0: "alice"},
+	}
+	if err := a.loadLines(lines, m); err != nil {
+		t.Fatalf("Expected loadLines() to be successful; got %v", err)
+	}
+	want := [][]string{{"alice", "data1", "read"}}
+	if got := m["p"]["p"].Policy; !SamePolicy(got, want) {
+		t.Errorf("got %q, wants %q", got, want)
+	}
+}
+
+func TestSoftLoad(t *testing.T) {
+	m, err := model.NewModelFromFile("examples/rbac_model.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &Adapter{config: Config{Logger: log.New(ioutil.Discard, "", 0)}}
+	lines := []*CasbinRule{
+		{PType: "p", V0: "alice", V1: "data1", V2: "read", V3: "extra"},
+		{PType: "p", V0: "bob", V1: "data2", V2: "write"},
+		{PType: "x", V0: "alice"},
+	}
+	if err := a.loadLines(lines, m.Copy()); err == nil {
+		t.Error("Expected a malformed rule to fail the load")
+	}
+
+	a.config.SoftLoad = true
+	var report LoadReport
+	if err := a.loadReported(lines, m, &report); err != nil {
+		t.Fatalf("Expected loadReported() to be successful; got %v", err)
+	}
+	if report.Loaded != 1 || len(report.Skipped) != 2 {
+		t.Fatalf("got %d loaded and %v skipped, wants 1 and 2", report.Loaded, report.Skipped)
+	}
+	if report.Skipped[0].Rule != lines[0] || !errors.Is(report.Skipped[1].Err, ErrUndefinedPType) {
+		t.Errorf("got %v skipped, wants the rule of alice and the undefined ptype", report.Skipped)
+	}
+	if got, want := m["p"]["p"].Policy, [][]string{{"bob", "data2", "write"}}; !SamePolicy(got, want) {
+		t.Errorf("got %q, wants %q", got, want)
+	}
+}
+
+func TestLoadTransform(t *testing.T) {
+	m, err := model.NewModelFromFile("examples/rbac_model.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := map[string]string{"u1": "alice", "u2": "bob"}
+	a := &Adapter{config: withDefaults(Config{LoadTransform: func(ptype string, fields []string) []string {
+		if fields[0] == "u3" {
+			return nil
+		}
+		if name, ok := names[fields[0]]; ok {
+			fields[0] = name
+		}
+		return fields
+	}})}
+	lines := []*CasbinRule{
+		{PType: "p", V0: "u1", V1: "data1", V2: "read"},
+		{PType: "p", V0: "u3", V1: "data1", V2: "read"},
+		{PType: "g", V0: "u2", V1: "data2_admin"},
+	}
+	if err := a.loadLines(lines, m); err != nil {
+		t.Fatalf("Expected loadLines() to be successful; got %v", err)
+	}
+	if got, want := m["p"]["p"].Policy, [][]string{{"alice", "data1", "read"}}; !SamePolicy(got, want) {
+		t.Errorf("got %q, wants %q", got, want)
+	}
+	if got, want := m["g"]["g"].Policy, [][]string{{"bob", "data2_admin"}}; !SamePolicy(got, want) {
+		t.Errorf("got %q, wants %q", got, want)
+	}
+}
+
+func TestSaveTransform(t *testing.T) {
+	ids := map[string]string{"alice": "u1", "bob": "u2"}
+	names := map[string]string{"u1": "alice", "u2": "bob"}
+	mapFirst := func(m map[string]string) func(ptype string, fields []string) []string {
+		return func(ptype string, fields []string) []string {
+			if v, ok := m[fields[0]]; ok {
+				fields[0] = v
+			}
+			return fields
+		}
+	}
+	a := &Adapter{config: withDefaults(Config{SaveTransform: mapFirst(ids), LoadTransform: mapFirst(names)})}
+	// Staging keeps the writes off Datastore.
+	if err := a.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	defer a.Rollback()
+
+	rules := [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}}
+	if err := a.AddPolicies("p", "p", rules); err != nil {
+		t.Fatalf("Expected AddPolicies() to be successful; got %v", err)
+	}
+	if err := a.RemovePolicy("p", "p", []string{"bob", "data2", "write"}); err != nil {
+		t.Fatalf("Expected RemovePolicy() to be successful; got %v", err)
+	}
+	if rules[0][0] != "alice" {
+		t.Errorf("got %q, wants the caller's rule unchanged", rules[0])
+	}
+
+	var stored []*CasbinRule
+	for _, name := range a.staged.order {
+		if mu := a.staged.mutations[name]; !mu.delete {
+			stored = append(stored, mu.line)
+		}
+	}
+	if len(stored) != 1 || stored[0].V0 != "u1" {
+		t.Fatalf("got %v stored, wants only the rule of u1", stored)
+	}
+
+	m, err := model.NewModelFromFile("examples/rbac_model.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.loadLines(stored, m); err != nil {
+		t.Fatalf("Expected loadLines() to be successful; got %v", err)
+	}
+	if got, want := m["p"]["p"].Policy, [][]string{{"alice", "data1", "read"}}; !SamePolicy(got, want) {
+		t.Errorf("got %q, wants %q", got, want)
+	}
+}
+
+func TestLoadLimit(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest", LoadLimit: 3}
+	initPolicy(t, config)
+
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	p, _ := e.GetPolicy()
+	g, _ := e.GetGroupingPolicy()
+	if n := len(p) + len(g); n != 3 {
+		t.Errorf("got %d rules, wants 3", n)
+	}
+	if !a.IsFiltered() {
+		t.Error("got a complete load, wants a truncated one")
+	}
+	if err := a.SavePolicy(e.GetModel()); !errors.Is(err, ErrFiltered) {
+		t.Errorf("got %v, wants %v", err, ErrFiltered)
+	}
+
+	config.LoadLimit = 100
+	a = NewAdapterWithConfig(getDatastore(t), config)
+	e.GetModel().ClearPolicy()
+	if err := a.LoadPolicy(e.GetModel()); err != nil {
+		t.Fatalf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	if a.IsFiltered() {
+		t.Error("got a truncated load, wants a complete one")
+	}
+}
+
+func TestLoadLimitPerQuery(t *testing.T) {
+	config := Config{Kind: "casbin_test", PolicyKind: "casbin_test_p", GroupingKind: "casbin_test_g", Namespace: "unittest"}
+	initPolicy(t, config)
+
+	// The 4 p and 1 g rules are queried separately, each under the limit.
+	config.LoadLimit = 5
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	if a.IsFiltered() {
+		t.Error("got a truncated load, wants a complete one")
+	}
+
+	config.LoadLimit = 4
+	a = NewAdapterWithConfig(getDatastore(t), config)
+	e.GetModel().ClearPolicy()
+	if err := a.LoadPolicy(e.GetModel()); err != nil {
+		t.Fatalf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	if !a.IsFiltered() {
+		t.Error("got a complete load, wants a truncated one")
+	}
+}
+
+func TestClientFactory(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+
+	calls := 0
+	a := NewAdapterWithClientFactory(func(ctx context.Context) (*datastore.Client, error) {
+		calls++
+		return datastore.NewClient(ctx, testDatastoreProject())
+	}, config)
+	if calls != 0 {
+		t.Errorf("got %d factory calls before first use, wants 0", calls)
+	}
+
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	if err := e.LoadPolicy(); err != nil {
+		t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("got %d factory calls, wants 1", calls)
+	}
+
+	// Closing drops the client; the next use creates a new one.
+	if err := a.Close(); err != nil {
+		t.Errorf("Expected Close() to be successful; got %v", err)
+	}
+	if err := e.LoadPolicy(); err != nil {
+		t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("got %d factory calls, wants 2", calls)
+	}
+	// A done context leaves the client open.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := a.CloseCtx(ctx); err != context.Canceled {
+		t.Errorf("got %v, wants %v", err, context.Canceled)
+	}
+	if err := e.LoadPolicy(); err != nil {
+		t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("got %d factory calls, wants 2", calls)
+	}
+	if err := a.CloseCtx(context.Background()); err != nil {
+		t.Errorf("Expected CloseCtx() to be successful; got %v", err)
+	}
+
+	// A failing factory fails the operation.
+	failure := errors.New("no credentials")
+	a = NewAdapterWithClientFactory(func(ctx context.Context) (*datastore.Client, error) {
+		return nil, failure
+	}, config)
+	if err := a.LoadPolicy(e.GetModel()); err != failure {
+		t.Errorf("got %v, wants %v", err, failure)
+	}
+}
+
+func TestNewAdapterWithProject(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest", ConnectionPoolSize: 2}
+	initPolicy(t, config)
+
+	a := NewAdapterWithProject(testDatastoreProject(), config)
+	defer a.Close()
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	testGetPolicy(e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}}, func(actual, wants [][]string) {
+		t.Error("got: ", actual, ", wants ", wants)
+	})
+}
+
+func TestLoadPolicyAcrossNamespaces(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+	other := Config{Kind: "casbin_test", Namespace: "unittest_tenant"}
+	initPolicy(t, other)
+	NewAdapterWithConfig(getDatastore(t), other).RemovePolicy("p", "p", []string{"alice", "data1", "read"})
+
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf")
+	err := a.LoadPolicyAcrossNamespaces(context.Background(), []string{"unittest", "unittest_tenant"}, e.GetModel(),
+		func(ns string, rule []string) []string {
+			if rule[0] == "bob" {
+				return nil
+			}
+			return append([]string{ns + "/" + rule[0]}, rule[1:]...)
+		})
+	if err != nil {
+		t.Fatalf("Expected LoadPolicyAcrossNamespaces() to be successful; got %v", err)
+	}
+	testGetPolicy(e, [][]string{
+		{"unittest/alice", "data1", "read"}, {"unittest/data2_admin", "data2", "read"}, {"unittest/data2_admin", "data2", "write"},
+		{"unittest_tenant/data2_admin", "data2", "read"}, {"unittest_tenant/data2_admin", "data2", "write"},
+	}, func(actual, wants [][]string) {
+		t.Error("got: ", actual, ", wants ", wants)
+	})
+	if ok, _ := e.HasGroupingPolicy("unittest_tenant/alice", "data2_admin"); !ok {
+		t.Error("Expected the grouping rule of the tenant to be loaded")
+	}
+	if !a.IsFiltered() {
+		t.Error("Expected the load to be partial")
+	}
+}
+
+func TestLoadPolicyArray(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	pRules, gRules, err := a.LoadPolicyArray(context.Background())
+	if err != nil {
+		t.Fatalf("Expected LoadPolicyArray() to be successful; got %v", err)
+	}
+
+	want := [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}}
+	if len(pRules) != 1 || !SamePolicy(pRules["p"], want) {
+		t.Error("got: ", pRules, ", wants ", want)
+	}
+	want = [][]string{{"alice", "data2_admin"}}
+	if len(gRules) != 1 || !SamePolicy(gRules["g"], want) {
+		t.Error("got: ", gRules, ", wants ", want)
+	}
+}
+
+func TestForEachRule(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	var got []string
+	err := a.ForEachRule(context.Background(), func(rule *CasbinRule) error {
+		got = append(got, rule.String())
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Expected ForEachRule() to be successful; got %v", err)
+	}
+	sort.Strings(got)
+	want := []string{"g,alice,data2_admin", "p,alice,data1,read", "p,bob,data2,write", "p,data2_admin,data2,read", "p,data2_admin,data2,write"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, wants %q", got, want)
+	}
+
+	stop := errors.New("stop")
+	calls := 0
+	err = a.ForEachRule(context.Background(), func(rule *CasbinRule) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Errorf("got %v after %d calls, wants %v after 1", err, calls, stop)
+	}
+
+	// The rules are read like LoadPolicy reads them.
+	config.SortOnLoad = true
+	config.ProjectedFields = 3
+	a = NewAdapterWithConfig(getDatastore(t), config)
+	got = nil
+	err = a.ForEachRule(context.Background(), func(rule *CasbinRule) error {
+		got = append(got, rule.String())
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Expected ForEachRule() to be successful; got %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, wants %q in order", got, want)
+	}
+}
+
+func TestFilteredQueryDebugLog(t *testing.T) {
+	var out strings.Builder
+	a := &Adapter{config: withDefaults(Config{Debug: true, Logger: log.New(&out, "", 0)})}
+
+	a.filteredQuery(context.Background(), "p", 1, "data2", "", "x")
+	got := out.String()
+	for _, want := range []string{`ptype = "p"`, `v1 = "data2"`, `v3 = "x"`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("got %q, wants it to contain %q", got, want)
+		}
+	}
+	if strings.Contains(got, "v2 =") {
+		t.Errorf("got %q, wants no filter on the empty v2", got)
+	}
+}
+
+func TestBuildFilterQuery(t *testing.T) {
+	want := []fieldFilter{{"ptype", "p"}, {"v1", "data2"}, {"v3", "x"}}
+	if got := fieldFilters("p", 1, "data2", "", "x"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, wants %v", got, want)
+	}
+	want = []fieldFilter{{"ptype", "p"}, {"v5", "x"}}
+	if got := fieldFilters("p", 5, "x", "ignored"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, wants %v", got, want)
+	}
+
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+
+	ctx := context.Background()
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	query := BuildFilterQuery(a.newQuery(ctx), "p", 0, "data2_admin", "", "write")
+	var rules []*CasbinRule
+	if _, err := getDatastore(t).GetAll(ctx, query, &rules); err != nil {
+		t.Fatalf("Expected GetAll() to be successful; got %v", err)
+	}
+	if len(rules) != 1 || rules[0].V1 != "data2" {
+		t.Errorf("got %v, wants the write rule of data2_admin", rules)
+	}
+}
+
+func TestProjectedFields(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+
+	config.ProjectedFields = 3
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf", a)
+
+	testGetPolicy(e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}}, func(actual, wants [][]string) {
+		t.Error("got: ", actual, ", wants ", wants)
+	})
+	grouping, _ := e.GetGroupingPolicy()
+	if !SamePolicy(grouping, [][]string{{"alice", "data2_admin"}}) {
+		t.Error("got: ", grouping, ", wants ", [][]string{{"alice", "data2_admin"}})
+	}
+}
+
+func TestPTypeNamespaceRouting(t *testing.T) {
+	a := &Adapter{config: withDefaults(Config{
+		Namespace:       "rules",
+		PTypeNamespaces: map[string]string{"g": "roles", "g2": "roles"},
+	})}
+	ctx := context.Background()
+
+	for ptype, want := range map[string]string{"p": "rules", "g": "roles", "g2": "roles"} {
+		if got := a.ruleKey(a.ptypeContext(ctx, ptype), &CasbinRule{PType: ptype, V0: "x"}).Namespace; got != want {
+			t.Errorf("%s: got namespace %q, wants %q", ptype, got, want)
+		}
+	}
+
+	var namespaces []string
+	for _, ctx := range a.namespaceContexts(ctx) {
+		namespaces = append(namespaces, a.namespace(ctx))
+	}
+	if fmt.Sprint(namespaces) != "[rules roles]" {
+		t.Errorf("got %v, wants [rules roles]", namespaces)
+	}
+}
+
+func TestPTypeNamespaces(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest", PTypeNamespaces: map[string]string{"g": "unittest_roles"}}
+	initPolicy(t, config)
+
+	// The role rule lives in its own namespace only.
+	plain := NewAdapterWithConfig(getDatastore(t), Config{Kind: "casbin_test", Namespace: "unittest"})
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf", plain)
+	if grouping, _ := e.GetGroupingPolicy(); len(grouping) != 0 {
+		t.Error("got: ", grouping, ", wants no grouping rules in the base namespace")
+	}
+
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	e, _ = casbin.NewEnforcer("examples/rbac_model.conf", a)
+	e.AddGroupingPolicy("bob", "data2_admin")
+	if err := e.LoadPolicy(); err != nil {
+		t.Fatalf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	grouping, _ := e.GetGroupingPolicy()
+	if !SamePolicy(grouping, [][]string{{"alice", "data2_admin"}, {"bob", "data2_admin"}}) {
+		t.Error("got: ", grouping, ", wants ", [][]string{{"alice", "data2_admin"}, {"bob", "data2_admin"}})
+	}
+	testGetPolicy(e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}}, func(actual, wants [][]string) {
+		t.Error("got: ", actual, ", wants ", wants)
+	})
+}
+
+func TestSectionKinds(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest", GroupingKind: "casbin_test_roles"}
+	initPolicy(t, config)
+
+	// The role rule lives in its own kind only.
+	plain := NewAdapterWithConfig(getDatastore(t), Config{Kind: "casbin_test", Namespace: "unittest"})
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf", plain)
+	if grouping, _ := e.GetGroupingPolicy(); len(grouping) != 0 {
+		t.Error("got: ", grouping, ", wants no grouping rules in the base kind")
+	}
+
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	e, _ = casbin.NewEnforcer("examples/rbac_model.conf", a)
+	e.AddGroupingPolicy("bob", "data2_admin")
+	if err := e.LoadPolicy(); err != nil {
+		t.Fatalf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	grouping, _ := e.GetGroupingPolicy()
+	if !SamePolicy(grouping, [][]string{{"alice", "data2_admin"}, {"bob", "data2_admin"}}) {
+		t.Error("got: ", grouping, ", wants ", [][]string{{"alice", "data2_admin"}, {"bob", "data2_admin"}})
+	}
+	testGetPolicy(e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}}, func(actual, wants [][]string) {
+		t.Error("got: ", actual, ", wants ", wants)
+	})
+}
+
+func TestSectionKindRouting(t *testing.T) {
+	a := &Adapter{config: withDefaults(Config{PolicyKind: "casbin_p", GroupingKind: "casbin_g",
+		PTypeNamespaces: map[string]string{"g2": "roles"}})}
+	ctx := context.Background()
+
+	for ptype, want := range map[string]string{"p": "casbin_p", "p2": "casbin_p", "g": "casbin_g", "x": "casbin"} {
+		line := CasbinRule{PType: ptype, V0: "alice"}
+		if key := a.ruleKey(a.ptypeContext(ctx, ptype), &line); key.Kind != want || key.Parent.Kind != want {
+			t.Errorf("got kind %q under %q for %s, wants %q", key.Kind, key.Parent.Kind, ptype, want)
+		}
+	}
+
+	var scopes []string
+	for _, ctx := range a.namespaceContexts(ctx) {
+		scopes = append(scopes, a.namespace(ctx)+"/"+a.kind(ctx))
+	}
+	want := []string{"/casbin", "/casbin_p", "/casbin_g", "roles/casbin", "roles/casbin_p", "roles/casbin_g"}
+	if !reflect.DeepEqual(scopes, want) {
+		t.Errorf("got scopes %q, wants %q", scopes, want)
+	}
+	if !a.routed(a.ptypeContext(ctx, "g"), &CasbinRule{PType: "g"}) || a.routed(ctx, &CasbinRule{PType: "g"}) {
+		t.Error("got g rules routed to the wrong kind")
+	}
+}
+
+func TestInsertOnly(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+
+	config.InsertOnly = true
+	a := NewAdapterWithConfig(getDatastore(t), config)
+
+	err := a.AddPolicy("p", "p", []string{"alice", "data1", "read"})
+	var ruleErr RuleError
+	if !errors.Is(err, ErrAlreadyExists) || !errors.As(err, &ruleErr) || ruleErr.Rule.V0 != "alice" {
+		t.Errorf("got %v, wants ErrAlreadyExists for alice's rule", err)
+	}
+	if err := a.AddPolicy("p", "p", []string{"carol", "data1", "read"}); err != nil {
+		t.Errorf("Expected AddPolicy() to be successful; got %v", err)
+	}
+	err = a.AddPolicies("p", "p", [][]string{{"dave", "data1", "read"}, {"bob", "data2", "write"}})
+	if !errors.Is(err, ErrAlreadyExists) {
+		t.Errorf("got %v, wants ErrAlreadyExists", err)
+	}
+
+	// The failed batch wrote nothing.
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	testGetPolicy(e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"carol", "data1", "read"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}}, func(actual, wants [][]string) {
+		t.Error("got: ", actual, ", wants ", wants)
+	})
+}
+
+func TestQueryPolicy(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	rules, err := a.QueryPolicy(context.Background(), "p", 1, "data2")
+	if err != nil {
+		t.Fatalf("Expected QueryPolicy() to be successful; got %v", err)
+	}
+	wants := [][]string{{"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}}
+	if !SamePolicy(rules, wants) {
+		t.Error("got: ", rules, ", wants ", wants)
+	}
+
+	// Expired rules are skipped like LoadPolicy skips them.
+	config.TTLProperty, config.TTL = "expires", time.Nanosecond
+	a = NewAdapterWithConfig(getDatastore(t), config)
+	if err := a.AddPolicy("p", "p", []string{"carol", "data2", "read"}); err != nil {
+		t.Fatalf("Expected AddPolicy() to be successful; got %v", err)
+	}
+	rules, err = a.QueryPolicy(context.Background(), "p", 1, "data2")
+	if err != nil {
+		t.Fatalf("Expected QueryPolicy() to be successful; got %v", err)
+	}
+	if !SamePolicy(rules, wants) {
+		t.Error("got: ", rules, ", wants ", wants)
+	}
+}
+
+func TestSavePolicyProgress(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+
+	var progress [][2]int
+	config.OnProgress = func(done, total int) {
+		progress = append(progress, [2]int{done, total})
+	}
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	e.EnableAutoSave(false)
+
+	// 600 rules need two transactions.
+	for i := 0; i < 600; i++ {
+		e.AddPolicy(fmt.Sprintf("user%d", i), "data1", "read")
+	}
+	if err := e.SavePolicy(); err != nil {
+		t.Fatalf("Expected SavePolicy() to be successful; got %v", err)
+	}
+	wants := [][2]int{{499, 600}, {600, 600}}
+	if fmt.Sprint(progress) != fmt.Sprint(wants) {
+		t.Errorf("got progress %v, wants %v", progress, wants)
+	}
+
+	// A small save is a single transaction.
+	progress = nil
+	initPolicy(t, Config{Kind: "casbin_test", Namespace: "unittest"})
+	if err := e.LoadPolicy(); err != nil {
+		t.Fatalf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	e.AddPolicy("carol", "data1", "read")
+	if err := e.SavePolicy(); err != nil {
+		t.Fatalf("Expected SavePolicy() to be successful; got %v", err)
+	}
+	if wants := [][2]int{{1, 1}}; fmt.Sprint(progress) != fmt.Sprint(wants) {
+		t.Errorf("got progress %v, wants %v", progress, wants)
+	}
+}
+
+func TestSavePolicyCancelled(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Cancelling after the first transaction stops before the second.
+	config.OnProgress = func(done, total int) { cancel() }
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	e.EnableAutoSave(false)
+
+	for i := 0; i < 600; i++ {
+		e.AddPolicy(fmt.Sprintf("user%d", i), "data1", "read")
+	}
+	err := a.SavePolicyCtx(ctx, e.GetModel())
+	var perr *PartialError
+	if !errors.As(err, &perr) || !errors.Is(err, ErrPartiallyApplied) || !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, wants a partially applied, cancelled save", err)
+	}
+	if perr.Done != 499 || perr.Total != 600 {
+		t.Errorf("got %d of %d mutations, wants 499 of 600", perr.Done, perr.Total)
+	}
+
+	if err := a.SavePolicy(e.GetModel()); err != nil {
+		t.Fatalf("Expected SavePolicy() to be successful; got %v", err)
+	}
+	if err := e.LoadPolicy(); err != nil {
+		t.Fatalf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	if actual, _ := e.GetPolicy(); len(actual) != 604 {
+		t.Errorf("got %d rules, wants 604", len(actual))
+	}
+}
+func TestGuardBroadDeletes(t *testing.T) {
+	a := &Adapter{config: withDefaults(Config{GuardBroadDeletes: true})}
+	ctx := context.Background()
+
+	for _, filter := range []FilterSpec{
+		{FieldIndex: 0},
+		{FieldIndex: 0, FieldValues: []string{"", ""}},
+		{FieldIndex: 6, FieldValues: []string{"alice"}},
+	} {
+		if err := a.RemoveFilteredPolicyCtx(ctx, "p", "p", filter.FieldIndex, filter.FieldValues...); !errors.Is(err, ErrBroadDelete) {
+			t.Errorf("%v: got %v, wants %v", filter, err, ErrBroadDelete)
+		}
+		if err := a.RemoveFilteredPoliciesCtx(ctx, "p", "p", []FilterSpec{{FieldIndex: 0, FieldValues: []string{"alice"}}, filter}); !errors.Is(err, ErrBroadDelete) {
+			t.Errorf("%v: got %v, wants %v", filter, err, ErrBroadDelete)
+		}
+		if err := a.checkBroadDelete(AllowBroadDeletes(ctx), "p", filter.FieldIndex, filter.FieldValues...); err != nil {
+			t.Errorf("%v: got %v, wants the override to allow it", filter, err)
+		}
+	}
+	if err := a.checkBroadDelete(ctx, "p", 1, "", "data1"); err != nil {
+		t.Errorf("got %v, wants a constrained filter to pass", err)
+	}
+
+	a.config.GuardBroadDeletes = false
+	if err := a.checkBroadDelete(ctx, "p", 0); err != nil {
+		t.Errorf("got %v, wants the guard to be off", err)
+	}
+}
+
+func TestIndexFallback(t *testing.T) {
+	missing := status.Error(codes.FailedPrecondition, "no matching index found")
+	a := &Adapter{config: withDefaults(Config{})}
+	if a.indexFallback(missing) {
+		t.Error("Expected no fallback unless IndexFallback is set")
+	}
+	a = &Adapter{config: withDefaults(Config{IndexFallback: true})}
+	if !a.indexFallback(missing) || a.indexFallback(status.Error(codes.Unavailable, "")) || a.indexFallback(nil) {
+		t.Error("Expected a fallback only for missing indexes")
+	}
+
+	stored := []*CasbinRule{
+		{PType: "p", V0: "alice", V1: "data1", V2: "read"},
+		{PType: "p", V0: "bob", V1: "data2", V2: "write"},
+		{PType: "g", V0: "alice", V1: "data2_admin"},
+	}
+	query := func(ctx context.Context, build func(ctx context.Context) *datastore.Query) ([]*CasbinRule, error) {
+		return append([]*CasbinRule(nil), stored...), nil
+	}
+	rules, err := a.fallbackRules(context.Background(), query, func(rule *CasbinRule) bool {
+		return rule.PType == "p" && matchesFilter(rule, 0, "alice")
+	})
+	if err != nil {
+		t.Fatalf("Expected fallbackRules() to be successful; got %v", err)
+	}
+	if len(rules) != 1 || rules[0] != stored[0] {
+		t.Errorf("got %v, wants only alice's p rule", rules)
+	}
+}
+
+func TestMultiplePolicyDefinitions(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest_p2"}
+	file, _ := casbin.NewEnforcer("examples/multiple_policy_definitions_model.conf", "examples/multiple_policy_definitions_policy.csv")
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	if err := a.SavePolicy(file.GetModel()); err != nil {
+		t.Fatalf("Expected SavePolicy() to be successful; got %v", err)
+	}
+
+	e, _ := casbin.NewEnforcer("examples/multiple_policy_definitions_model.conf", a)
+	adult := []string{"r2.sub.Age > 18 && r2.sub.Age < 60", "/data1", "read", "allow"}
+	senior := []string{"r2.sub.Age > 60 && r2.sub.Age < 100", "/data1", "read", "deny"}
+	if p2, _ := e.GetNamedPolicy("p2"); !SamePolicy(p2, [][]string{adult, senior}) {
+		t.Errorf("got p2 rules %v, wants both", p2)
+	}
+
+	// Writes to p2 leave p alone, and the other way round.
+	if err := a.AddPolicy("p", "p2", []string{"true", "/data2", "write", "allow"}); err != nil {
+		t.Fatalf("Expected AddPolicy() to be successful; got %v", err)
+	}
+	if err := a.UpdatePolicy("p", "p2", adult, []string{"r2.sub.Age >= 18", "/data1", "read", "allow"}); err != nil {
+		t.Fatalf("Expected UpdatePolicy() to be successful; got %v", err)
+	}
+	if err := a.RemoveFilteredPolicy("p", "p2", 1, "/data1"); err != nil {
+		t.Fatalf("Expected RemoveFilteredPolicy() to be successful; got %v", err)
+	}
+	if err := a.RemoveFilteredPolicy("p", "p", 0, "data2_admin"); err != nil {
+		t.Fatalf("Expected RemoveFilteredPolicy() to be successful; got %v", err)
+	}
+
+	if err := e.LoadPolicy(); err != nil {
+		t.Fatalf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	if p, _ := e.GetNamedPolicy("p"); len(p) != 0 {
+		t.Errorf("got p rules %v, wants none", p)
+	}
+	if p2, _ := e.GetNamedPolicy("p2"); !SamePolicy(p2, [][]string{{"true", "/data2", "write", "allow"}}) {
+		t.Errorf("got p2 rules %v, wants only the added one", p2)
+	}
+	if g, _ := e.GetNamedGroupingPolicy("g"); !SamePolicy(g, [][]string{{"alice", "data2_admin"}}) {
+		t.Errorf("got g rules %v, wants alice's role", g)
+	}
+}
+
+func TestFindBySubject(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	defer initPolicy(t, config)
+
+	for _, format := range []string{StorageFormatFields, StorageFormatCSV} {
+		config.StorageFormat = format
+		initPolicy(t, config)
+		a := NewAdapterWithConfig(getDatastore(t), config)
+
+		rules, err := a.FindBySubject(context.Background(), "alice")
+		if err != nil {
+			t.Fatalf("Expected FindBySubject() to be successful; got %v", err)
+		}
+		wants := [][]string{{"g", "alice", "data2_admin"}, {"p", "alice", "data1", "read"}}
+		if !reflect.DeepEqual(rules, wants) {
+			t.Errorf("%s: got %v, wants %v", format, rules, wants)
+		}
+	}
 }
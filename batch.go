@@ -0,0 +1,135 @@
+package datastoreadapter
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+func (a *Adapter) AddPolicies(sec string, ptype string, rules [][]string) error {
+	return a.AddPoliciesCtx(context.Background(), sec, ptype, rules)
+}
+
+// AddPoliciesCtx adds policy rules to the storage in one transaction. A
+// single rule takes the cheaper non-transactional AddPolicy path, and
+// batches too large for one transaction are split unless Config.BatchAtomic
+// is set.
+func (a *Adapter) AddPoliciesCtx(ctx context.Context, sec string, ptype string, rules [][]string) (err error) {
+	defer a.observe(a.ptypeContext(ctx, ptype), "AddPolicies", time.Now(), &err)
+	if err := a.checkWritable(); err != nil {
+		return err
+	}
+	switch len(rules) {
+	case 0:
+		return nil
+	case 1:
+		return a.addPolicy(ctx, ptype, rules[0])
+	}
+	for _, rule := range rules {
+		if err := a.validateRule(ptype, rule); err != nil {
+			return err
+		}
+	}
+	m := Mutation{Op: "AddPolicies", PType: ptype, Rules: rules}
+	if err := a.beforeMutate(ctx, m); err != nil {
+		return err
+	}
+	defer a.afterMutate(ctx, m, &err)
+
+	ctx, cancel := withDeadline(a.ptypeContext(ctx, ptype), a.config.AddRemoveDeadline)
+	defer cancel()
+
+	keys, lines := a.batchLines(ctx, ptype, rules)
+	if a.config.Debug {
+		a.logPrintln("[AddPolicies] called:", len(lines), "rules")
+	}
+	if a.stageAll(ctx, keys, lines, false) {
+		return nil
+	}
+	if len(keys) > maxPutsPerTx {
+		if a.config.BatchAtomic {
+			return fmt.Errorf("%w: %d rules, the limit is %d",
+				ErrTooManyMutations, len(keys), maxPutsPerTx)
+		}
+		return a.putChunked(ctx, keys, lines, a.config.InsertOnly, nil)
+	}
+
+	return a.retry(ctx, func(db *datastore.Client) error {
+		_, err := db.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+			return a.putRules(ctx, tx, keys, lines, a.config.InsertOnly)
+		})
+		return insertConflict(err, lines)
+	})
+}
+
+func (a *Adapter) RemovePolicies(sec string, ptype string, rules [][]string) error {
+	return a.RemovePoliciesCtx(context.Background(), sec, ptype, rules)
+}
+
+// RemovePoliciesCtx removes policy rules from the storage in one transaction.
+// A single rule takes the cheaper non-transactional RemovePolicy path, and
+// batches too large for one transaction are split unless Config.BatchAtomic
+// is set.
+func (a *Adapter) RemovePoliciesCtx(ctx context.Context, sec string, ptype string, rules [][]string) (err error) {
+	defer a.observe(a.ptypeContext(ctx, ptype), "RemovePolicies", time.Now(), &err)
+	if err := a.checkWritable(); err != nil {
+		return err
+	}
+	switch len(rules) {
+	case 0:
+		return nil
+	case 1:
+		return a.removePolicy(ctx, ptype, rules[0])
+	}
+	m := Mutation{Op: "RemovePolicies", PType: ptype, Rules: rules}
+	if err := a.beforeMutate(ctx, m); err != nil {
+		return err
+	}
+	defer a.afterMutate(ctx, m, &err)
+
+	ctx, cancel := withDeadline(a.ptypeContext(ctx, ptype), a.config.AddRemoveDeadline)
+	defer cancel()
+
+	keys, lines := a.batchLines(ctx, ptype, rules)
+	if a.config.Debug {
+		a.logPrintln("[RemovePolicies] called:", len(keys), "rules")
+	}
+	if a.stageAll(ctx, keys, lines, true) {
+		return nil
+	}
+	if len(keys) > maxMutationsPerTx {
+		if a.config.BatchAtomic {
+			return fmt.Errorf("%w: %d rules, the limit is %d",
+				ErrTooManyMutations, len(keys), maxMutationsPerTx)
+		}
+		return a.deleteChunked(ctx, keys, lines, nil)
+	}
+
+	return a.retry(ctx, func(db *datastore.Client) error {
+		_, err := db.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+			return rulesError(tx.DeleteMulti(keys), lines)
+		})
+		return err
+	})
+}
+
+// batchLines converts rules to entities and their keys. Duplicate rules are
+// dropped, as a commit can't mutate the same entity twice.
+func (a *Adapter) batchLines(ctx context.Context, ptype string, rules [][]string) ([]*datastore.Key, []*CasbinRule) {
+	seen := make(map[string]bool, len(rules))
+	keys := make([]*datastore.Key, 0, len(rules))
+	lines := make([]*CasbinRule, 0, len(rules))
+	for _, rule := range rules {
+		line := a.storedLine(ptype, rule)
+		name := a.keyName(&line)
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		keys = append(keys, a.ruleKey(ctx, &line))
+		lines = append(lines, &line)
+	}
+	return keys, lines
+}
@@ -0,0 +1,129 @@
+package datastoreadapter
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/casbin/casbin/v2"
+)
+
+func TestAddRemovePolicies(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf", a)
+
+	rules := [][]string{{"alice", "data1", "write"}, {"bob", "data1", "read"}, {"bob", "data1", "read"}}
+	if err := a.AddPolicies("p", "p", rules); err != nil {
+		t.Errorf("Expected AddPolicies() to be successful; got %v", err)
+	}
+	if err := e.LoadPolicy(); err != nil {
+		t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(e, [][]string{{"alice", "data1", "read"}, {"alice", "data1", "write"}, {"bob", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}}, func(actual, wants [][]string) {
+		t.Error("got: ", actual, ", wants ", wants)
+	})
+
+	if err := a.RemovePolicies("p", "p", rules); err != nil {
+		t.Errorf("Expected RemovePolicies() to be successful; got %v", err)
+	}
+	if err := e.LoadPolicy(); err != nil {
+		t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}}, func(actual, wants [][]string) {
+		t.Error("got: ", actual, ", wants ", wants)
+	})
+}
+
+func TestAddPoliciesChunked(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+	defer initPolicy(t, config)
+
+	var rules [][]string
+	for i := 0; i < 1000; i++ {
+		rules = append(rules, []string{"user" + fmt.Sprint(i), "data1", "read"})
+	}
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	if err := a.AddPolicies("p", "p", rules); err != nil {
+		t.Fatalf("Expected AddPolicies() to be successful; got %v", err)
+	}
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	if actual, _ := e.GetPolicy(); len(actual) != 1002 {
+		t.Errorf("got %d rules, wants 1002", len(actual))
+	}
+
+	if err := a.RemovePolicies("p", "p", rules); err != nil {
+		t.Fatalf("Expected RemovePolicies() to be successful; got %v", err)
+	}
+	if err := e.LoadPolicy(); err != nil {
+		t.Fatalf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	if actual, _ := e.GetPolicy(); len(actual) != 2 {
+		t.Errorf("got %d rules, wants 2", len(actual))
+	}
+}
+
+func TestBatchAtomic(t *testing.T) {
+	a := &Adapter{config: withDefaults(Config{BatchAtomic: true})}
+	var rules [][]string
+	for i := 0; i < maxMutationsPerTx+1; i++ {
+		rules = append(rules, []string{"user" + fmt.Sprint(i), "data1", "read"})
+	}
+	if err := a.AddPolicies("p", "p", rules); !errors.Is(err, ErrTooManyMutations) {
+		t.Errorf("got %v, wants %v", err, ErrTooManyMutations)
+	}
+	if err := a.RemovePolicies("p", "p", rules); !errors.Is(err, ErrTooManyMutations) {
+		t.Errorf("got %v, wants %v", err, ErrTooManyMutations)
+	}
+}
+
+func BenchmarkAddPolicy(b *testing.B) {
+	a := NewAdapterWithConfig(getDatastore(b), Config{Kind: "casbin_bench", Namespace: "unittest"})
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := a.AddPolicy("p", "p", []string{"bench", fmt.Sprint(i), "read"}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAddPoliciesSingle(b *testing.B) {
+	a := NewAdapterWithConfig(getDatastore(b), Config{Kind: "casbin_bench", Namespace: "unittest"})
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := a.AddPolicies("p", "p", [][]string{{"bench", fmt.Sprint(i), "read"}}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAddPoliciesBatch(b *testing.B) {
+	a := NewAdapterWithConfig(getDatastore(b), Config{Kind: "casbin_bench", Namespace: "unittest"})
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		rules := [][]string{{"bench", fmt.Sprint(i), "read"}, {"bench", fmt.Sprint(i), "write"}}
+		if err := a.AddPolicies("p", "p", rules); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRemoveFilteredPolicy(b *testing.B) {
+	a := NewAdapterWithConfig(getDatastore(b), Config{Kind: "casbin_bench", Namespace: "unittest"})
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		rules := [][]string{{"bench", fmt.Sprint(i), "read"}, {"bench", fmt.Sprint(i), "write"}}
+		if err := a.AddPolicies("p", "p", rules); err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+
+		if err := a.RemoveFilteredPolicy("p", "p", 1, fmt.Sprint(i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
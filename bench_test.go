@@ -0,0 +1,129 @@
+package datastoreadapter
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/casbin/casbin/v2/model"
+)
+
+// benchSizes are the policy sizes the storage benchmarks run with. The
+// largest only runs without -short, as seeding it takes a while.
+var benchSizes = []int{1000, 10000, 100000}
+
+// benchModel returns the RBAC model with n policy rules and n/10 grouping
+// rules.
+func benchModel(b *testing.B, n int) model.Model {
+	m, err := model.NewModelFromFile("examples/rbac_model.conf")
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		m.AddPolicy("p", "p", []string{fmt.Sprintf("user%d", i), fmt.Sprintf("data%d", i%100), "read"})
+	}
+	for i := 0; i < n/10; i++ {
+		m.AddPolicy("g", "g", []string{fmt.Sprintf("user%d", i), fmt.Sprintf("role%d", i%10)})
+	}
+	return m
+}
+
+// benchAdapter returns an adapter on a kind of its own, seeded with the
+// rules of m.
+func benchAdapter(b *testing.B, n int, m model.Model) *Adapter {
+	if n > 10000 && testing.Short() {
+		b.Skip("skipping the largest policy in short mode")
+	}
+	a := NewAdapterWithConfig(getDatastore(b), Config{Kind: fmt.Sprintf("casbin_bench_%d", n), Namespace: "benchmark"})
+	if err := a.SavePolicy(m); err != nil {
+		b.Fatalf("Expected SavePolicy() to be successful; got %v", err)
+	}
+	return a
+}
+
+func BenchmarkLoadPolicy(b *testing.B) {
+	for _, n := range benchSizes {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			a := benchAdapter(b, n, benchModel(b, n))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				m, _ := model.NewModelFromFile("examples/rbac_model.conf")
+				b.StartTimer()
+				if err := a.LoadPolicy(m); err != nil {
+					b.Fatalf("Expected LoadPolicy() to be successful; got %v", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkSavePolicy(b *testing.B) {
+	for _, n := range benchSizes {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			m := benchModel(b, n)
+			a := benchAdapter(b, n, m)
+			// Every other save changes one rule, so the diff is exercised as
+			// well as the unchanged case.
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if i%2 == 0 {
+					m.AddPolicy("p", "p", []string{"bench", "data", "write"})
+				} else {
+					m.RemovePolicy("p", "p", []string{"bench", "data", "write"})
+				}
+				if _, err := a.SavePolicyWithResult(context.Background(), m); err != nil {
+					b.Fatalf("Expected SavePolicy() to be successful; got %v", err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkLoadPolicyLine measures the in-memory part of a load, which
+// doesn't need Datastore.
+func BenchmarkLoadPolicyLine(b *testing.B) {
+	m, err := model.NewModelFromFile("examples/rbac_model.conf")
+	if err != nil {
+		b.Fatal(err)
+	}
+	lines := make([]CasbinRule, 1000)
+	for i := range lines {
+		lines[i] = CasbinRule{PType: "p", V0: fmt.Sprintf("user%d", i), V1: "data1", V2: "read"}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.ClearPolicy()
+		for _, line := range lines {
+			if err := loadPolicyLine(line, m); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// BenchmarkShardedWrites adds rules concurrently with different numbers of
+// entity groups. Datastore limits the write rate of each group, so
+// throughput should grow roughly with the number of shards.
+func BenchmarkShardedWrites(b *testing.B) {
+	for _, shards := range []int{1, 4, 16} {
+		b.Run(fmt.Sprint(shards), func(b *testing.B) {
+			a := NewAdapterWithConfig(getDatastore(b), Config{Kind: "casbin_bench_sharded", Namespace: "benchmark", EntityGroupShards: shards})
+			var n int64
+			b.SetParallelism(8)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					i := atomic.AddInt64(&n, 1)
+					if err := a.AddPolicy("p", "p", []string{fmt.Sprintf("user%d", i), fmt.Sprint(shards), "read"}); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
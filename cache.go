@@ -0,0 +1,71 @@
+package datastoreadapter
+
+import (
+	"context"
+	"time"
+)
+
+// cachedRules are the rules loaded by LoadPolicy for a namespace, see
+// Config.CacheTTL.
+type cachedRules struct {
+	rules     []*CasbinRule
+	truncated bool
+	expires   time.Time
+}
+
+// loadCache holds the cached rules by namespace. Invalidations bump the
+// generation of their namespace, so that a load overlapping a write doesn't
+// cache the rules from before it.
+type loadCache struct {
+	entries     map[string]cachedRules
+	generations map[string]uint64
+}
+
+// cachedLoad returns the rules cached for namespace, if they haven't
+// expired, else runs load and caches its rules. Whether they were
+// truncated by Config.LoadLimit is cached with them.
+func (a *Adapter) cachedLoad(namespace string, load loadFunc) ([]*CasbinRule, bool, error) {
+	a.cacheMu.Lock()
+	if entry, ok := a.cache.entries[namespace]; ok && time.Now().Before(entry.expires) {
+		a.cacheMu.Unlock()
+		return entry.rules, entry.truncated, nil
+	}
+	generation := a.cache.generations[namespace]
+	a.cacheMu.Unlock()
+
+	rules, truncated, err := load()
+	if err != nil {
+		return nil, false, err
+	}
+
+	a.cacheMu.Lock()
+	defer a.cacheMu.Unlock()
+	if a.cache.generations[namespace] == generation {
+		if a.cache.entries == nil {
+			a.cache.entries = make(map[string]cachedRules)
+		}
+		a.cache.entries[namespace] = cachedRules{rules: rules, truncated: truncated, expires: time.Now().Add(a.config.CacheTTL)}
+	}
+	return rules, truncated, nil
+}
+
+// InvalidateCache drops the rules cached for the namespace of ctx, see
+// Config.CacheTTL, e.g. after another process changed its policy. The
+// caches of other namespaces are kept.
+func (a *Adapter) InvalidateCache(ctx context.Context) {
+	a.invalidateNamespace(a.baseNamespace(ctx))
+}
+
+// invalidateNamespace drops the rules cached for namespace.
+func (a *Adapter) invalidateNamespace(namespace string) {
+	if a.config.CacheTTL <= 0 {
+		return
+	}
+	a.cacheMu.Lock()
+	defer a.cacheMu.Unlock()
+	if a.cache.generations == nil {
+		a.cache.generations = make(map[string]uint64)
+	}
+	delete(a.cache.entries, namespace)
+	a.cache.generations[namespace]++
+}
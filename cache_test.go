@@ -0,0 +1,76 @@
+package datastoreadapter
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCacheByNamespace(t *testing.T) {
+	a := &Adapter{config: withDefaults(Config{CacheTTL: time.Minute})}
+	loads := make(map[string]int)
+	load := func(ctx context.Context) {
+		ns := a.baseNamespace(ctx)
+		_, _, err := a.cachedLoad(ns, func() ([]*CasbinRule, bool, error) {
+			loads[ns]++
+			return []*CasbinRule{{PType: "p", V0: ns}}, false, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tenantA := ContextWithNamespace(context.Background(), "a")
+	tenantB := ContextWithNamespace(context.Background(), "b")
+
+	load(tenantA)
+	load(tenantB)
+	load(tenantA)
+	load(tenantB)
+	if loads["a"] != 1 || loads["b"] != 1 {
+		t.Errorf("got %v loads, wants one per namespace", loads)
+	}
+
+	// Staging keeps the write off Datastore.
+	if err := a.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	defer a.Rollback()
+	if err := a.AddPolicyCtx(tenantA, "p", "p", []string{"alice", "data1", "read"}); err != nil {
+		t.Fatalf("Expected AddPolicyCtx() to be successful; got %v", err)
+	}
+	load(tenantA)
+	load(tenantB)
+	if loads["a"] != 2 || loads["b"] != 1 {
+		t.Errorf("got %v loads, wants only namespace a reloaded", loads)
+	}
+
+	// Commit drops the cache of namespace a again, once written.
+	if !reflect.DeepEqual(a.staged.namespaces, map[string]bool{"a": true}) {
+		t.Errorf("got staged namespaces %v, wants only a", a.staged.namespaces)
+	}
+	a.invalidateNamespace("a")
+	load(tenantA)
+	load(tenantB)
+	if loads["a"] != 3 || loads["b"] != 1 {
+		t.Errorf("got %v loads, wants only namespace a reloaded", loads)
+	}
+}
+
+func TestCacheExpires(t *testing.T) {
+	a := &Adapter{config: withDefaults(Config{CacheTTL: time.Nanosecond})}
+	n := 0
+	load := func() ([]*CasbinRule, bool, error) {
+		n++
+		return nil, false, nil
+	}
+	for i := 0; i < 2; i++ {
+		if _, _, err := a.cachedLoad("", load); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n != 2 {
+		t.Errorf("got %d loads, wants 2", n)
+	}
+}
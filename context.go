@@ -0,0 +1,63 @@
+package datastoreadapter
+
+import (
+	"context"
+	"time"
+)
+
+// namespaceKey is the context key of the namespace set by
+// ContextWithNamespace.
+type namespaceKey struct{}
+
+// actorKey is the context key of the actor set by ContextWithActor.
+type actorKey struct{}
+
+// ContextWithNamespace returns a copy of ctx making the operations it is
+// passed to use namespace, e.g. the tenant of the current request, instead
+// of Config.Namespace or Config.NamespaceFunc. Ptypes listed in
+// Config.PTypeNamespaces keep their own namespace.
+func ContextWithNamespace(ctx context.Context, namespace string) context.Context {
+	return context.WithValue(ctx, namespaceKey{}, namespace)
+}
+
+// NamespaceFromContext returns the namespace set by ContextWithNamespace, if
+// any.
+func NamespaceFromContext(ctx context.Context) (string, bool) {
+	ns, ok := ctx.Value(namespaceKey{}).(string)
+	return ns, ok
+}
+
+// ContextWithActor returns a copy of ctx carrying actor, e.g. the user making
+// the current request. The adapter reports it in Operation.Actor so that
+// Config.OnOperation can keep an audit log.
+func ContextWithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFromContext returns the actor set by ContextWithActor, if any.
+func ActorFromContext(ctx context.Context) (string, bool) {
+	actor, ok := ctx.Value(actorKey{}).(string)
+	return actor, ok
+}
+
+// detachedContext carries the values of its parent, but neither its
+// deadline nor its cancellation.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}               { return nil }
+func (detachedContext) Err() error                          { return nil }
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
+
+// chunkContext returns the context to commit a chunk of a multi-transaction
+// write in: detached from ctx, so that cancelling ctx doesn't interrupt a
+// chunk being committed, and bounded by Config.AddRemoveDeadline instead.
+// Without that deadline, it is ctx itself.
+func (a *Adapter) chunkContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if a.config.AddRemoveDeadline < 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(detachedContext{ctx}, a.config.AddRemoveDeadline)
+}
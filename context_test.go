@@ -0,0 +1,44 @@
+package datastoreadapter
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestContextWithNamespace(t *testing.T) {
+	a := &Adapter{config: withDefaults(Config{
+		Namespace:       "default",
+		PTypeNamespaces: map[string]string{"g": "roles"},
+	})}
+	ctx := ContextWithNamespace(context.Background(), "tenant1")
+	if ns := a.namespace(ctx); ns != "tenant1" {
+		t.Errorf("got namespace %q, wants tenant1", ns)
+	}
+	if ns := a.namespace(a.ptypeContext(ctx, "g")); ns != "roles" {
+		t.Errorf("got namespace %q for g, wants roles", ns)
+	}
+
+	a = &Adapter{config: withDefaults(Config{NamespaceFunc: func(ctx context.Context) string { return "func" }})}
+	if ns := a.namespace(ctx); ns != "tenant1" {
+		t.Errorf("got namespace %q, wants the context's to override NamespaceFunc", ns)
+	}
+	if ns := a.namespace(context.Background()); ns != "func" {
+		t.Errorf("got namespace %q, wants func", ns)
+	}
+}
+
+func TestContextWithActor(t *testing.T) {
+	var ops []Operation
+	a := &Adapter{config: withDefaults(Config{OnOperation: func(op Operation) { ops = append(ops, op) }})}
+
+	var err error
+	a.observe(ContextWithActor(context.Background(), "alice"), "AddPolicy", time.Now(), &err)
+	a.observe(context.Background(), "AddPolicy", time.Now(), &err)
+	if len(ops) != 2 || ops[0].Actor != "alice" || ops[1].Actor != "" {
+		t.Errorf("got %+v, wants alice's operation then an anonymous one", ops)
+	}
+	if actor, ok := ActorFromContext(context.Background()); ok {
+		t.Errorf("got actor %q, wants none", actor)
+	}
+}
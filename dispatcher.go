@@ -0,0 +1,127 @@
+package datastoreadapter
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/casbin/casbin/v2/model"
+	"github.com/casbin/casbin/v2/persist"
+)
+
+// PersistDelta removes the rules of removed and adds those of added in one
+// transaction, e.g. to persist a change coordinated by a persist.Dispatcher.
+// A rule in both is added. Deltas too large for one transaction are split,
+// removals first, unless Config.BatchAtomic is set. The change is published
+// as "RemovePolicy" and "AddPolicy" events, see Config.Publisher.
+func (a *Adapter) PersistDelta(ctx context.Context, sec string, ptype string, added, removed [][]string) (err error) {
+	defer a.observe(a.ptypeContext(ctx, ptype), "PersistDelta", time.Now(), &err)
+	if err := a.checkWritable(); err != nil {
+		return err
+	}
+	for _, rule := range added {
+		if err := a.validateRule(ptype, rule); err != nil {
+			return err
+		}
+	}
+	m := Mutation{Op: "PersistDelta", PType: ptype, Rules: added, OldRules: removed}
+	if err := a.beforeMutate(ctx, m); err != nil {
+		return err
+	}
+	// The lines are read once the write is done, to publish its events.
+	var addLines, removeLines []*CasbinRule
+	defer a.afterMutations(ctx, []Mutation{m}, func() []PolicyEvent {
+		return a.changeEvents(ctx, removeLines, addLines)
+	}, &err)
+
+	ctx, cancel := withDeadline(a.ptypeContext(ctx, ptype), a.config.AddRemoveDeadline)
+	defer cancel()
+
+	var addKeys, removeKeys []*datastore.Key
+	addKeys, addLines = a.batchLines(ctx, ptype, added)
+	removeKeys, removeLines = a.batchLines(ctx, ptype, removed)
+	if a.config.Debug {
+		a.logPrintln("[PersistDelta] called:", len(addKeys), "added,", len(removeKeys), "removed")
+	}
+	if a.stageAll(ctx, removeKeys, removeLines, true) {
+		a.stageAll(ctx, addKeys, addLines, false)
+		return nil
+	}
+
+	if len(addKeys)+len(removeKeys) > maxPutsPerTx {
+		if a.config.BatchAtomic {
+			return fmt.Errorf("%w: %d rules to add and %d to remove, the limit is %d",
+				ErrTooManyMutations, len(addKeys), len(removeKeys), maxPutsPerTx)
+		}
+		if err := a.deleteChunked(ctx, removeKeys, removeLines, nil); err != nil {
+			return err
+		}
+		return a.putChunked(ctx, addKeys, addLines, false, nil)
+	}
+	return a.updateChunk(ctx, removeKeys, addKeys, addLines)
+}
+
+// Dispatcher is a persist.Dispatcher for a casbin.DistributedEnforcer that
+// persists every change with Adapter, once, on the instance the change
+// originates from, then passes it on to Next to apply it to all instances.
+// Next would typically call the *Self methods of every instance's enforcer
+// with a shouldPersist returning false.
+type Dispatcher struct {
+	Adapter *Adapter
+	// Next distributes the changes to all instances. If nil, changes are
+	// only persisted.
+	Next persist.Dispatcher
+}
+
+var _ persist.Dispatcher = (*Dispatcher)(nil)
+
+func (d *Dispatcher) AddPolicies(sec string, ptype string, rules [][]string) error {
+	if err := d.Adapter.AddPolicies(sec, ptype, rules); err != nil || d.Next == nil {
+		return err
+	}
+	return d.Next.AddPolicies(sec, ptype, rules)
+}
+
+func (d *Dispatcher) RemovePolicies(sec string, ptype string, rules [][]string) error {
+	if err := d.Adapter.RemovePolicies(sec, ptype, rules); err != nil || d.Next == nil {
+		return err
+	}
+	return d.Next.RemovePolicies(sec, ptype, rules)
+}
+
+func (d *Dispatcher) RemoveFilteredPolicy(sec string, ptype string, fieldIndex int, fieldValues ...string) error {
+	if err := d.Adapter.RemoveFilteredPolicy(sec, ptype, fieldIndex, fieldValues...); err != nil || d.Next == nil {
+		return err
+	}
+	return d.Next.RemoveFilteredPolicy(sec, ptype, fieldIndex, fieldValues...)
+}
+
+// ClearPolicy deletes every stored rule, like saving an empty policy.
+func (d *Dispatcher) ClearPolicy() error {
+	if err := d.Adapter.SavePolicy(model.Model{}); err != nil || d.Next == nil {
+		return err
+	}
+	return d.Next.ClearPolicy()
+}
+
+func (d *Dispatcher) UpdatePolicy(sec string, ptype string, oldRule, newRule []string) error {
+	if err := d.Adapter.UpdatePolicy(sec, ptype, oldRule, newRule); err != nil || d.Next == nil {
+		return err
+	}
+	return d.Next.UpdatePolicy(sec, ptype, oldRule, newRule)
+}
+
+func (d *Dispatcher) UpdatePolicies(sec string, ptype string, oldRules, newRules [][]string) error {
+	if err := d.Adapter.UpdatePolicies(sec, ptype, oldRules, newRules); err != nil || d.Next == nil {
+		return err
+	}
+	return d.Next.UpdatePolicies(sec, ptype, oldRules, newRules)
+}
+
+func (d *Dispatcher) UpdateFilteredPolicies(sec string, ptype string, oldRules [][]string, newRules [][]string) error {
+	if err := d.Adapter.PersistDelta(context.Background(), sec, ptype, newRules, oldRules); err != nil || d.Next == nil {
+		return err
+	}
+	return d.Next.UpdateFilteredPolicies(sec, ptype, oldRules, newRules)
+}
@@ -0,0 +1,108 @@
+package datastoreadapter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/casbin/casbin/v2"
+)
+
+// selfDispatcher applies changes to a single enforcer, standing in for the
+// transport of a cluster.
+type selfDispatcher struct {
+	e *casbin.DistributedEnforcer
+}
+
+func noPersist() bool { return false }
+
+func (d selfDispatcher) AddPolicies(sec string, ptype string, rules [][]string) error {
+	_, err := d.e.AddPoliciesSelf(noPersist, sec, ptype, rules)
+	return err
+}
+
+func (d selfDispatcher) RemovePolicies(sec string, ptype string, rules [][]string) error {
+	_, err := d.e.RemovePoliciesSelf(noPersist, sec, ptype, rules)
+	return err
+}
+
+func (d selfDispatcher) RemoveFilteredPolicy(sec string, ptype string, fieldIndex int, fieldValues ...string) error {
+	_, err := d.e.RemoveFilteredPolicySelf(noPersist, sec, ptype, fieldIndex, fieldValues...)
+	return err
+}
+
+func (d selfDispatcher) ClearPolicy() error {
+	return d.e.ClearPolicySelf(noPersist)
+}
+
+func (d selfDispatcher) UpdatePolicy(sec string, ptype string, oldRule, newRule []string) error {
+	_, err := d.e.UpdatePolicySelf(noPersist, sec, ptype, oldRule, newRule)
+	return err
+}
+
+func (d selfDispatcher) UpdatePolicies(sec string, ptype string, oldRules, newRules [][]string) error {
+	_, err := d.e.UpdatePoliciesSelf(noPersist, sec, ptype, oldRules, newRules)
+	return err
+}
+
+func (d selfDispatcher) UpdateFilteredPolicies(sec string, ptype string, oldRules [][]string, newRules [][]string) error {
+	_, err := d.e.UpdateFilteredPoliciesSelf(noPersist, sec, ptype, newRules, 0)
+	return err
+}
+
+func TestDispatcher(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+	defer initPolicy(t, config)
+
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	e, _ := casbin.NewDistributedEnforcer("examples/rbac_model.conf", a)
+	e.SetDispatcher(&Dispatcher{Adapter: a, Next: selfDispatcher{e}})
+	e.EnableAutoNotifyDispatcher(true)
+
+	e.AddPolicy("carol", "data3", "read")
+	e.RemovePolicy("bob", "data2", "write")
+	e.UpdatePolicy([]string{"alice", "data1", "read"}, []string{"alice", "data1", "write"})
+
+	want := [][]string{{"alice", "data1", "write"}, {"carol", "data3", "read"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}}
+	testGetPolicy(e.Enforcer, want, func(actual, wants [][]string) {
+		t.Error("in memory got: ", actual, ", wants ", wants)
+	})
+	if err := e.LoadPolicy(); err != nil {
+		t.Fatalf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(e.Enforcer, want, func(actual, wants [][]string) {
+		t.Error("stored got: ", actual, ", wants ", wants)
+	})
+}
+
+func TestPersistDelta(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+	defer initPolicy(t, config)
+
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	err := a.PersistDelta(context.Background(), "p", "p",
+		[][]string{{"carol", "data3", "read"}, {"alice", "data1", "read"}},
+		[][]string{{"bob", "data2", "write"}, {"alice", "data1", "read"}})
+	if err != nil {
+		t.Fatalf("Expected PersistDelta() to be successful; got %v", err)
+	}
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	testGetPolicy(e, [][]string{{"alice", "data1", "read"}, {"carol", "data3", "read"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}}, func(actual, wants [][]string) {
+		t.Error("got: ", actual, ", wants ", wants)
+	})
+}
+
+func TestPersistDeltaAtomic(t *testing.T) {
+	a := &Adapter{config: withDefaults(Config{BatchAtomic: true})}
+	var rules [][]string
+	for i := 0; i < maxPutsPerTx; i++ {
+		rules = append(rules, []string{"user" + fmt.Sprint(i), "data1", "read"})
+	}
+	err := a.PersistDelta(context.Background(), "p", "p", rules, [][]string{{"alice", "data1", "read"}})
+	if !errors.Is(err, ErrTooManyMutations) {
+		t.Errorf("got %v, wants %v", err, ErrTooManyMutations)
+	}
+}
@@ -0,0 +1,188 @@
+package datastoreadapter
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Errors returned by the adapter, possibly wrapped with more detail; test
+// for them with errors.Is.
+var (
+	// ErrReadOnly is returned by every write of an adapter configured with
+	// Config.ReadOnly.
+	ErrReadOnly = errors.New("datastoreadapter: adapter is read-only")
+	// ErrFiltered is returned by SavePolicy after a partial load, like
+	// LoadSectionPolicy or LoadPolicyByField, as saving the partially loaded
+	// model would delete the rules left out. LoadPolicy resets the state.
+	ErrFiltered = errors.New("datastoreadapter: cannot save a filtered policy")
+	// ErrKeyTooLong is returned when a rule's key name exceeds the 1500
+	// bytes Datastore allows.
+	ErrKeyTooLong = errors.New("datastoreadapter: key name too long")
+	// ErrInvalidFieldIndex is returned for a field index outside [0, 5].
+	ErrInvalidFieldIndex = errors.New("datastoreadapter: field index out of range [0, 5]")
+	// ErrEmptyPType is returned when writing a rule with an empty ptype.
+	ErrEmptyPType = errors.New("datastoreadapter: ptype must not be empty")
+	// ErrInvalidSection is returned for an empty section name.
+	ErrInvalidSection = errors.New("datastoreadapter: section must not be empty")
+	// ErrAlreadyStaging is returned by Begin while staging is active.
+	ErrAlreadyStaging = errors.New("datastoreadapter: Begin called while already staging")
+	// ErrNotStaging is returned by Commit without a preceding Begin.
+	ErrNotStaging = errors.New("datastoreadapter: Commit called without Begin")
+	// ErrTooManyMutations is returned when a single transaction would exceed
+	// Datastore's limit of 500 mutations.
+	ErrTooManyMutations = errors.New("datastoreadapter: too many mutations for one transaction")
+	// ErrMissingIndex is returned by VerifyIndexes if a query needs a
+	// composite index that doesn't exist.
+	ErrMissingIndex = errors.New("datastoreadapter: missing index")
+	// ErrAlreadyExists is the failure of a rule that is already stored, with
+	// Config.InsertOnly.
+	ErrAlreadyExists = errors.New("datastoreadapter: rule already exists")
+	// ErrBroadDelete is returned by filtered deletes that would remove every
+	// rule of a ptype, with Config.GuardBroadDeletes.
+	ErrBroadDelete = errors.New("datastoreadapter: filter matches every rule")
+	// ErrChecksumMismatch is returned by loads finding a rule whose fields
+	// don't match its checksum, with Config.ChecksumAction ChecksumError.
+	ErrChecksumMismatch = errors.New("datastoreadapter: rule checksum mismatch")
+	// ErrEntityTooLarge is the failure of a rule whose entity would exceed
+	// Config.MaxEntitySize.
+	ErrEntityTooLarge = errors.New("datastoreadapter: entity too large")
+	// ErrDuplicateRule is returned by saves of rules mapping to the same key,
+	// with Config.DuplicateAction DuplicateError.
+	ErrDuplicateRule = errors.New("datastoreadapter: duplicate rule")
+	// ErrNoSnapshot is returned by RestoreSnapshot if no snapshot was taken
+	// at or before the requested time.
+	ErrNoSnapshot = errors.New("datastoreadapter: no snapshot")
+	// ErrRuleNotFound is returned by UpdateField if the rule to update isn't
+	// stored.
+	ErrRuleNotFound = errors.New("datastoreadapter: rule not found")
+	// ErrUndefinedPType is the reason a load skipped a rule of a ptype the
+	// model doesn't define, see LoadReport.
+	ErrUndefinedPType = errors.New("datastoreadapter: ptype not defined by the model")
+	// ErrPartiallyApplied matches a *PartialError.
+	ErrPartiallyApplied = errors.New("datastoreadapter: write partially applied")
+)
+
+// RuleError is the failure of a single rule within a batch operation.
+type RuleError struct {
+	Rule *CasbinRule
+	Err  error
+}
+
+func (e RuleError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Rule, e.Err)
+}
+
+func (e RuleError) Unwrap() error {
+	return e.Err
+}
+
+// RulesError is returned when Datastore rejected some of the rules of a
+// batch operation. Rules not listed in Failed didn't fail by themselves,
+// though within a transaction none of the batch was applied.
+type RulesError struct {
+	Failed []RuleError
+	// Total is the number of rules in the batch.
+	Total int
+}
+
+func (e *RulesError) Error() string {
+	msgs := make([]string, len(e.Failed))
+	for i, f := range e.Failed {
+		msgs[i] = f.Error()
+	}
+	return fmt.Sprintf("datastoreadapter: %d of %d rules failed: %s",
+		len(e.Failed), e.Total, strings.Join(msgs, "; "))
+}
+
+// Is reports whether any of the failed rules failed with target, so that
+// errors.Is(err, ErrAlreadyExists) works for batches.
+func (e *RulesError) Is(target error) bool {
+	for _, f := range e.Failed {
+		if errors.Is(f.Err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// PartialError is returned by a write split into several transactions,
+// like a large SavePolicy, that stopped after committing some of them, e.g.
+// because its context was cancelled. Every committed transaction was
+// applied in full. Repeating the write completes it.
+type PartialError struct {
+	// Done is the number of mutations applied, of Total.
+	Done, Total int
+	Err         error
+}
+
+func (e *PartialError) Error() string {
+	return fmt.Sprintf("datastoreadapter: write partially applied, %d of %d mutations: %v", e.Done, e.Total, e.Err)
+}
+
+func (e *PartialError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is ErrPartiallyApplied.
+func (e *PartialError) Is(target error) bool {
+	return target == ErrPartiallyApplied
+}
+
+// alreadyExists returns the error of inserting lines, of which those found
+// are already stored: a RuleError for a single rule, else a *RulesError.
+func alreadyExists(found []bool, lines []*CasbinRule) error {
+	rerr := &RulesError{Total: len(lines)}
+	for i, ok := range found {
+		if ok {
+			rerr.Failed = append(rerr.Failed, RuleError{Rule: lines[i], Err: ErrAlreadyExists})
+		}
+	}
+	switch {
+	case len(rerr.Failed) == 0:
+		return nil
+	case len(lines) == 1:
+		return rerr.Failed[0]
+	}
+	return rerr
+}
+
+// insertConflict maps the error of a commit that failed because a rule was
+// inserted concurrently to ErrAlreadyExists. Other errors are returned
+// unchanged.
+func insertConflict(err error, lines []*CasbinRule) error {
+	if status.Code(err) != codes.AlreadyExists {
+		return err
+	}
+	if len(lines) == 1 {
+		return RuleError{Rule: lines[0], Err: ErrAlreadyExists}
+	}
+	return fmt.Errorf("%w: %v", ErrAlreadyExists, err)
+}
+
+// rulesError maps a datastore.MultiError returned for a batch of rules back
+// to the failed rules. Other errors are returned unchanged.
+func rulesError(err error, rules []*CasbinRule) error {
+	multi, ok := err.(datastore.MultiError)
+	if !ok || len(multi) != len(rules) {
+		return err
+	}
+
+	rerr := &RulesError{Total: len(rules)}
+	for i, e := range multi {
+		if e != nil {
+			rerr.Failed = append(rerr.Failed, RuleError{Rule: rules[i], Err: e})
+		}
+	}
+	return rerr
+}
+
+// isMissingIndex reports whether err is the failure of a query needing a
+// composite index that doesn't exist or is still building.
+func isMissingIndex(err error) bool {
+	return status.Code(err) == codes.FailedPrecondition
+}
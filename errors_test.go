@@ -0,0 +1,112 @@
+package datastoreadapter
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestRulesError(t *testing.T) {
+	rules := []*CasbinRule{
+		{PType: "p", V0: "alice", V1: "data1", V2: "read"},
+		{PType: "p", V0: "bob", V1: "data2", V2: "write"},
+	}
+	failure := errors.New("entity too big")
+
+	err := rulesError(datastore.MultiError{nil, failure}, rules)
+	rerr, ok := err.(*RulesError)
+	if !ok {
+		t.Fatalf("got %T, wants *RulesError", err)
+	}
+	if rerr.Total != 2 || len(rerr.Failed) != 1 {
+		t.Fatalf("got %d of %d failed, wants 1 of 2", len(rerr.Failed), rerr.Total)
+	}
+	if f := rerr.Failed[0]; f.Rule != rules[1] || f.Err != failure {
+		t.Errorf("got %v, wants %v: %v", f, rules[1], failure)
+	}
+
+	// Other errors pass through.
+	if err := rulesError(failure, rules); err != failure {
+		t.Errorf("got %v, wants %v", err, failure)
+	}
+	if err := rulesError(nil, rules); err != nil {
+		t.Errorf("got %v, wants nil", err)
+	}
+}
+
+func TestSentinelErrors(t *testing.T) {
+	ctx := context.Background()
+
+	a := &Adapter{config: withDefaults(Config{ReadOnly: true})}
+	if err := a.AddPolicy("p", "p", []string{"alice", "data1", "read"}); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("got %v, wants %v", err, ErrReadOnly)
+	}
+	if err := a.RemoveFilteredPolicy("p", "p", 0, "alice"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("got %v, wants %v", err, ErrReadOnly)
+	}
+
+	a = &Adapter{config: withDefaults(Config{}), filtered: true}
+	if err := a.SavePolicy(nil); !errors.Is(err, ErrFiltered) {
+		t.Errorf("got %v, wants %v", err, ErrFiltered)
+	}
+	if err := a.AddPolicy("p", "p", []string{strings.Repeat("x", maxKeyNameLen)}); !errors.Is(err, ErrKeyTooLong) {
+		t.Errorf("got %v, wants %v", err, ErrKeyTooLong)
+	}
+	if err := a.AddPolicy("p", "", []string{"alice", "data1", "read"}); !errors.Is(err, ErrEmptyPType) {
+		t.Errorf("got %v, wants %v", err, ErrEmptyPType)
+	}
+	if err := a.LoadPolicyByField(ctx, "p", 6, "x", nil); !errors.Is(err, ErrInvalidFieldIndex) {
+		t.Errorf("got %v, wants %v", err, ErrInvalidFieldIndex)
+	}
+	if err := a.LoadSectionPolicy(ctx, nil, ""); !errors.Is(err, ErrInvalidSection) {
+		t.Errorf("got %v, wants %v", err, ErrInvalidSection)
+	}
+	if err := a.Commit(); !errors.Is(err, ErrNotStaging) {
+		t.Errorf("got %v, wants %v", err, ErrNotStaging)
+	}
+}
+
+func TestPartialError(t *testing.T) {
+	if err := partial(nil, 3, 5); err != nil {
+		t.Errorf("got %v, wants nil", err)
+	}
+	if err := partial(context.Canceled, 0, 5); err != context.Canceled {
+		t.Errorf("got %v, wants %v unwrapped when nothing was applied", err, context.Canceled)
+	}
+	err := partial(context.Canceled, 3, 5)
+	if !errors.Is(err, ErrPartiallyApplied) || !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, wants it to match %v and %v", err, ErrPartiallyApplied, context.Canceled)
+	}
+	if !strings.Contains(err.Error(), "3 of 5") {
+		t.Errorf("got %q, wants the number of applied mutations", err)
+	}
+}
+
+func TestAlreadyExists(t *testing.T) {
+	rules := []*CasbinRule{
+		{PType: "p", V0: "alice", V1: "data1", V2: "read"},
+		{PType: "p", V0: "bob", V1: "data2", V2: "write"},
+	}
+
+	if err := alreadyExists([]bool{false, false}, rules); err != nil {
+		t.Errorf("got %v, wants nil", err)
+	}
+
+	err := alreadyExists([]bool{false, true}, rules)
+	var rerr *RulesError
+	if !errors.Is(err, ErrAlreadyExists) || !errors.As(err, &rerr) {
+		t.Fatalf("got %v, wants a *RulesError matching ErrAlreadyExists", err)
+	}
+	if len(rerr.Failed) != 1 || rerr.Failed[0].Rule != rules[1] {
+		t.Errorf("got %v, wants %v to fail", rerr.Failed, rules[1])
+	}
+
+	err = alreadyExists([]bool{true}, rules[:1])
+	var ruleErr RuleError
+	if !errors.Is(err, ErrAlreadyExists) || !errors.As(err, &ruleErr) || ruleErr.Rule != rules[0] {
+		t.Errorf("got %v, wants a RuleError for %v matching ErrAlreadyExists", err, rules[0])
+	}
+}
@@ -0,0 +1,106 @@
+package datastoreadapter
+
+import (
+	"context"
+	"fmt"
+)
+
+// defaultPublishBatchSize is the default of Config.PublishBatchSize, the
+// maximum number of messages of a Cloud Pub/Sub publish request.
+const defaultPublishBatchSize = 1000
+
+// PolicyEvent describes a change of the stored policy, see Config.Publisher.
+// Events are meant to be published as JSON, one message per event.
+type PolicyEvent struct {
+	// Op is the name of the method that made the change, like Mutation.Op.
+	// Writes staged by Begin are published by Commit as "AddPolicy" and
+	// "RemovePolicy" events, and so are the rules changed by SavePolicy,
+	// SavePolicyForPType, ReplacePolicy, SaveModelAndPolicy and
+	// PersistDelta.
+	Op        string `json:"op"`
+	Namespace string `json:"namespace,omitempty"`
+	PType     string `json:"ptype,omitempty"`
+	// Rule is the rule added or removed; for updates, the new rule. Empty
+	// for filtered removes, whose Filter is set instead, and for
+	// DeletePType, ImportFromReader, Compact, Reindex and RestoreSnapshot.
+	Rule []string `json:"rule,omitempty"`
+	// OldRule is the rule replaced by an update.
+	OldRule []string    `json:"old_rule,omitempty"`
+	Filter  *FilterSpec `json:"filter,omitempty"`
+}
+
+// Publisher publishes policy events, e.g. to a Cloud Pub/Sub topic, so that
+// other services can invalidate their caches. An implementation for a topic
+// marshals every event with encoding/json, publishes the messages and waits
+// for their results.
+type Publisher interface {
+	Publish(ctx context.Context, events []PolicyEvent) error
+}
+
+// PublisherFunc adapts a function to a Publisher.
+type PublisherFunc func(ctx context.Context, events []PolicyEvent) error
+
+// Publish calls f(ctx, events).
+func (f PublisherFunc) Publish(ctx context.Context, events []PolicyEvent) error {
+	return f(ctx, events)
+}
+
+// mutationEvents returns the events describing m, written in namespace.
+func mutationEvents(m Mutation, namespace string) []PolicyEvent {
+	if len(m.Rules) == 0 {
+		return []PolicyEvent{{Op: m.Op, Namespace: namespace, PType: m.PType, Filter: m.Filter}}
+	}
+	events := make([]PolicyEvent, len(m.Rules))
+	for i, rule := range m.Rules {
+		events[i] = PolicyEvent{Op: m.Op, Namespace: namespace, PType: m.PType, Rule: rule}
+		if len(m.OldRules) == len(m.Rules) {
+			events[i].OldRule = m.OldRules[i]
+		}
+	}
+	return events
+}
+
+// changeEvents returns a "RemovePolicy" event for each of removed and an
+// "AddPolicy" event for each of added, the rules a write changed, like
+// Commit publishes the staged writes.
+func (a *Adapter) changeEvents(ctx context.Context, removed, added []*CasbinRule) []PolicyEvent {
+	events := make([]PolicyEvent, 0, len(removed)+len(added))
+	for _, op := range []string{"RemovePolicy", "AddPolicy"} {
+		lines := removed
+		if op == "AddPolicy" {
+			lines = added
+		}
+		for _, line := range lines {
+			events = append(events, PolicyEvent{
+				Op:        op,
+				Namespace: a.namespace(a.ptypeContext(ctx, line.PType)),
+				PType:     line.PType,
+				Rule:      trimTrailingEmpty(line.fields()[1:]),
+			})
+		}
+	}
+	return events
+}
+
+// publish publishes events with Config.Publisher, if set, in batches of
+// Config.PublishBatchSize. Failures are logged and only returned with
+// Config.FailOnPublishError.
+func (a *Adapter) publish(ctx context.Context, events []PolicyEvent) error {
+	if a.config.Publisher == nil || len(events) == 0 {
+		return nil
+	}
+	for start := 0; start < len(events); start += a.config.PublishBatchSize {
+		end := start + a.config.PublishBatchSize
+		if end > len(events) {
+			end = len(events)
+		}
+		if err := a.config.Publisher.Publish(ctx, events[start:end]); err != nil {
+			a.logPrintln("[Publish] failed to publish", len(events)-start, "policy events:", err)
+			if a.config.FailOnPublishError {
+				return fmt.Errorf("datastoreadapter: policy changed, but not published: %w", err)
+			}
+			return nil
+		}
+	}
+	return nil
+}
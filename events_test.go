@@ -0,0 +1,164 @@
+package datastoreadapter
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/casbin/casbin/v2/model"
+)
+
+func TestPublish(t *testing.T) {
+	var batches [][]PolicyEvent
+	publisher := PublisherFunc(func(ctx context.Context, events []PolicyEvent) error {
+		batches = append(batches, events)
+		return nil
+	})
+	a := &Adapter{config: withDefaults(Config{Namespace: "unittest", Publisher: publisher, PublishBatchSize: 2})}
+	ctx := context.Background()
+
+	var err error
+	m := Mutation{Op: "AddPolicies", PType: "p", Rules: [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"carol", "data3", "read"}}}
+	a.afterMutate(ctx, m, &err)
+	if err != nil {
+		t.Fatalf("Expected publishing to be successful; got %v", err)
+	}
+	if len(batches) != 2 || len(batches[0]) != 2 || len(batches[1]) != 1 {
+		t.Fatalf("got batches %v, wants 2 and 1 events", batches)
+	}
+	wants := PolicyEvent{Op: "AddPolicies", Namespace: "unittest", PType: "p", Rule: []string{"carol", "data3", "read"}}
+	if !reflect.DeepEqual(batches[1][0], wants) {
+		t.Errorf("got %+v, wants %+v", batches[1][0], wants)
+	}
+
+	batches = nil
+	m = Mutation{Op: "UpdatePolicy", PType: "p", Rules: [][]string{{"alice", "data1", "write"}}, OldRules: [][]string{{"alice", "data1", "read"}}}
+	a.afterMutate(ctx, m, &err)
+	if len(batches) != 1 || batches[0][0].OldRule[2] != "read" {
+		t.Errorf("got %v, wants the old rule of the update", batches)
+	}
+
+	// Failed and staged writes aren't published.
+	batches = nil
+	failed := errors.New("failed")
+	a.afterMutate(ctx, m, &failed)
+	a.Begin()
+	a.afterMutate(ctx, m, &err)
+	a.Rollback()
+	if len(batches) != 0 {
+		t.Errorf("got %v, wants nothing published", batches)
+	}
+}
+
+func TestPublishError(t *testing.T) {
+	failure := errors.New("topic not found")
+	publisher := PublisherFunc(func(ctx context.Context, events []PolicyEvent) error {
+		return failure
+	})
+	a := &Adapter{config: withDefaults(Config{Publisher: publisher})}
+	m := Mutation{Op: "RemoveFilteredPolicy", PType: "p", Filter: &FilterSpec{FieldIndex: 0, FieldValues: []string{"alice"}}}
+
+	var err error
+	a.afterMutate(context.Background(), m, &err)
+	if err != nil {
+		t.Errorf("got %v, wants publishing failures only logged", err)
+	}
+
+	a.config.FailOnPublishError = true
+	a.afterMutate(context.Background(), m, &err)
+	if !errors.Is(err, failure) {
+		t.Errorf("got %v, wants %v", err, failure)
+	}
+}
+
+func TestChangeEvents(t *testing.T) {
+	a := &Adapter{config: withDefaults(Config{Namespace: "unittest", PTypeNamespaces: map[string]string{"g": "roles"}})}
+	removed := []*CasbinRule{{PType: "p", V0: "bob", V1: "data2", V2: "write"}}
+	added := []*CasbinRule{{PType: "g", V0: "alice", V1: "admin"}}
+
+	events := a.changeEvents(context.Background(), removed, added)
+	wants := []PolicyEvent{
+		{Op: "RemovePolicy", Namespace: "unittest", PType: "p", Rule: []string{"bob", "data2", "write"}},
+		{Op: "AddPolicy", Namespace: "roles", PType: "g", Rule: []string{"alice", "admin"}},
+	}
+	if !reflect.DeepEqual(events, wants) {
+		t.Errorf("got %+v, wants %+v", events, wants)
+	}
+}
+
+func TestPublishSaveDiff(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+
+	var events []PolicyEvent
+	config.Publisher = PublisherFunc(func(ctx context.Context, batch []PolicyEvent) error {
+		events = append(events, batch...)
+		return nil
+	})
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	m, err := model.NewModelFromFile("examples/rbac_model.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.LoadPolicy(m); err != nil {
+		t.Fatalf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	m.RemovePolicy("p", "p", []string{"bob", "data2", "write"})
+	m.AddPolicy("p", "p", []string{"zoe", "data1", "read"})
+
+	if err := a.SavePolicy(m); err != nil {
+		t.Fatalf("Expected SavePolicy() to be successful; got %v", err)
+	}
+	wants := []PolicyEvent{
+		{Op: "RemovePolicy", Namespace: "unittest", PType: "p", Rule: []string{"bob", "data2", "write"}},
+		{Op: "AddPolicy", Namespace: "unittest", PType: "p", Rule: []string{"zoe", "data1", "read"}},
+	}
+	if !reflect.DeepEqual(events, wants) {
+		t.Errorf("got %+v, wants only the changed rules %+v", events, wants)
+	}
+}
+
+func TestPublishPartialSave(t *testing.T) {
+	var events []PolicyEvent
+	a := &Adapter{config: withDefaults(Config{Publisher: PublisherFunc(func(ctx context.Context, batch []PolicyEvent) error {
+		events = append(events, batch...)
+		return nil
+	})})}
+	ctx := context.Background()
+	line := func(fields ...string) *CasbinRule {
+		rule := savePolicyLine("p", fields)
+		return &rule
+	}
+	key := func(rule *CasbinRule) *datastore.Key {
+		return a.ruleKey(ctx, rule)
+	}
+	removed, added, overwriting := line("bob", "data2", "write"), line("zoe", "data1", "read"), line("alice", "data1", "read")
+	d := saveDiff{
+		deleteKeys:      []*datastore.Key{key(removed)},
+		deleted:         []*CasbinRule{removed},
+		overwrittenKeys: []*datastore.Key{key(overwriting)},
+		overwritten:     []*CasbinRule{line("alice", "data1", "read", "old")},
+		putKeys:         []*datastore.Key{key(added), key(overwriting)},
+		putLines:        []*CasbinRule{added, overwriting},
+	}
+
+	// The delete and the first put were committed before the failure.
+	applied := d.prefix(1, 1)
+	if applied.result.Added != 1 || applied.result.Deleted != 1 || len(applied.overwritten) != 0 {
+		t.Errorf("got %+v, wants one rule added and one deleted", applied.result)
+	}
+	var err error = &PartialError{Done: 2, Total: 3, Err: errors.New("deadline exceeded")}
+	a.afterMutations(ctx, []Mutation{{Op: "SavePolicy", PType: "p"}}, func() []PolicyEvent { return a.diffEvents(ctx, applied) }, &err)
+	wants := []PolicyEvent{
+		{Op: "RemovePolicy", PType: "p", Rule: []string{"bob", "data2", "write"}},
+		{Op: "AddPolicy", PType: "p", Rule: []string{"zoe", "data1", "read"}},
+	}
+	if !reflect.DeepEqual(events, wants) {
+		t.Errorf("got %+v, wants the applied rules %+v", events, wants)
+	}
+	if !errors.Is(err, ErrPartiallyApplied) {
+		t.Errorf("got %v, wants %v", err, ErrPartiallyApplied)
+	}
+}
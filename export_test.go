@@ -0,0 +1,105 @@
+package datastoreadapter
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/casbin/casbin/v2"
+	"github.com/casbin/casbin/v2/model"
+)
+
+func TestExportToWriter(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	var buf bytes.Buffer
+	if err := a.ExportToWriter(context.Background(), &buf); err != nil {
+		t.Fatalf("Expected ExportToWriter() to be successful; got %v", err)
+	}
+
+	var p, g [][]string
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var rule exportedRule
+		if err := json.Unmarshal(scanner.Bytes(), &rule); err != nil {
+			t.Fatalf("got invalid line %q: %v", scanner.Text(), err)
+		}
+		switch rule.PType {
+		case "p":
+			p = append(p, rule.Rule)
+		case "g":
+			g = append(g, rule.Rule)
+		}
+	}
+	if wants := [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}}; !SamePolicy(p, wants) {
+		t.Errorf("got p rules %v, wants %v", p, wants)
+	}
+	if wants := [][]string{{"alice", "data2_admin"}}; !SamePolicy(g, wants) {
+		t.Errorf("got g rules %v, wants %v", g, wants)
+	}
+}
+
+func TestImportFromReader(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+
+	var buf bytes.Buffer
+	if err := NewAdapterWithConfig(getDatastore(t), config).ExportToWriter(context.Background(), &buf); err != nil {
+		t.Fatalf("Expected ExportToWriter() to be successful; got %v", err)
+	}
+
+	restored := Config{Kind: "casbin_test", Namespace: "unittest_import"}
+	a := NewAdapterWithConfig(getDatastore(t), restored)
+	if err := a.SavePolicy(model.Model{}); err != nil {
+		t.Fatalf("Expected SavePolicy() to be successful; got %v", err)
+	}
+	n, err := a.ImportFromReader(context.Background(), &buf)
+	if err != nil {
+		t.Fatalf("Expected ImportFromReader() to be successful; got %v", err)
+	}
+	if n != 5 {
+		t.Errorf("got %d rules imported, wants 5", n)
+	}
+
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	testGetPolicy(e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}}, func(actual, wants [][]string) {
+		t.Error("got: ", actual, ", wants ", wants)
+	})
+}
+
+func TestImportFromReaderDuplicates(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+
+	// The first rule is repeated in the second chunk.
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for i := 0; i < 600; i++ {
+		enc.Encode(exportedRule{PType: "p", Rule: []string{fmt.Sprintf("user%d", i%550), "data1", "read"}})
+	}
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	n, err := a.ImportFromReader(context.Background(), &buf)
+	if err != nil {
+		t.Fatalf("Expected ImportFromReader() to be successful; got %v", err)
+	}
+	if n != 550 {
+		t.Errorf("got %d rules imported, wants 550", n)
+	}
+}
+
+func TestImportFromReaderInvalid(t *testing.T) {
+	a := &Adapter{config: withDefaults(Config{})}
+	if _, err := a.ImportFromReader(context.Background(), strings.NewReader(`{"ptype": "p", "rule": [`)); err == nil {
+		t.Error("Expected malformed JSON to fail")
+	}
+	if _, err := a.ImportFromReader(context.Background(), strings.NewReader(`{"rule": ["alice"]}`)); !errors.Is(err, ErrEmptyPType) {
+		t.Errorf("got %v, wants %v", err, ErrEmptyPType)
+	}
+}
@@ -4,5 +4,9 @@ go 1.14
 
 require (
 	cloud.google.com/go/datastore v1.6.0
-	github.com/casbin/casbin/v2 v2.41.1
+	github.com/casbin/casbin/v2 v2.105.0
+	google.golang.org/api v0.54.0
+	google.golang.org/genproto v0.0.0-20210821163610-241b8fcbd6c8
+	google.golang.org/grpc v1.40.0
+	google.golang.org/protobuf v1.27.1
 )
@@ -0,0 +1,71 @@
+package datastoreadapter
+
+import (
+	"context"
+	"errors"
+)
+
+// Mutation describes a write, see Config.BeforeMutate and Config.AfterMutate.
+type Mutation struct {
+	// Op is the name of the method, without a Ctx suffix, e.g.
+	// "AddPolicies".
+	Op    string
+	PType string
+	// Rules are the rules added, removed or saved, depending on Op; for
+	// updates, the new rules. Nil for RemoveFilteredPolicy,
+	// RemoveFilteredPolicies and DeletePType, whose rules aren't known
+	// before the write, and for ImportFromReader, Compact and Reindex.
+	Rules [][]string
+	// OldRules are the rules replaced by UpdatePolicy, UpdatePolicies and
+	// UpdateField, and the rules removed by PersistDelta.
+	OldRules [][]string
+	// Filter is the filter of RemoveFilteredPolicy, UpdateFilteredPolicies
+	// and RenameSubject, and one of the filters of RemoveFilteredPolicies.
+	Filter *FilterSpec
+}
+
+// beforeMutate calls Config.BeforeMutate, if set.
+func (a *Adapter) beforeMutate(ctx context.Context, m Mutation) error {
+	if a.config.BeforeMutate == nil {
+		return nil
+	}
+	return a.config.BeforeMutate(ctx, m)
+}
+
+// afterMutate drops the cache of the namespace of ctx, publishes the events
+// of a successful, not staged write, see Config.Publisher, and calls
+// Config.AfterMutate, if set, with the error *err of the write. Call it
+// deferred.
+func (a *Adapter) afterMutate(ctx context.Context, m Mutation, err *error) {
+	a.afterMutations(ctx, []Mutation{m}, nil, err)
+}
+
+// afterMutations is afterMutate for a write described by ms, e.g. one per
+// filter. If events isn't nil, the events it returns are published instead
+// of those describing ms, for writes that know the rules they changed, see
+// changeEvents; they are also published if the write failed with a
+// *PartialError, as the rules it applied. Call it deferred.
+func (a *Adapter) afterMutations(ctx context.Context, ms []Mutation, events func() []PolicyEvent, err *error) {
+	a.InvalidateCache(ctx)
+	var partialErr *PartialError
+	applied := *err == nil || events != nil && errors.As(*err, &partialErr)
+	if applied && a.config.Publisher != nil && !a.isStaging() {
+		if events == nil {
+			events = func() []PolicyEvent {
+				var all []PolicyEvent
+				for _, m := range ms {
+					all = append(all, mutationEvents(m, a.namespace(a.ptypeContext(ctx, m.PType)))...)
+				}
+				return all
+			}
+		}
+		if publishErr := a.publish(ctx, events()); *err == nil {
+			*err = publishErr
+		}
+	}
+	if a.config.AfterMutate != nil {
+		for _, m := range ms {
+			a.config.AfterMutate(ctx, m, *err)
+		}
+	}
+}
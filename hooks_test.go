@@ -0,0 +1,91 @@
+package datastoreadapter
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMutationHooks(t *testing.T) {
+	errDeny := errors.New("deny rules need 4 fields")
+	var before, after []Mutation
+	a := &Adapter{config: withDefaults(Config{
+		BeforeMutate: func(ctx context.Context, m Mutation) error {
+			before = append(before, m)
+			for _, rule := range m.Rules {
+				if len(rule) > 0 && rule[len(rule)-1] == "deny" && len(rule) != 4 {
+					return errDeny
+				}
+			}
+			return nil
+		},
+		AfterMutate: func(ctx context.Context, m Mutation, err error) {
+			after = append(after, m)
+		},
+	})}
+	// Staging keeps the writes off Datastore.
+	if err := a.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	defer a.Rollback()
+
+	if err := a.AddPolicies("p", "p", [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}}); err != nil {
+		t.Fatalf("Expected AddPolicies() to be successful; got %v", err)
+	}
+	if err := a.AddPolicy("p", "p", []string{"bob", "data1", "deny"}); !errors.Is(err, errDeny) {
+		t.Errorf("got %v, wants %v", err, errDeny)
+	}
+	if err := a.UpdatePolicy("p", "p", []string{"alice", "data1", "read"}, []string{"alice", "data1", "write"}); err != nil {
+		t.Fatalf("Expected UpdatePolicy() to be successful; got %v", err)
+	}
+
+	if len(before) != 3 || before[0].Op != "AddPolicies" || before[1].Op != "AddPolicy" || before[2].Op != "UpdatePolicy" {
+		t.Errorf("got %+v before, wants AddPolicies, AddPolicy and UpdatePolicy", before)
+	}
+	if len(after) != 2 || after[0].Op != "AddPolicies" || after[1].Op != "UpdatePolicy" {
+		t.Errorf("got %+v after, wants only the accepted writes", after)
+	}
+	if m := before[2]; m.PType != "p" || !SamePolicy(m.OldRules, [][]string{{"alice", "data1", "read"}}) ||
+		!SamePolicy(m.Rules, [][]string{{"alice", "data1", "write"}}) {
+		t.Errorf("got %+v, wants the old and new rules", m)
+	}
+	if n := len(a.staged.order); n != 3 {
+		t.Errorf("got %d staged mutations, wants 3 without the rejected rule", n)
+	}
+}
+
+func TestMutationHooksEveryWrite(t *testing.T) {
+	errDeny := errors.New("maintenance window")
+	var ops []string
+	a := &Adapter{config: withDefaults(Config{
+		BeforeMutate: func(ctx context.Context, m Mutation) error {
+			ops = append(ops, m.Op)
+			return errDeny
+		},
+	})}
+	ctx := context.Background()
+
+	// The hook rejects every write before it reaches Datastore.
+	writes := []func() error{
+		func() error {
+			return a.RemoveFilteredPoliciesCtx(ctx, "p", "p", []FilterSpec{{FieldIndex: 0, FieldValues: []string{"alice"}}})
+		},
+		func() error { return a.PersistDelta(ctx, "p", "p", [][]string{{"alice", "data1", "read"}}, nil) },
+		func() error { return a.DeleteByKeyName(ctx, "p,bob,data2,write") },
+		func() error { _, err := a.ImportFromReader(ctx, strings.NewReader("")); return err },
+		func() error { _, err := a.Compact(ctx); return err },
+		func() error { _, err := a.Reindex(ctx); return err },
+		func() error { _, err := a.DeletePType(ctx, "p"); return err },
+	}
+	for _, write := range writes {
+		if err := write(); !errors.Is(err, errDeny) {
+			t.Errorf("got %v, wants %v", err, errDeny)
+		}
+	}
+	wants := []string{"RemoveFilteredPolicies", "PersistDelta", "DeleteByKeyName", "ImportFromReader", "Compact", "Reindex", "DeletePType"}
+	if !reflect.DeepEqual(ops, wants) {
+		t.Errorf("got %v, wants %v", ops, wants)
+	}
+}
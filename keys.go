@@ -0,0 +1,133 @@
+package datastoreadapter
+
+import (
+	"context"
+	"hash/fnv"
+
+	"cloud.google.com/go/datastore"
+)
+
+// KeyStrategy decides the entity group, i.e. the ancestor, of rule entities.
+// Datastore serializes writes within an entity group and reads it strongly
+// consistently, so the choice trades consistency for write throughput.
+type KeyStrategy interface {
+	// Ancestor returns the parent of the key storing rule, or nil to store
+	// it without one. root is the adapter's pseudo root key in the
+	// namespace of the operation.
+	Ancestor(root *datastore.Key, rule *CasbinRule) *datastore.Key
+	// Ancestors returns every parent Ancestor may return for root, which
+	// queries read one after the other. A nil entry queries without an
+	// ancestor filter, i.e. with eventual consistency.
+	Ancestors(root *datastore.Key) []*datastore.Key
+}
+
+// SingleAncestor stores all rules of a namespace in one entity group under
+// the pseudo root key. Reads are strongly consistent, but the group's write
+// rate is limited. This is the default. The pseudo root key lives in the
+// namespace of the operation, so tenants kept apart by Config.NamespaceFunc
+// or ContextWithNamespace each get their own entity group: consistent per
+// tenant, with writes of different tenants not limiting each other.
+type SingleAncestor struct{}
+
+func (SingleAncestor) Ancestor(root *datastore.Key, rule *CasbinRule) *datastore.Key {
+	return root
+}
+
+func (SingleAncestor) Ancestors(root *datastore.Key) []*datastore.Key {
+	return []*datastore.Key{root}
+}
+
+// NoAncestor stores rules as root entities. Writes scale freely, but queries
+// are eventually consistent, and transactions can't query them in Datastore's
+// legacy mode.
+type NoAncestor struct{}
+
+func (NoAncestor) Ancestor(root *datastore.Key, rule *CasbinRule) *datastore.Key {
+	return nil
+}
+
+func (NoAncestor) Ancestors(root *datastore.Key) []*datastore.Key {
+	return []*datastore.Key{nil}
+}
+
+// ShardedAncestors spreads rules over Shards entity groups by a hash of the
+// rule, multiplying the write rate while keeping reads strongly consistent
+// at the cost of one query per shard. Shard 0 is the pseudo root key, so
+// going from SingleAncestor to ShardedAncestors keeps rules stored in shard
+// 0 readable. Changing the number of shards moves rules to other shards;
+// SavePolicy or Compact relocate them.
+type ShardedAncestors struct {
+	Shards int
+}
+
+func (s ShardedAncestors) Ancestor(root *datastore.Key, rule *CasbinRule) *datastore.Key {
+	h := fnv.New32a()
+	h.Write([]byte(rule.String()))
+	return s.shard(root, int(h.Sum32()%uint32(s.shards())))
+}
+
+func (s ShardedAncestors) Ancestors(root *datastore.Key) []*datastore.Key {
+	keys := make([]*datastore.Key, s.shards())
+	for i := range keys {
+		keys[i] = s.shard(root, i)
+	}
+	return keys
+}
+
+func (s ShardedAncestors) shards() int {
+	if s.Shards < 1 {
+		return 1
+	}
+	return s.Shards
+}
+
+// shard returns the root key of shard i, a sibling of root.
+func (s ShardedAncestors) shard(root *datastore.Key, i int) *datastore.Key {
+	key := datastore.IDKey(root.Kind, root.ID+int64(i), nil)
+	key.Namespace = root.Namespace
+	return key
+}
+
+// ancestorKey is the context key of the ancestor picked for a query by
+// ancestorContexts.
+type ancestorKey struct{}
+
+// keyStrategy returns the configured KeyStrategy.
+func (a *Adapter) keyStrategy() KeyStrategy {
+	if a.config.KeyStrategy == nil {
+		return SingleAncestor{}
+	}
+	return a.config.KeyStrategy
+}
+
+// ancestor returns the ancestor of queries running with ctx.
+func (a *Adapter) ancestor(ctx context.Context) *datastore.Key {
+	if key, ok := ctx.Value(ancestorKey{}).(*datastore.Key); ok {
+		return key
+	}
+	return a.keyStrategy().Ancestors(a.pseudoRootKey(ctx))[0]
+}
+
+// ancestorContexts returns a context for each ancestor storing rules in the
+// namespace of ctx.
+func (a *Adapter) ancestorContexts(ctx context.Context) []context.Context {
+	ancestors := a.keyStrategy().Ancestors(a.pseudoRootKey(ctx))
+	if len(ancestors) == 1 {
+		return []context.Context{ctx}
+	}
+	ctxs := make([]context.Context, len(ancestors))
+	for i, key := range ancestors {
+		ctxs[i] = context.WithValue(ctx, ancestorKey{}, key)
+	}
+	return ctxs
+}
+
+// scopeContexts returns a context for each ancestor of each namespace
+// storing rules.
+func (a *Adapter) scopeContexts(ctx context.Context) []context.Context {
+	var ctxs []context.Context
+	for _, ctx := range a.namespaceContexts(ctx) {
+		ctxs = append(ctxs, a.ancestorContexts(ctx)...)
+	}
+	return ctxs
+}
@@ -0,0 +1,238 @@
+package datastoreadapter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/casbin/casbin/v2"
+	"github.com/casbin/casbin/v2/model"
+)
+
+func TestKeyStrategy(t *testing.T) {
+	ctx := context.Background()
+	rule := &CasbinRule{PType: "p", V0: "alice", V1: "data1", V2: "read"}
+
+	a := &Adapter{config: withDefaults(Config{Kind: "casbin_test", Namespace: "unittest"})}
+	if parent := a.ruleKey(ctx, rule).Parent; !parent.Equal(a.pseudoRootKey(ctx)) {
+		t.Errorf("got parent %v, wants the pseudo root key", parent)
+	}
+	if got := len(a.ancestorContexts(ctx)); got != 1 {
+		t.Errorf("got %d ancestor contexts, wants 1", got)
+	}
+
+	a.config.KeyStrategy = NoAncestor{}
+	if parent := a.ruleKey(ctx, rule).Parent; parent != nil {
+		t.Errorf("got parent %v, wants none", parent)
+	}
+	if ancestor := a.ancestor(ctx); ancestor != nil {
+		t.Errorf("got ancestor %v, wants none", ancestor)
+	}
+
+	a.config.KeyStrategy = ShardedAncestors{Shards: 4}
+	ctxs := a.ancestorContexts(ctx)
+	if len(ctxs) != 4 {
+		t.Fatalf("got %d ancestor contexts, wants 4", len(ctxs))
+	}
+	if !a.ancestor(ctxs[0]).Equal(a.pseudoRootKey(ctx)) {
+		t.Errorf("got shard 0 %v, wants the pseudo root key", a.ancestor(ctxs[0]))
+	}
+	parent := a.ruleKey(ctx, rule).Parent
+	found := false
+	for _, ctx := range ctxs {
+		found = found || a.ancestor(ctx).Equal(parent)
+	}
+	if !found || parent.Namespace != "unittest" {
+		t.Errorf("got parent %v, wants one of the shards", parent)
+	}
+	if !a.ruleKey(ctx, rule).Equal(a.ruleKey(ctx, rule)) {
+		t.Error("got different keys for the same rule")
+	}
+}
+
+func TestShardedAncestors(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+	defer initPolicy(t, config)
+
+	config.KeyStrategy = ShardedAncestors{Shards: 3}
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	// Saving moves every rule into its shard.
+	if err := e.SavePolicy(); err != nil {
+		t.Fatalf("Expected SavePolicy() to be successful; got %v", err)
+	}
+	e.AddPolicy("zoe", "data1", "read")
+	e.RemovePolicy("bob", "data2", "write")
+	e.RemoveFilteredPolicy(0, "data2_admin", "data2", "write")
+
+	if err := e.LoadPolicy(); err != nil {
+		t.Fatalf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(e, [][]string{{"alice", "data1", "read"}, {"data2_admin", "data2", "read"}, {"zoe", "data1", "read"}}, func(actual, wants [][]string) {
+		t.Error("got: ", actual, ", wants ", wants)
+	})
+}
+
+func TestRequireAncestor(t *testing.T) {
+	offline := func(ctx context.Context) (*datastore.Client, error) {
+		return nil, errors.New("offline")
+	}
+	var a *Adapter
+	var ancestors []*datastore.Key
+	build := func(ctx context.Context) *datastore.Query {
+		ancestors = append(ancestors, a.ancestor(ctx))
+		return a.newQuery(ctx)
+	}
+
+	a = NewAdapterWithClientFactory(offline, Config{KeyStrategy: ShardedAncestors{Shards: 4}})
+	if !*a.EffectiveConfig().RequireAncestor {
+		t.Error("Expected RequireAncestor to default to true")
+	}
+	a.queryAncestors(context.Background(), build)
+	if len(ancestors) != 4 || ancestors[0] == nil || ancestors[3] == nil {
+		t.Errorf("got ancestors %v, wants every shard", ancestors)
+	}
+
+	ancestors = nil
+	requireAncestor := false
+	a = NewAdapterWithClientFactory(offline, Config{KeyStrategy: ShardedAncestors{Shards: 4}, RequireAncestor: &requireAncestor})
+	a.queryAncestors(context.Background(), build)
+	if len(ancestors) != 1 || ancestors[0] != nil {
+		t.Errorf("got ancestors %v, wants a single query without ancestor", ancestors)
+	}
+}
+
+func TestHashPrefixKeys(t *testing.T) {
+	a := &Adapter{config: withDefaults(Config{HashPrefixKeys: true})}
+	rule := &CasbinRule{PType: "p", V0: "alice", V1: "data1", V2: "read"}
+	name := a.keyName(rule)
+	if len(name) != keyPrefixLen+len(rule.String()) || name[keyPrefixLen-1] != ':' {
+		t.Fatalf("got key name %q, wants a hash prefix", name)
+	}
+	if got := a.trimKeyPrefix(name); got != rule.String() {
+		t.Errorf("got %q without prefix, wants %q", got, rule.String())
+	}
+	if again := a.keyName(&CasbinRule{PType: "p", V0: "alice", V1: "data1", V2: "read"}); again != name {
+		t.Errorf("got key name %q, wants %q for the same rule", again, name)
+	}
+
+	// Rules of one subject spread over several prefixes.
+	prefixes := make(map[string]bool)
+	for _, obj := range []string{"data1", "data2", "data3", "data4", "data5", "data6"} {
+		prefixes[a.keyName(&CasbinRule{PType: "p", V0: "alice", V1: obj})[:keyPrefixLen]] = true
+	}
+	if len(prefixes) < 2 {
+		t.Errorf("got prefixes %v, wants them spread", prefixes)
+	}
+
+	a.config.HashPrefixKeys = false
+	if got := a.keyName(rule); got != rule.String() {
+		t.Errorf("got key name %q, wants %q without HashPrefixKeys", got, rule.String())
+	}
+}
+
+func TestEntityGroupShards(t *testing.T) {
+	if got := withDefaults(Config{EntityGroupShards: 4}).KeyStrategy; got != (ShardedAncestors{Shards: 4}) {
+		t.Errorf("got %#v, wants 4 sharded ancestors", got)
+	}
+	if got := withDefaults(Config{EntityGroupShards: 4, KeyStrategy: NoAncestor{}}).KeyStrategy; got != (NoAncestor{}) {
+		t.Errorf("got %#v, wants the configured KeyStrategy", got)
+	}
+
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+
+	// The concurrent loads of the groups are merged in insertion order.
+	config.EntityGroupShards = 4
+	config.InsertionOrder = true
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	parents := make(map[int64]bool)
+	var rules [][]string
+	for i := 0; i < 20; i++ {
+		rule := []string{fmt.Sprintf("user%d", i), "data1", "read"}
+		if err := a.AddPolicy("p", "p", rule); err != nil {
+			t.Fatalf("Expected AddPolicy() to be successful; got %v", err)
+		}
+		line := savePolicyLine("p", rule)
+		parents[a.ruleKey(context.Background(), &line).Parent.ID] = true
+		rules = append(rules, rule)
+	}
+	if len(parents) < 2 {
+		t.Errorf("got rules in %d entity groups, wants them spread", len(parents))
+	}
+
+	m, err := model.NewModelFromFile("examples/rbac_model.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.LoadPolicy(m); err != nil {
+		t.Fatalf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	loaded, _ := m.GetPolicy("p", "p")
+	// The rules of initPolicy have no seq and come first.
+	if len(loaded) != 24 || fmt.Sprint(loaded[4:]) != fmt.Sprint(rules) {
+		t.Errorf("got %v, wants the rules of initPolicy, then %v", loaded, rules)
+	}
+}
+
+func TestTenantEntityGroups(t *testing.T) {
+	a := &Adapter{config: withDefaults(Config{NamespaceFunc: func(ctx context.Context) string {
+		tenant, _ := ctx.Value(tenantKey{}).(string)
+		return tenant
+	}})}
+	rule := &CasbinRule{PType: "p", V0: "alice", V1: "data1", V2: "read"}
+
+	keyA := a.ruleKey(context.WithValue(context.Background(), tenantKey{}, "a"), rule)
+	keyB := a.ruleKey(context.WithValue(context.Background(), tenantKey{}, "b"), rule)
+	if keyA.Parent.Namespace != "a" || keyB.Parent.Namespace != "b" {
+		t.Errorf("got roots %v and %v, wants one per tenant namespace", keyA.Parent, keyB.Parent)
+	}
+	if keyA.Parent.Equal(keyB.Parent) {
+		t.Error("got tenants sharing an entity group")
+	}
+}
+
+type tenantKey struct{}
+
+func TestAncestorKinds(t *testing.T) {
+	a := &Adapter{config: withDefaults(Config{
+		Kind:            "casbin_test",
+		PolicyKind:      "casbin_test_p",
+		GroupingKind:    "casbin_test_g",
+		PTypeNamespaces: map[string]string{"g2": "roles"},
+		KeyStrategy:     ShardedAncestors{Shards: 3},
+		Namespace:       "unittest",
+	})}
+	ctx := context.Background()
+
+	tests := []struct {
+		ptype, kind, namespace string
+	}{
+		{"p", "casbin_test_p", "unittest"},
+		{"g", "casbin_test_g", "unittest"},
+		{"g2", "casbin_test_g", "roles"},
+		{"x", "casbin_test", "unittest"},
+	}
+	for _, tt := range tests {
+		rule := &CasbinRule{PType: tt.ptype, V0: "alice", V1: "data1"}
+		// The context of another ptype doesn't leak into the key.
+		for _, ctx := range []context.Context{ctx, a.ptypeContext(ctx, "g2"), a.ptypeContext(ctx, "p")} {
+			key := a.ruleKey(ctx, rule)
+			if key.Kind != tt.kind || key.Parent.Kind != tt.kind {
+				t.Errorf("%s: got kind %q under %q, wants %q for both", tt.ptype, key.Kind, key.Parent.Kind, tt.kind)
+			}
+			if key.Namespace != tt.namespace || key.Parent.Namespace != tt.namespace {
+				t.Errorf("%s: got namespace %q under %q, wants %q for both", tt.ptype, key.Namespace, key.Parent.Namespace, tt.namespace)
+			}
+		}
+	}
+
+	for _, ctx := range a.scopeContexts(ctx) {
+		if ancestor := a.ancestor(ctx); ancestor.Kind != a.kind(ctx) || ancestor.Namespace != a.namespace(ctx) {
+			t.Errorf("got ancestor %v for queries of kind %q in %q", ancestor, a.kind(ctx), a.namespace(ctx))
+		}
+	}
+}
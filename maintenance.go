@@ -0,0 +1,400 @@
+package datastoreadapter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Compact deletes duplicate rule entities, e.g. left behind by older versions
+// deriving key names differently, keeping one entity per distinct rule. The
+// entity under the rule's current key name is kept if it exists. It returns
+// the number of deleted entities. Rules stored outside the namespace of their
+// ptype, see Config.PTypeNamespaces, count as duplicates if the rule is also
+// stored where it belongs, and so do rules stored under another ancestor
+// than the one picked by Config.KeyStrategy. The deletes are chunked: if a
+// chunk fails after others were committed, it fails with a *PartialError,
+// and compacting again completes it.
+func (a *Adapter) Compact(ctx context.Context) (removed int, err error) {
+	defer a.observe(ctx, "Compact", time.Now(), &err)
+	if err := a.checkWritable(); err != nil {
+		return 0, err
+	}
+	m := Mutation{Op: "Compact"}
+	if err := a.beforeMutate(ctx, m); err != nil {
+		return 0, err
+	}
+	defer a.afterMutate(ctx, m, &err)
+
+	ctx, cancel := withDeadline(ctx, a.config.LoadSaveFilterDeadline)
+	defer cancel()
+
+	if a.config.Debug {
+		a.logPrintln("[Compact] called")
+	}
+
+	var keys []*datastore.Key
+	var rules []*CasbinRule
+	for _, ctx := range a.scopeContexts(ctx) {
+		var found []*datastore.Key
+		var foundRules []*CasbinRule
+		err = a.retry(ctx, func(db *datastore.Client) error {
+			foundRules = nil
+			var err error
+			found, err = db.GetAll(ctx, a.newQuery(ctx), &foundRules)
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
+		found, foundRules = rulesOnly(found, foundRules)
+		keys = append(keys, found...)
+		rules = append(rules, foundRules...)
+	}
+
+	// kept maps every distinct rule to the index of the entity kept for it.
+	kept := make(map[CasbinRule]int)
+	var toDelete []*datastore.Key
+	var deleted []*CasbinRule
+	for i, rule := range rules {
+		j, ok := kept[*rule]
+		switch {
+		case !ok:
+			kept[*rule] = i
+			continue
+		case a.canonical(ctx, keys[i], rule):
+			// Prefer the canonical entity over the one kept so far.
+			kept[*rule] = i
+			i = j
+		}
+		toDelete = append(toDelete, keys[i])
+		deleted = append(deleted, rules[i])
+	}
+
+	if a.config.Debug {
+		a.logPrintln("[Compact] duplicates to drop:", toDelete)
+	}
+	err = a.deleteChunked(ctx, toDelete, deleted, func(n int) {
+		removed += n
+	})
+	return removed, partial(err, removed, len(toDelete))
+}
+
+// canonical reports whether key is the key rule is written under.
+func (a *Adapter) canonical(ctx context.Context, key *datastore.Key, rule *CasbinRule) bool {
+	return key.Equal(a.ruleKey(a.ptypeContext(ctx, rule.PType), rule))
+}
+
+// CheckConsistency returns the rules whose entity's key name doesn't match
+// the fields stored in it, e.g. written by older versions with bugs deriving
+// key names, without changing them. Such rules load fine, but adding or
+// removing them misses the entity. To fix them, add them again, which
+// stores them under their current key name, then run Compact to delete the
+// stale entities.
+func (a *Adapter) CheckConsistency(ctx context.Context) (inconsistent []*CasbinRule, err error) {
+	defer a.observe(ctx, "CheckConsistency", time.Now(), &err)
+	ctx, cancel := withDeadline(ctx, a.config.LoadSaveFilterDeadline)
+	defer cancel()
+
+	if a.config.Debug {
+		a.logPrintln("[CheckConsistency] called")
+	}
+
+	for _, ctx := range a.scopeContexts(ctx) {
+		var keys []*datastore.Key
+		var rules []*CasbinRule
+		err := a.retry(ctx, func(db *datastore.Client) error {
+			rules = nil
+			var err error
+			keys, err = db.GetAll(ctx, a.newQuery(ctx), &rules)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		keys, rules = rulesOnly(keys, rules)
+		for i, rule := range rules {
+			if keys[i].Name != a.keyName(rule) {
+				inconsistent = append(inconsistent, rule)
+			}
+		}
+	}
+
+	if a.config.Debug {
+		a.logPrintln("[CheckConsistency] inconsistent rules:", len(inconsistent))
+	}
+	return inconsistent, nil
+}
+
+// Reindex rewrites every rule entity in the configured storage format, in
+// transactions of up to 500 entities, so that entities written before a
+// change of the indexed properties pick up the current ones. Entities keep
+// their keys and their properties beyond the rule, like metadata and
+// expiry. Key names differ between storage formats, so entities stored in
+// the other format are skipped; move those with ExportToWriter and
+// ImportFromReader instead. It reports progress to Config.OnProgress after
+// every transaction and returns the number of rewritten entities.
+func (a *Adapter) Reindex(ctx context.Context) (rewritten int, err error) {
+	defer a.observe(ctx, "Reindex", time.Now(), &err)
+	if err := a.checkWritable(); err != nil {
+		return 0, err
+	}
+	m := Mutation{Op: "Reindex"}
+	if err := a.beforeMutate(ctx, m); err != nil {
+		return 0, err
+	}
+	defer a.afterMutate(ctx, m, &err)
+
+	ctx, cancel := withDeadline(ctx, a.config.LoadSaveFilterDeadline)
+	defer cancel()
+
+	if a.config.Debug {
+		a.logPrintln("[Reindex] called")
+	}
+
+	var keys []*datastore.Key
+	for _, ctx := range a.scopeContexts(ctx) {
+		var found []*datastore.Key
+		err = a.retry(ctx, func(db *datastore.Client) error {
+			var err error
+			found, err = db.GetAll(ctx, a.newQuery(ctx).KeysOnly(), nil)
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
+		for _, key := range found {
+			// Entities without a key name aren't rules, see newQuery.
+			if key.Name != "" && !(key.Name == "conf" && key.Parent == nil) {
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	total := len(keys)
+	for done := 0; done < total; {
+		if err := ctx.Err(); err != nil {
+			return rewritten, partial(err, done, total)
+		}
+		n := total - done
+		if n > maxMutationsPerTx {
+			n = maxMutationsPerTx
+		}
+		chunk := keys[done : done+n]
+		chunkCtx, cancel := a.chunkContext(ctx)
+		var count int
+		err := a.retry(chunkCtx, func(db *datastore.Client) error {
+			_, err := db.RunInTransaction(chunkCtx, func(tx *datastore.Transaction) error {
+				var err error
+				count, err = a.reindexTx(tx, chunk)
+				return err
+			})
+			return err
+		})
+		cancel()
+		if err != nil {
+			return rewritten, partial(err, done, total)
+		}
+		rewritten += count
+		done += n
+		a.reportProgress(done, total)
+	}
+	return rewritten, nil
+}
+
+// reindexTx rewrites the rule entities under keys within tx, skipping the
+// ones deleted meanwhile and the ones of the other storage format, and
+// returns the number of rewritten entities.
+func (a *Adapter) reindexTx(tx *datastore.Transaction, keys []*datastore.Key) (int, error) {
+	entities := make([]datastore.PropertyList, len(keys))
+	err := tx.GetMulti(keys, entities)
+	var missing datastore.MultiError
+	if err != nil && !errors.As(err, &missing) {
+		return 0, err
+	}
+
+	var putKeys []*datastore.Key
+	var puts []interface{}
+	for i, props := range entities {
+		if missing != nil && missing[i] != nil {
+			if missing[i] == datastore.ErrNoSuchEntity {
+				continue
+			}
+			return 0, missing[i]
+		}
+		var line CasbinRule
+		csv := false
+		var extra []datastore.Property
+		for _, p := range props {
+			switch p.Name {
+			case "ptype", "v0", "v1", "v2", "v3", "v4", "v5":
+			case "rule":
+				csv = true
+			default:
+				extra = append(extra, p)
+			}
+		}
+		if csv != a.csvFormat() {
+			continue
+		}
+		if err := line.Load(props); err != nil {
+			return 0, err
+		}
+		var entity datastore.PropertyLoadSaver = &line
+		if csv {
+			entity = &csvRule{&line}
+		}
+		putKeys = append(putKeys, keys[i])
+		puts = append(puts, &ruleEntity{PropertyLoadSaver: entity, extra: extra})
+	}
+	if len(putKeys) == 0 {
+		return 0, nil
+	}
+	if _, err := tx.PutMulti(putKeys, puts); err != nil {
+		return 0, err
+	}
+	return len(putKeys), nil
+}
+
+// ListPTypes returns the sorted distinct ptypes of the stored rules, e.g.
+// for admin UIs to offer filters. With StorageFormatFields, it reads only
+// keys and takes the ptypes from the key names; with StorageFormatCSV, whose
+// key names are hashes, it reads every rule.
+func (a *Adapter) ListPTypes(ctx context.Context) (ptypes []string, err error) {
+	defer a.observe(ctx, "ListPTypes", time.Now(), &err)
+	ctx, cancel := withDeadline(ctx, a.config.LoadSaveFilterDeadline)
+	defer cancel()
+
+	if a.config.Debug {
+		a.logPrintln("[ListPTypes] called")
+	}
+
+	found := make(map[string]bool)
+	for _, ctx := range a.namespaceContexts(ctx) {
+		for _, ctx := range a.queryContexts(ctx) {
+			if a.csvFormat() {
+				err = a.streamRules(ctx, func() *datastore.Query { return a.newQuery(ctx) }, func(rule *CasbinRule) error {
+					found[rule.PType] = true
+					return nil
+				})
+			} else {
+				err = a.retry(ctx, func(db *datastore.Client) error {
+					keys, err := db.GetAll(ctx, a.newQuery(ctx).KeysOnly(), nil)
+					for _, key := range keys {
+						// Entities without a key name aren't rules, see newQuery,
+						// nor is the model saved by SaveModelWithConfig.
+						if key.Name != "" && !(key.Name == "conf" && key.Parent == nil) {
+							found[ParseString(a.trimKeyPrefix(key.Name)).PType] = true
+						}
+					}
+					return err
+				})
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for ptype := range found {
+		if ptype != "" {
+			ptypes = append(ptypes, ptype)
+		}
+	}
+	sort.Strings(ptypes)
+	return ptypes, nil
+}
+
+// VerifyIndexes runs a representative query of each kind the adapter issues
+// that may need a composite index, with the configured options, to detect
+// missing indexes at startup instead of on first use: LoadPolicy's,
+// LoadSectionPolicy's and LoadPolicyByRange's for each field index in
+// rangeFields, as each field needs an index of its own. Missing indexes fail
+// with an error matching ErrMissingIndex, whose message includes Datastore's
+// suggestion of the index to create.
+func (a *Adapter) VerifyIndexes(ctx context.Context, rangeFields ...int) (err error) {
+	defer a.observe(ctx, "VerifyIndexes", time.Now(), &err)
+	ctx, cancel := withDeadline(ctx, a.config.LoadSaveFilterDeadline)
+	defer cancel()
+
+	if a.config.Debug {
+		a.logPrintln("[VerifyIndexes] called")
+	}
+
+	// The loads query with or without ancestor, see queryContexts, which
+	// needs a different index; any of their ancestors stands for all.
+	qctx := a.queryContexts(ctx)[0]
+	type check struct {
+		name  string
+		query *datastore.Query
+	}
+	checks := []check{
+		{"LoadPolicy", a.ordered(qctx, a.projected(a.newQuery(qctx)))},
+		{"LoadSectionPolicy", a.ordered(qctx, a.sectionQuery(qctx, "p"))},
+	}
+	if !a.csvFormat() {
+		for _, i := range rangeFields {
+			if i < 0 || i > 5 {
+				return fmt.Errorf("%w: %d", ErrInvalidFieldIndex, i)
+			}
+			// Range queries are sorted in memory, see LoadPolicyByRange.
+			checks = append(checks, check{fmt.Sprintf("LoadPolicyByRange on v%d", i), a.rangeQuery(qctx, "p", i, "a", "b")})
+		}
+	}
+
+	var missing []string
+	for _, c := range checks {
+		err := a.retry(ctx, func(db *datastore.Client) error {
+			// Count runs keys-only queries, unless projecting, which
+			// can't be keys-only.
+			_, err := db.Count(ctx, c.query.Limit(1))
+			return err
+		})
+		switch {
+		case isMissingIndex(err):
+			missing = append(missing, fmt.Sprintf("%s: %v", c.name, err))
+		case err != nil:
+			return err
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: %s", ErrMissingIndex, strings.Join(missing, "; "))
+	}
+	return nil
+}
+
+// ClearNamespace deletes every entity of kind in namespace, i.e. the rules,
+// the model saved by SaveModelWithConfig, the snapshots of
+// Config.SnapshotRetention and any bookkeeping entities of adapters
+// configured with that kind and namespace, e.g. to isolate tests or start
+// over from an empty policy. An empty kind means the default one. The
+// deletes aren't atomic: if it fails, part of the entities may be deleted.
+func ClearNamespace(ctx context.Context, db *datastore.Client, kind, namespace string) error {
+	if strings.TrimSpace(kind) == "" {
+		kind = casbinKind
+	}
+	var keys []*datastore.Key
+	for _, kind := range []string{kind, kind + snapshotKindSuffix} {
+		found, err := db.GetAll(ctx, datastore.NewQuery(kind).Namespace(namespace).KeysOnly(), nil)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, found...)
+	}
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > maxMutationsPerTx {
+			n = maxMutationsPerTx
+		}
+		if err := db.DeleteMulti(ctx, keys[:n]); err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package datastoreadapter
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/casbin/casbin/v2"
+)
+
+func TestCompact(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+
+	ctx := context.Background()
+	a := NewAdapterWithConfig(getDatastore(t), config)
+
+	// A duplicate of a stored rule under a legacy key name.
+	key := datastore.NameKey(config.Kind, "legacy,p,alice,data1,read", a.pseudoRootKey(ctx))
+	key.Namespace = config.Namespace
+	if _, err := getDatastore(t).Put(ctx, key, &CasbinRule{PType: "p", V0: "alice", V1: "data1", V2: "read"}); err != nil {
+		t.Fatalf("Expected Put() to be successful; got %v", err)
+	}
+
+	removed, err := a.Compact(ctx)
+	if err != nil {
+		t.Fatalf("Expected Compact() to be successful; got %v", err)
+	}
+	if removed != 1 {
+		t.Errorf("got %d removed, wants 1", removed)
+	}
+	var rule CasbinRule
+	if err := getDatastore(t).Get(ctx, key, &rule); err != datastore.ErrNoSuchEntity {
+		t.Errorf("got %v, wants the legacy entity to be deleted", err)
+	}
+
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	testGetPolicy(e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}}, func(actual, wants [][]string) {
+		t.Error("got: ", actual, ", wants ", wants)
+	})
+}
+
+func TestCheckConsistency(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+
+	ctx := context.Background()
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	if inconsistent, err := a.CheckConsistency(ctx); err != nil || len(inconsistent) != 0 {
+		t.Fatalf("got %v, %v, wants no inconsistent rules", inconsistent, err)
+	}
+
+	// A rule whose fields changed without its key name.
+	key := datastore.NameKey(config.Kind, "p,carol,data3,read", a.pseudoRootKey(ctx))
+	key.Namespace = config.Namespace
+	if _, err := getDatastore(t).Put(ctx, key, &CasbinRule{PType: "p", V0: "carol", V1: "data3", V2: "write"}); err != nil {
+		t.Fatalf("Expected Put() to be successful; got %v", err)
+	}
+
+	inconsistent, err := a.CheckConsistency(ctx)
+	if err != nil {
+		t.Fatalf("Expected CheckConsistency() to be successful; got %v", err)
+	}
+	if len(inconsistent) != 1 || inconsistent[0].V2 != "write" {
+		t.Errorf("got %v, wants the rule of carol", inconsistent)
+	}
+}
+
+func TestReindex(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+
+	ctx := context.Background()
+	var progress []int
+	config.OnProgress = func(done, total int) { progress = append(progress, done, total) }
+	a := NewAdapterWithConfig(getDatastore(t), config)
+
+	// A rule written with v0 unindexed, and metadata.
+	line := CasbinRule{PType: "p", V0: "zoe", V1: "data1", V2: "read"}
+	props, _ := line.Save()
+	props[1].NoIndex = true
+	props = append(props, metaProperties(ContextWithMeta(ctx, map[string]string{"ticket": "SEC-42"}))...)
+	pl := datastore.PropertyList(props)
+	if _, err := getDatastore(t).Put(ctx, a.ruleKey(ctx, &line), &pl); err != nil {
+		t.Fatalf("Expected Put() to be successful; got %v", err)
+	}
+	query := BuildFilterQuery(a.newQuery(ctx), "p", 0, "zoe").KeysOnly()
+	if keys, _ := getDatastore(t).GetAll(ctx, query, nil); len(keys) != 0 {
+		t.Fatalf("got %v, wants the rule not indexed by v0", keys)
+	}
+
+	rewritten, err := a.Reindex(ctx)
+	if err != nil {
+		t.Fatalf("Expected Reindex() to be successful; got %v", err)
+	}
+	if rewritten != 6 || !reflect.DeepEqual(progress, []int{6, 6}) {
+		t.Errorf("got %d rewritten and progress %v, wants 6 and [6 6]", rewritten, progress)
+	}
+	if keys, _ := getDatastore(t).GetAll(ctx, query, nil); len(keys) != 1 {
+		t.Errorf("got %v, wants the rule indexed by v0", keys)
+	}
+	if meta, err := a.GetPolicyMeta(ctx, "p", []string{"zoe", "data1", "read"}); err != nil || meta["ticket"] != "SEC-42" {
+		t.Errorf("got %v, %v, wants the metadata kept", meta, err)
+	}
+}
+
+func TestListPTypes(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	if err := a.AddPolicy("p", "p2", []string{"alice", "data1"}); err != nil {
+		t.Fatalf("Expected AddPolicy() to be successful; got %v", err)
+	}
+	ptypes, err := a.ListPTypes(context.Background())
+	if err != nil {
+		t.Fatalf("Expected ListPTypes() to be successful; got %v", err)
+	}
+	if want := []string{"g", "p", "p2"}; !reflect.DeepEqual(ptypes, want) {
+		t.Errorf("got %q, wants %q", ptypes, want)
+	}
+}
+
+func TestVerifyIndexes(t *testing.T) {
+	invalid := &Adapter{config: withDefaults(Config{})}
+	if err := invalid.VerifyIndexes(context.Background(), 6); !errors.Is(err, ErrInvalidFieldIndex) {
+		t.Errorf("got %v, wants %v", err, ErrInvalidFieldIndex)
+	}
+
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	if err := a.VerifyIndexes(context.Background()); err != nil {
+		t.Errorf("Expected VerifyIndexes() to be successful; got %v", err)
+	}
+	config.SortOnLoad = true
+	config.ProjectedFields = 3
+	a = NewAdapterWithConfig(getDatastore(t), config)
+	if err := a.VerifyIndexes(context.Background(), 0, 2); err != nil && !errors.Is(err, ErrMissingIndex) {
+		t.Errorf("got %v, wants success or %v", err, ErrMissingIndex)
+	}
+
+	// Without ancestor, the loads need indexes without "ancestor: yes".
+	requireAncestor := false
+	config.RequireAncestor = &requireAncestor
+	a = NewAdapterWithConfig(getDatastore(t), config)
+	if err := a.VerifyIndexes(context.Background(), 2); err != nil && !errors.Is(err, ErrMissingIndex) {
+		t.Errorf("got %v, wants success or %v", err, ErrMissingIndex)
+	}
+}
+
+func TestClearNamespace(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+
+	ctx := context.Background()
+	if err := ClearNamespace(ctx, getDatastore(t), config.Kind, config.Namespace); err != nil {
+		t.Fatalf("Expected ClearNamespace() to be successful; got %v", err)
+	}
+	keys, err := getDatastore(t).GetAll(ctx, datastore.NewQuery(config.Kind).Namespace(config.Namespace).KeysOnly(), nil)
+	if err != nil {
+		t.Fatalf("Expected GetAll() to be successful; got %v", err)
+	}
+	if len(keys) != 0 {
+		t.Errorf("got %d entities left, wants 0", len(keys))
+	}
+}
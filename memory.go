@@ -0,0 +1,290 @@
+package datastoreadapter
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/casbin/casbin/v2/model"
+	"github.com/casbin/casbin/v2/persist"
+)
+
+// MemoryAdapter is an in-memory stand-in for Adapter, for tests of code
+// using Casbin that shouldn't need Datastore or its emulator. Rules are kept
+// by the same key names as in Datastore, so adding a stored rule again and
+// removing a missing one are no-ops, and filters have the same semantics.
+// Rules load in key name order, the order Adapter loads them in with the
+// default Config; key formats such as Config.HashPrefixKeys and
+// StorageFormatCSV, and options such as Config.SortOnLoad, load in other
+// orders, so tests shouldn't depend on it.
+type MemoryAdapter struct {
+	mu    sync.Mutex
+	rules map[string]CasbinRule
+}
+
+// NewInMemoryAdapter returns an empty MemoryAdapter. Besides
+// persist.Adapter it implements persist.ContextAdapter,
+// persist.BatchAdapter, persist.ContextBatchAdapter,
+// persist.UpdatableAdapter and persist.ContextUpdatableAdapter, like
+// Adapter.
+func NewInMemoryAdapter() *MemoryAdapter {
+	return &MemoryAdapter{rules: make(map[string]CasbinRule)}
+}
+
+// The casbin interfaces MemoryAdapter implements, checked at compile time.
+var (
+	_ persist.Adapter                 = (*MemoryAdapter)(nil)
+	_ persist.ContextAdapter          = (*MemoryAdapter)(nil)
+	_ persist.BatchAdapter            = (*MemoryAdapter)(nil)
+	_ persist.ContextBatchAdapter     = (*MemoryAdapter)(nil)
+	_ persist.UpdatableAdapter        = (*MemoryAdapter)(nil)
+	_ persist.ContextUpdatableAdapter = (*MemoryAdapter)(nil)
+)
+
+func (m *MemoryAdapter) LoadPolicy(model model.Model) error {
+	return m.LoadPolicyCtx(context.Background(), model)
+}
+
+// LoadPolicyCtx loads all policy rules into model. Rules of ptypes the
+// model doesn't define are skipped.
+func (m *MemoryAdapter) LoadPolicyCtx(ctx context.Context, model model.Model) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	names := make([]string, 0, len(m.rules))
+	for name := range m.rules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	lines := make([]CasbinRule, len(names))
+	for i, name := range names {
+		lines[i] = m.rules[name]
+	}
+	m.mu.Unlock()
+
+	for _, line := range lines {
+		if !definesPType(model, line.PType) {
+			continue
+		}
+		if err := loadPolicyLine(line, model); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MemoryAdapter) SavePolicy(model model.Model) error {
+	return m.SavePolicyCtx(context.Background(), model)
+}
+
+// SavePolicyCtx replaces the stored rules with those of model.
+func (m *MemoryAdapter) SavePolicyCtx(ctx context.Context, model model.Model) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	rules := make(map[string]CasbinRule)
+	for _, sec := range []string{"p", "g"} {
+		for ptype, ast := range model[sec] {
+			for _, rule := range ast.Policy {
+				line, err := memoryLine(ptype, rule)
+				if err != nil {
+					return err
+				}
+				rules[line.String()] = line
+			}
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.rules = rules
+	return nil
+}
+
+func (m *MemoryAdapter) AddPolicy(sec string, ptype string, rule []string) error {
+	return m.AddPolicyCtx(context.Background(), sec, ptype, rule)
+}
+
+// AddPolicyCtx adds a policy rule to the storage.
+func (m *MemoryAdapter) AddPolicyCtx(ctx context.Context, sec string, ptype string, rule []string) error {
+	return m.AddPoliciesCtx(ctx, sec, ptype, [][]string{rule})
+}
+
+func (m *MemoryAdapter) AddPolicies(sec string, ptype string, rules [][]string) error {
+	return m.AddPoliciesCtx(context.Background(), sec, ptype, rules)
+}
+
+// AddPoliciesCtx adds policy rules to the storage, all or none of them.
+func (m *MemoryAdapter) AddPoliciesCtx(ctx context.Context, sec string, ptype string, rules [][]string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	lines := make([]CasbinRule, len(rules))
+	for i, rule := range rules {
+		var err error
+		if lines[i], err = memoryLine(ptype, rule); err != nil {
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, line := range lines {
+		m.rules[line.String()] = line
+	}
+	return nil
+}
+
+func (m *MemoryAdapter) RemovePolicy(sec string, ptype string, rule []string) error {
+	return m.RemovePolicyCtx(context.Background(), sec, ptype, rule)
+}
+
+// RemovePolicyCtx removes a policy rule from the storage.
+func (m *MemoryAdapter) RemovePolicyCtx(ctx context.Context, sec string, ptype string, rule []string) error {
+	return m.RemovePoliciesCtx(ctx, sec, ptype, [][]string{rule})
+}
+
+func (m *MemoryAdapter) RemovePolicies(sec string, ptype string, rules [][]string) error {
+	return m.RemovePoliciesCtx(context.Background(), sec, ptype, rules)
+}
+
+// RemovePoliciesCtx removes policy rules from the storage.
+func (m *MemoryAdapter) RemovePoliciesCtx(ctx context.Context, sec string, ptype string, rules [][]string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, rule := range rules {
+		line := savePolicyLine(ptype, rule)
+		delete(m.rules, line.String())
+	}
+	return nil
+}
+
+func (m *MemoryAdapter) RemoveFilteredPolicy(sec string, ptype string, fieldIndex int, fieldValues ...string) error {
+	return m.RemoveFilteredPolicyCtx(context.Background(), sec, ptype, fieldIndex, fieldValues...)
+}
+
+// RemoveFilteredPolicyCtx removes policy rules that match the filter from
+// the storage.
+func (m *MemoryAdapter) RemoveFilteredPolicyCtx(ctx context.Context, sec string, ptype string, fieldIndex int, fieldValues ...string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for name, line := range m.rules {
+		if line.PType == ptype && matchesFilter(&line, fieldIndex, fieldValues...) {
+			delete(m.rules, name)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryAdapter) UpdatePolicy(sec string, ptype string, oldRule, newRule []string) error {
+	return m.UpdatePolicyCtx(context.Background(), sec, ptype, oldRule, newRule)
+}
+
+// UpdatePolicyCtx replaces oldRule with newRule. A missing oldRule is not
+// an error.
+func (m *MemoryAdapter) UpdatePolicyCtx(ctx context.Context, sec string, ptype string, oldRule, newRule []string) error {
+	return m.UpdatePoliciesCtx(ctx, sec, ptype, [][]string{oldRule}, [][]string{newRule})
+}
+
+func (m *MemoryAdapter) UpdatePolicies(sec string, ptype string, oldRules, newRules [][]string) error {
+	return m.UpdatePoliciesCtx(context.Background(), sec, ptype, oldRules, newRules)
+}
+
+// UpdatePoliciesCtx replaces every rule of oldRules with the rule of
+// newRules at the same index, all or none of them.
+func (m *MemoryAdapter) UpdatePoliciesCtx(ctx context.Context, sec string, ptype string, oldRules, newRules [][]string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(oldRules) != len(newRules) {
+		return fmt.Errorf("datastoreadapter: %d old rules but %d new rules", len(oldRules), len(newRules))
+	}
+	lines := make([]CasbinRule, len(newRules))
+	for i, rule := range newRules {
+		var err error
+		if lines[i], err = memoryLine(ptype, rule); err != nil {
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, rule := range oldRules {
+		line := savePolicyLine(ptype, rule)
+		delete(m.rules, line.String())
+	}
+	for _, line := range lines {
+		m.rules[line.String()] = line
+	}
+	return nil
+}
+
+func (m *MemoryAdapter) UpdateFilteredPolicies(sec string, ptype string, newRules [][]string, fieldIndex int, fieldValues ...string) ([][]string, error) {
+	return m.UpdateFilteredPoliciesCtx(context.Background(), sec, ptype, newRules, fieldIndex, fieldValues...)
+}
+
+// UpdateFilteredPoliciesCtx replaces the rules matching the filter, with
+// the semantics of RemoveFilteredPolicy, with newRules, and returns the
+// replaced rules by key name. Trailing empty fields are dropped from every
+// returned rule.
+func (m *MemoryAdapter) UpdateFilteredPoliciesCtx(ctx context.Context, sec string, ptype string, newRules [][]string,
+	fieldIndex int, fieldValues ...string) ([][]string, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	lines := make([]CasbinRule, len(newRules))
+	for i, rule := range newRules {
+		var err error
+		if lines[i], err = memoryLine(ptype, rule); err != nil {
+			return nil, err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var names []string
+	for name, line := range m.rules {
+		if line.PType == ptype && matchesFilter(&line, fieldIndex, fieldValues...) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	oldRules := make([][]string, len(names))
+	for i, name := range names {
+		line := m.rules[name]
+		oldRules[i] = trimTrailingEmpty(line.fields()[1:])
+		delete(m.rules, name)
+	}
+	for _, line := range lines {
+		m.rules[line.String()] = line
+	}
+	return oldRules, nil
+}
+
+// memoryLine returns the stored form of rule, failing like Adapter does
+// for rules Datastore can't key.
+func memoryLine(ptype string, rule []string) (CasbinRule, error) {
+	if ptype == "" {
+		return CasbinRule{}, ErrEmptyPType
+	}
+	line := savePolicyLine(ptype, rule)
+	if name := line.String(); len(name) > maxKeyNameLen {
+		return CasbinRule{}, fmt.Errorf("%w: %d bytes, the limit is %d", ErrKeyTooLong, len(name), maxKeyNameLen)
+	}
+	return line, nil
+}
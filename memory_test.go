@@ -0,0 +1,97 @@
+package datastoreadapter
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/casbin/casbin/v2"
+)
+
+func TestMemoryAdapter(t *testing.T) {
+	a := NewInMemoryAdapter()
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf", "examples/rbac_policy.csv")
+	if err := a.SavePolicy(e.GetModel()); err != nil {
+		t.Fatalf("Expected SavePolicy() to be successful; got %v", err)
+	}
+
+	e, _ = casbin.NewEnforcer("examples/rbac_model.conf", a)
+	testGetPolicy(e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}}, func(actual, wants [][]string) {
+		t.Error("got: ", actual, ", wants ", wants)
+	})
+
+	e.AddPolicy("bob", "data1", "read")
+	// Adding a stored rule again and removing a missing one are no-ops.
+	a.AddPolicy("p", "p", []string{"bob", "data1", "read"})
+	a.RemovePolicy("p", "p", []string{"nobody", "data1", "read"})
+	e.AddPolicies([][]string{{"carol", "data3", "read"}, {"carol", "data3", "write"}})
+	e.RemovePolicy("alice", "data1", "read")
+	e.RemoveFilteredPolicy(1, "data2")
+	e.RemovePolicies([][]string{{"carol", "data3", "write"}})
+
+	if err := e.LoadPolicy(); err != nil {
+		t.Fatalf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(e, [][]string{{"bob", "data1", "read"}, {"carol", "data3", "read"}}, func(actual, wants [][]string) {
+		t.Error("got: ", actual, ", wants ", wants)
+	})
+	if ok, _ := e.HasGroupingPolicy("alice", "data2_admin"); !ok {
+		t.Error("Expected the grouping rule to be kept")
+	}
+
+	if err := a.AddPolicy("p", "p", []string{strings.Repeat("x", maxKeyNameLen)}); !errors.Is(err, ErrKeyTooLong) {
+		t.Errorf("got %v, wants %v", err, ErrKeyTooLong)
+	}
+}
+
+func TestMemoryAdapterMultiplePolicyDefinitions(t *testing.T) {
+	a := NewInMemoryAdapter()
+	file, _ := casbin.NewEnforcer("examples/multiple_policy_definitions_model.conf", "examples/multiple_policy_definitions_policy.csv")
+	if err := a.SavePolicy(file.GetModel()); err != nil {
+		t.Fatalf("Expected SavePolicy() to be successful; got %v", err)
+	}
+	if err := a.RemoveFilteredPolicy("p", "p2", 3, "deny"); err != nil {
+		t.Fatalf("Expected RemoveFilteredPolicy() to be successful; got %v", err)
+	}
+
+	e, _ := casbin.NewEnforcer("examples/multiple_policy_definitions_model.conf", a)
+	if p, _ := e.GetNamedPolicy("p"); !SamePolicy(p, [][]string{{"data2_admin", "data2", "read"}}) {
+		t.Errorf("got p rules %v, wants data2_admin's", p)
+	}
+	if p2, _ := e.GetNamedPolicy("p2"); !SamePolicy(p2, [][]string{{"r2.sub.Age > 18 && r2.sub.Age < 60", "/data1", "read", "allow"}}) {
+		t.Errorf("got p2 rules %v, wants only the allowing one", p2)
+	}
+}
+
+func TestMemoryAdapterUpdate(t *testing.T) {
+	a := NewInMemoryAdapter()
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf", "examples/rbac_policy.csv")
+	if err := a.SavePolicy(e.GetModel()); err != nil {
+		t.Fatalf("Expected SavePolicy() to be successful; got %v", err)
+	}
+
+	e, _ = casbin.NewEnforcer("examples/rbac_model.conf", a)
+	if _, err := e.UpdatePolicy([]string{"alice", "data1", "read"}, []string{"alice", "data1", "write"}); err != nil {
+		t.Fatalf("Expected UpdatePolicy() to be successful; got %v", err)
+	}
+	if _, err := e.UpdatePolicies([][]string{{"bob", "data2", "write"}}, [][]string{{"bob", "data3", "write"}}); err != nil {
+		t.Fatalf("Expected UpdatePolicies() to be successful; got %v", err)
+	}
+	old, err := a.UpdateFilteredPolicies("p", "p", [][]string{{"data3_admin", "data3", "read"}}, 0, "data2_admin")
+	if err != nil {
+		t.Fatalf("Expected UpdateFilteredPolicies() to be successful; got %v", err)
+	}
+	if !SamePolicy(old, [][]string{{"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}}) {
+		t.Errorf("got %v, wants data2_admin's rules", old)
+	}
+	if err := a.UpdatePolicies("p", "p", [][]string{{"alice", "data1", "write"}}, nil); err == nil {
+		t.Error("Expected UpdatePolicies() to fail with fewer new rules")
+	}
+
+	if err := e.LoadPolicy(); err != nil {
+		t.Fatalf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(e, [][]string{{"alice", "data1", "write"}, {"bob", "data3", "write"}, {"data3_admin", "data3", "read"}}, func(actual, wants [][]string) {
+		t.Error("got: ", actual, ", wants ", wants)
+	})
+}
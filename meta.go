@@ -0,0 +1,71 @@
+package datastoreadapter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// metaProperty is the unindexed property holding a rule's metadata, as a
+// JSON-encoded object.
+const metaProperty = "meta"
+
+// metaKey is the context key of the metadata set by ContextWithMeta.
+type metaKey struct{}
+
+// ContextWithMeta returns a copy of ctx carrying meta, which is stored with
+// every rule written with the returned context, e.g. by AddPolicyCtx or
+// AddPoliciesCtx. Rules staged by Begin get the metadata of the context
+// passed to CommitCtx. The metadata is not part of the rule: it isn't loaded
+// into the model and doesn't affect enforcement. Writing a rule again
+// replaces its metadata, or drops it if the context has none.
+func ContextWithMeta(ctx context.Context, meta map[string]string) context.Context {
+	return context.WithValue(ctx, metaKey{}, meta)
+}
+
+// metaProperties returns the properties storing the metadata of ctx, if any.
+func metaProperties(ctx context.Context) []datastore.Property {
+	meta, _ := ctx.Value(metaKey{}).(map[string]string)
+	if len(meta) == 0 {
+		return nil
+	}
+	// Encoding a map of strings can't fail.
+	b, _ := json.Marshal(meta)
+	return []datastore.Property{{Name: metaProperty, Value: string(b), NoIndex: true}}
+}
+
+// GetPolicyMeta returns the metadata stored with rule, see ContextWithMeta,
+// or nil if it has none. It fails with datastore.ErrNoSuchEntity if the rule
+// isn't stored.
+func (a *Adapter) GetPolicyMeta(ctx context.Context, ptype string, rule []string) (meta map[string]string, err error) {
+	defer a.observe(a.ptypeContext(ctx, ptype), "GetPolicyMeta", time.Now(), &err)
+	ctx, cancel := withDeadline(a.ptypeContext(ctx, ptype), a.config.AddRemoveDeadline)
+	defer cancel()
+
+	line := a.storedLine(ptype, rule)
+	key := a.ruleKey(ctx, &line)
+
+	if a.config.Debug {
+		a.logPrintln("[GetPolicyMeta] called:", line.String())
+	}
+
+	var entity ruleEntity
+	err = a.retry(ctx, func(db *datastore.Client) error {
+		entity = ruleEntity{}
+		return db.Get(ctx, key, &entity)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range entity.extra {
+		if s, ok := p.Value.(string); ok && p.Name == metaProperty {
+			if err := json.Unmarshal([]byte(s), &meta); err != nil {
+				return nil, fmt.Errorf("datastoreadapter: invalid metadata of %s: %v", line.String(), err)
+			}
+		}
+	}
+	return meta, nil
+}
@@ -0,0 +1,127 @@
+package datastoreadapter
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/casbin/casbin/v2"
+)
+
+func TestPolicyMeta(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+	defer initPolicy(t, config)
+
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	meta := map[string]string{"granted_by": "carol", "ticket": "SEC-42"}
+	ctx := ContextWithMeta(context.Background(), meta)
+	if err := a.AddPolicyCtx(ctx, "p", "p", []string{"zoe", "data1", "read"}); err != nil {
+		t.Fatalf("Expected AddPolicyCtx() to be successful; got %v", err)
+	}
+
+	got, err := a.GetPolicyMeta(context.Background(), "p", []string{"zoe", "data1", "read"})
+	if err != nil {
+		t.Fatalf("Expected GetPolicyMeta() to be successful; got %v", err)
+	}
+	if !reflect.DeepEqual(got, meta) {
+		t.Errorf("got %v, wants %v", got, meta)
+	}
+
+	// Rules without metadata have none.
+	got, err = a.GetPolicyMeta(context.Background(), "p", []string{"alice", "data1", "read"})
+	if err != nil || got != nil {
+		t.Errorf("got %v, %v, wants no metadata", got, err)
+	}
+	if _, err := a.GetPolicyMeta(context.Background(), "p", []string{"nobody", "data1", "read"}); err != datastore.ErrNoSuchEntity {
+		t.Errorf("got %v, wants %v", err, datastore.ErrNoSuchEntity)
+	}
+
+	// The metadata isn't part of the loaded rule.
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	testGetPolicy(e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}, {"zoe", "data1", "read"}}, func(actual, wants [][]string) {
+		t.Error("got: ", actual, ", wants ", wants)
+	})
+}
+
+func TestMetaProperties(t *testing.T) {
+	if props := metaProperties(context.Background()); props != nil {
+		t.Errorf("got %v, wants none", props)
+	}
+	props := metaProperties(ContextWithMeta(context.Background(), map[string]string{"ticket": "SEC-42"}))
+	wants := []datastore.Property{{Name: "meta", Value: `{"ticket":"SEC-42"}`, NoIndex: true}}
+	if !reflect.DeepEqual(props, wants) {
+		t.Errorf("got %v, wants %v", props, wants)
+	}
+}
+
+func TestSavePolicyKeepsMeta(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	meta := map[string]string{"granted_by": "carol"}
+	ctx := ContextWithMeta(context.Background(), meta)
+	if err := a.AddPolicyCtx(ctx, "p", "p", []string{"zoe", "data1", "read"}); err != nil {
+		t.Fatalf("Expected AddPolicyCtx() to be successful; got %v", err)
+	}
+
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	e.EnableAutoSave(false)
+	e.AddPolicy("yves", "data2", "read")
+	e.RemovePolicy("bob", "data2", "write")
+	if err := e.SavePolicy(); err != nil {
+		t.Fatalf("Expected SavePolicy() to be successful; got %v", err)
+	}
+
+	got, err := a.GetPolicyMeta(context.Background(), "p", []string{"zoe", "data1", "read"})
+	if err != nil {
+		t.Fatalf("Expected GetPolicyMeta() to be successful; got %v", err)
+	}
+	if !reflect.DeepEqual(got, meta) {
+		t.Errorf("got %v, wants the metadata kept through the save", got)
+	}
+}
+
+func TestSavePolicyKeepsCreated(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest", CreatedProperty: "created"}
+	initPolicy(t, config)
+
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	created := func(rule ...string) time.Time {
+		t.Helper()
+		line := a.storedLine("p", rule)
+		var entity ruleEntity
+		if err := getDatastore(t).Get(context.Background(), a.ruleKey(context.Background(), &line), &entity); err != nil {
+			t.Fatalf("Expected Get() to be successful; got %v", err)
+		}
+		for _, p := range entity.extra {
+			if v, ok := p.Value.(time.Time); ok && p.Name == "created" {
+				return v
+			}
+		}
+		t.Fatalf("got no creation time for %v", rule)
+		return time.Time{}
+	}
+	first := created("alice", "data1", "read")
+
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	e.EnableAutoSave(false)
+	e.AddPolicy("yves", "data2", "read")
+	if err := e.SavePolicy(); err != nil {
+		t.Fatalf("Expected SavePolicy() to be successful; got %v", err)
+	}
+	// Adding a stored rule again keeps its creation time too.
+	if err := a.AddPolicy("p", "p", []string{"alice", "data1", "read"}); err != nil {
+		t.Fatalf("Expected AddPolicy() to be successful; got %v", err)
+	}
+
+	if got := created("alice", "data1", "read"); !got.Equal(first) {
+		t.Errorf("got %v, wants the creation time %v kept", got, first)
+	}
+	if got := created("yves", "data2", "read"); !got.After(first) {
+		t.Errorf("got %v, wants a creation time after %v", got, first)
+	}
+}
@@ -0,0 +1,41 @@
+package datastoreadapter
+
+import (
+	"context"
+	"time"
+)
+
+// Operation describes a finished adapter operation, see Config.OnOperation.
+type Operation struct {
+	// Name is the name of the method, without a Ctx suffix, e.g.
+	// "AddPolicy".
+	Name string
+	// Kind and Namespace are where the operation ran. Operations spanning
+	// the namespaces of Config.PTypeNamespaces or the kinds of
+	// Config.PolicyKind and Config.GroupingKind report the base namespace
+	// and Config.Kind.
+	Kind      string
+	Namespace string
+	// Actor is the actor set by ContextWithActor, or "" if none was set.
+	Actor    string
+	Duration time.Duration
+	// Err is the error the operation returned, if any.
+	Err error
+}
+
+// observe reports the operation name, started at start and running with
+// ctx, to Config.OnOperation once it returned *err. Call it deferred.
+func (a *Adapter) observe(ctx context.Context, name string, start time.Time, err *error) {
+	if a.config.OnOperation == nil {
+		return
+	}
+	actor, _ := ActorFromContext(ctx)
+	a.config.OnOperation(Operation{
+		Name:      name,
+		Kind:      a.kind(ctx),
+		Namespace: a.namespace(ctx),
+		Actor:     actor,
+		Duration:  time.Since(start),
+		Err:       *err,
+	})
+}
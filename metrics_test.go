@@ -0,0 +1,56 @@
+package datastoreadapter
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestOnOperation(t *testing.T) {
+	var ops []Operation
+	a := &Adapter{config: withDefaults(Config{
+		Namespace:       "tenant1",
+		PTypeNamespaces: map[string]string{"g": "roles"},
+		ReadOnly:        true,
+		OnOperation: func(op Operation) {
+			ops = append(ops, op)
+		},
+	})}
+
+	a.AddPolicy("p", "p", []string{"alice", "data1", "read"})
+	a.RemovePolicy("g", "g", []string{"alice", "admin"})
+
+	if len(ops) != 2 {
+		t.Fatalf("got %d operations, wants 2", len(ops))
+	}
+	wants := []Operation{
+		{Name: "AddPolicy", Kind: "casbin", Namespace: "tenant1", Err: ErrReadOnly},
+		{Name: "RemovePolicy", Kind: "casbin", Namespace: "roles", Err: ErrReadOnly},
+	}
+	for i, want := range wants {
+		got := ops[i]
+		if got.Name != want.Name || got.Kind != want.Kind || got.Namespace != want.Namespace || !errors.Is(got.Err, want.Err) {
+			t.Errorf("got %+v, wants %+v", got, want)
+		}
+	}
+}
+
+func TestOnOperationSingleRuleBatch(t *testing.T) {
+	var names []string
+	a := &Adapter{config: withDefaults(Config{OnOperation: func(op Operation) {
+		names = append(names, op.Name)
+	}})}
+	// Staging keeps the writes off Datastore.
+	if err := a.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	defer a.Rollback()
+
+	// A single rule takes the AddPolicy and RemovePolicy paths, but is
+	// observed once, as the batch called.
+	a.AddPolicies("p", "p", [][]string{{"alice", "data1", "read"}})
+	a.RemovePolicies("p", "p", [][]string{{"alice", "data1", "read"}})
+	if wants := []string{"AddPolicies", "RemovePolicies"}; !reflect.DeepEqual(names, wants) {
+		t.Errorf("got %v, wants %v", names, wants)
+	}
+}
@@ -2,10 +2,13 @@ package datastoreadapter
 
 import (
 	"context"
+	"fmt"
 	"io/ioutil"
+	"time"
 
 	"cloud.google.com/go/datastore"
-	"github.com/casbin/casbin/model"
+	"github.com/casbin/casbin/v2"
+	"github.com/casbin/casbin/v2/model"
 )
 
 type CasbinModelConf struct {
@@ -30,21 +33,16 @@ func SaveModelWithConfig(db *datastore.Client, path string, config Config) error
 		return err
 	}
 
-	kind := casbinKind
-	if config.Kind != "" {
-		kind = config.Kind
-	}
+	config = withDefaults(config)
+	kind := config.Kind
 	namespace := config.Namespace
 
-	ctx, cancel := context.WithTimeout(
+	ctx, cancel := withDeadline(
 		context.Background(), config.LoadSaveFilterDeadline)
 	defer cancel()
 	_, err = db.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
-		key := datastore.NameKey(kind, "conf", nil)
-		key.Namespace = namespace
-
 		m := CasbinModelConf{text}
-		_, err := tx.Put(key, &m)
+		_, err := tx.Put(modelKey(kind, namespace), &m)
 		return err
 	})
 	return err
@@ -57,17 +55,27 @@ func LoadModel(db *datastore.Client) (model.Model, error) {
 
 // LoadModel loads a casbin model definition from a datastore entity.
 func LoadModelWithConfig(db *datastore.Client, config Config) (model.Model, error) {
-	kind := casbinKind
-	if config.Kind != "" {
-		kind = config.Kind
+	return loadModel(context.Background(), db, config)
+}
+
+// NewEnforcerFromDatastore returns an enforcer with the model saved by
+// SaveModelWithConfig and an adapter with config, having loaded the policy.
+// ctx bounds reading the model; the enforcer loads the policy, bounded by
+// Config.LoadSaveFilterDeadline, as casbin enforcers don't pass a context.
+func NewEnforcerFromDatastore(ctx context.Context, db *datastore.Client, config Config) (*casbin.Enforcer, error) {
+	m, err := loadModel(ctx, db, config)
+	if err != nil {
+		return nil, err
 	}
-	namespace := config.Namespace
+	return casbin.NewEnforcer(m, NewAdapterWithConfig(db, config))
+}
 
-	key := datastore.NameKey(kind, "conf", nil)
-	key.Namespace = namespace
+// loadModel implements LoadModelWithConfig with ctx.
+func loadModel(ctx context.Context, db *datastore.Client, config Config) (model.Model, error) {
+	config = withDefaults(config)
+	key := modelKey(config.Kind, config.Namespace)
 
-	ctx, cancel := context.WithTimeout(
-		context.Background(), config.LoadSaveFilterDeadline)
+	ctx, cancel := withDeadline(ctx, config.LoadSaveFilterDeadline)
 	defer cancel()
 	var conf CasbinModelConf
 	if err := db.Get(ctx, key, &conf); err != nil {
@@ -76,3 +84,61 @@ func LoadModelWithConfig(db *datastore.Client, config Config) (model.Model, erro
 
 	return model.NewModelFromString(conf.Text)
 }
+
+// modelKey returns the key of the entity storing the model text.
+func modelKey(kind, namespace string) *datastore.Key {
+	key := datastore.NameKey(kind, "conf", nil)
+	key.Namespace = namespace
+	return key
+}
+
+// SaveModelAndPolicy stores the text of m, like SaveModelWithConfig, and
+// replaces the stored rules with the rules of m, like SavePolicy, in a
+// single transaction, so that loads never see the new model with the old
+// policy or the other way round. The model is stored with the adapter's
+// kind and Config.Namespace. Unlike SavePolicy, it fails with
+// ErrTooManyMutations instead of splitting a policy change too large for one
+// transaction.
+func (a *Adapter) SaveModelAndPolicy(ctx context.Context, m model.Model) (result SaveResult, err error) {
+	defer a.observe(ctx, "SaveModelAndPolicy", time.Now(), &err)
+	return a.savePolicy(ctx, "SaveModelAndPolicy", m, true)
+}
+
+// saveWithModel is saveRules for all stored rules, also putting the model
+// text in the same transaction.
+func (a *Adapter) saveWithModel(ctx context.Context, wanted map[string]*CasbinRule, order []string, text string) (saveDiff, error) {
+	var d saveDiff
+	err := a.retry(ctx, func(db *datastore.Client) error {
+		_, err := db.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+			keys, rules, err := a.storedRules(ctx, db, tx)
+			if err != nil {
+				return err
+			}
+			d = a.diff(ctx, keys, rules, wanted, order)
+			// The model takes one put.
+			if d.mutations()+1 > maxPutsPerTx {
+				return fmt.Errorf("%w: %d rule mutations and the model, the limit is %d",
+					ErrTooManyMutations, d.mutations(), maxPutsPerTx)
+			}
+
+			if len(d.deleteKeys) > 0 {
+				if err := tx.DeleteMulti(d.deleteKeys); err != nil {
+					return rulesError(err, d.deleted)
+				}
+			}
+			if _, err := tx.Put(modelKey(a.config.Kind, a.config.Namespace), &CasbinModelConf{text}); err != nil {
+				return err
+			}
+			if len(d.putKeys) == 0 {
+				return nil
+			}
+			return a.putRules(ctx, tx, d.putKeys, d.putLines, false)
+		})
+		return err
+	})
+	if err != nil {
+		return saveDiff{}, err
+	}
+	a.reportProgress(d.mutations(), d.mutations())
+	return d, nil
+}
@@ -1,12 +1,13 @@
 package datastoreadapter
 
 import (
+	"context"
 	"fmt"
 	"sort"
 	"strings"
 	"testing"
 
-	"github.com/casbin/casbin/model"
+	"github.com/casbin/casbin/v2/model"
 )
 
 func TestSaveAndLoadModel(t *testing.T) {
@@ -15,7 +16,7 @@ func TestSaveAndLoadModel(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	db := getDatastore()
+	db := getDatastore(t)
 	config := Config{
 		Namespace: "unittest",
 	}
@@ -38,8 +39,60 @@ func TestSaveAndLoadModel(t *testing.T) {
 	}
 }
 
+func TestNewEnforcerFromDatastore(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+
+	db := getDatastore(t)
+	if err := SaveModelWithConfig(db, "examples/rbac_model.conf", config); err != nil {
+		t.Fatalf("Expected SaveModelWithConfig() to be successful; got %v", err)
+	}
+	e, err := NewEnforcerFromDatastore(context.Background(), db, config)
+	if err != nil {
+		t.Fatalf("Expected NewEnforcerFromDatastore() to be successful; got %v", err)
+	}
+	if ok, _ := e.Enforce("alice", "data2", "write"); !ok {
+		t.Error("got alice denied, wants the stored policy loaded")
+	}
+
+	config.Namespace = "unknown"
+	if _, err := NewEnforcerFromDatastore(context.Background(), db, config); err == nil {
+		t.Error("got no error, wants one for a missing model")
+	}
+}
+
+func TestSaveModelAndPolicy(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+
+	m, err := model.NewModelFromFile("examples/rbac_model.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.AddPolicy("p", "p", []string{"zoe", "data1", "read"})
+
+	db := getDatastore(t)
+	a := NewAdapterWithConfig(db, config)
+	result, err := a.SaveModelAndPolicy(context.Background(), m)
+	if err != nil {
+		t.Fatalf("Expected SaveModelAndPolicy() to be successful; got %v", err)
+	}
+	// The rules of the initial policy are deleted, as m holds only zoe's.
+	if result.Added != 1 || result.Deleted != 5 {
+		t.Errorf("got %+v, wants 1 added and 5 deleted", result)
+	}
+
+	e, err := NewEnforcerFromDatastore(context.Background(), db, config)
+	if err != nil {
+		t.Fatalf("Expected NewEnforcerFromDatastore() to be successful; got %v", err)
+	}
+	testGetPolicy(e, [][]string{{"zoe", "data1", "read"}}, func(actual, wants [][]string) {
+		t.Error("got: ", actual, ", wants ", wants)
+	})
+}
+
 func TestSaveInvalidFile(t *testing.T) {
-	db := getDatastore()
+	db := getDatastore(t)
 	config := Config{
 		Namespace: "unittest",
 	}
@@ -52,7 +105,7 @@ func TestSaveInvalidFile(t *testing.T) {
 }
 
 func TestLoadModelFail(t *testing.T) {
-	db := getDatastore()
+	db := getDatastore(t)
 	config := Config{
 		Namespace: "unknown",
 	}
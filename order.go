@@ -0,0 +1,186 @@
+package datastoreadapter
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// seqCounter is the root entity of the policy, holding the last sequence
+// number handed out. It has no ptype, which tells it apart from the rules,
+// see newQuery.
+type seqCounter struct {
+	Seq int64 `datastore:"seq,noindex"`
+}
+
+// putRules puts lines under keys within tx. If insert is set, it fails with
+// ErrAlreadyExists if any of the rules is already stored, instead of
+// overwriting it. With Config.InsertionOrder, rules already stored keep their
+// sequence number and new rules get the next ones, in the order of lines;
+// likewise with Config.CreatedProperty for their creation time.
+func (a *Adapter) putRules(ctx context.Context, tx *datastore.Transaction, keys []*datastore.Key, lines []*CasbinRule, insert bool) error {
+	var existing []ruleEntity
+	var found []bool
+	if insert || a.config.InsertionOrder || a.config.CreatedProperty != "" {
+		existing = make([]ruleEntity, len(keys))
+		found = make([]bool, len(keys))
+		err := tx.GetMulti(keys, existing)
+		if multi, ok := err.(datastore.MultiError); ok {
+			for i, e := range multi {
+				if e != nil && e != datastore.ErrNoSuchEntity {
+					return rulesError(err, lines)
+				}
+				found[i] = e == nil
+			}
+		} else if err != nil {
+			return err
+		} else {
+			for i := range found {
+				found[i] = true
+			}
+		}
+	}
+	if insert {
+		if err := alreadyExists(found, lines); err != nil {
+			return err
+		}
+	}
+
+	entities := make([]interface{}, len(lines))
+	for i, line := range lines {
+		entity := a.entity(ctx, line)
+		if err := a.checkEntitySize(keys[i], line, entity); err != nil {
+			return err
+		}
+		entities[i] = entity
+	}
+	if a.config.CreatedProperty != "" {
+		a.stampCreated(entities, existing, found, time.Now())
+	}
+	if a.config.InsertionOrder {
+		if err := a.sequence(ctx, tx, entities, existing, found); err != nil {
+			return err
+		}
+	}
+
+	if insert {
+		mutations := make([]*datastore.Mutation, len(keys))
+		for i, key := range keys {
+			mutations[i] = datastore.NewInsert(key, entities[i])
+		}
+		_, err := tx.Mutate(mutations...)
+		return rulesError(err, lines)
+	}
+	_, err := tx.PutMulti(keys, entities)
+	return rulesError(err, lines)
+}
+
+// stampCreated wraps entities with their creation time, see
+// Config.CreatedProperty: that of the existing entity if found and it has
+// one, else now.
+func (a *Adapter) stampCreated(entities []interface{}, existing []ruleEntity, found []bool, now time.Time) {
+	for i, entity := range entities {
+		created := now
+		if found[i] {
+			for _, p := range existing[i].extra {
+				if t, ok := p.Value.(time.Time); ok && p.Name == a.config.CreatedProperty {
+					created = t
+				}
+			}
+		}
+		property := datastore.Property{Name: a.config.CreatedProperty, Value: created, NoIndex: true}
+		entities[i] = &ruleEntity{PropertyLoadSaver: entity.(datastore.PropertyLoadSaver), extra: []datastore.Property{property}}
+	}
+}
+
+// sequence wraps entities with their sequence numbers: that of the existing
+// entity if found, else the next one of the counter.
+func (a *Adapter) sequence(ctx context.Context, tx *datastore.Transaction, entities []interface{}, existing []ruleEntity, found []bool) error {
+	// The counter lives in the base namespace, so that sequence numbers
+	// are comparable across Config.PTypeNamespaces.
+	rootKey := datastore.IDKey(a.config.Kind, 1, nil)
+	rootKey.Namespace = a.baseNamespace(ctx)
+	var counter seqCounter
+	if err := tx.Get(rootKey, &counter); err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	allocated := false
+	for i, entity := range entities {
+		seq := existing[i].Seq
+		if !found[i] {
+			counter.Seq++
+			seq = counter.Seq
+			allocated = true
+		}
+		entities[i] = &ruleEntity{PropertyLoadSaver: entity.(datastore.PropertyLoadSaver), Seq: seq}
+	}
+	if allocated {
+		if _, err := tx.Put(rootKey, &counter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// seqsKey is the context key of the ruleSeqs getRules records the sequence
+// numbers of the rules it returns in, with Config.InsertionOrder, so that
+// the results of several queries can be merged in creation order.
+type seqsKey struct{}
+
+// ruleSeqs are the sequence numbers of loaded rules. Queries of several
+// entity groups record them concurrently.
+type ruleSeqs struct {
+	mu   sync.Mutex
+	seqs map[*CasbinRule]int64
+}
+
+// recordSeqs returns ctx recording the sequence numbers of the rules its
+// queries load, if Config.InsertionOrder is set and it doesn't already.
+func (a *Adapter) recordSeqs(ctx context.Context) context.Context {
+	if !a.config.InsertionOrder {
+		return ctx
+	}
+	if _, ok := ctx.Value(seqsKey{}).(*ruleSeqs); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, seqsKey{}, &ruleSeqs{seqs: make(map[*CasbinRule]int64)})
+}
+
+// record records the sequence numbers of the rules of entities in the
+// ruleSeqs of ctx, if any.
+func record(ctx context.Context, entities []*ruleEntity) {
+	s, ok := ctx.Value(seqsKey{}).(*ruleSeqs)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range entities {
+		s.seqs[e.rule()] = e.Seq
+	}
+}
+
+// sortMerged orders the rules merged from several queries of ctx the way
+// each query orders its own: by sequence number with Config.InsertionOrder,
+// so that the rules of different entity groups and kinds interleave in
+// creation order, else by their fields with Config.SortOnLoad.
+func (a *Adapter) sortMerged(ctx context.Context, rules []*CasbinRule) {
+	if !a.config.InsertionOrder {
+		if a.config.SortOnLoad {
+			sortRules(rules)
+		}
+		return
+	}
+	s, ok := ctx.Value(seqsKey{}).(*ruleSeqs)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sort.SliceStable(rules, func(i, j int) bool {
+		return s.seqs[rules[i]] < s.seqs[rules[j]]
+	})
+}
@@ -0,0 +1,128 @@
+package datastoreadapter
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/casbin/casbin/v2"
+)
+
+func TestInsertionOrder(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+
+	config.InsertionOrder = true
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf", a)
+
+	e.AddPolicy("zoe", "data1", "read")
+	e.AddPolicies([][]string{{"carol", "data2", "read"}, {"bob", "data1", "read"}})
+	e.AddPolicy("alice", "data2", "read")
+	// Adding a stored rule again keeps its position.
+	e.AddPolicy("zoe", "data1", "read")
+
+	if err := e.LoadPolicy(); err != nil {
+		t.Fatalf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	actual, _ := e.GetPolicy()
+	// The rules of initPolicy have no seq and come first, in any order.
+	if len(actual) != 8 {
+		t.Fatalf("got: %v, wants 8 rules", actual)
+	}
+	wants := [][]string{{"zoe", "data1", "read"}, {"carol", "data2", "read"}, {"bob", "data1", "read"}, {"alice", "data2", "read"}}
+	if fmt.Sprint(actual[4:]) != fmt.Sprint(wants) {
+		t.Error("got: ", actual[4:], ", wants ", wants)
+	}
+}
+
+func TestInsertionOrderShards(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest", EntityGroupShards: 4}
+	initPolicy(t, config)
+
+	config.InsertionOrder = true
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf", a)
+
+	// The rules spread over the shards, which load concurrently.
+	var wants [][]string
+	for i := 20; i > 0; i-- {
+		rule := []string{fmt.Sprintf("user%d", i), "data1", "read"}
+		e.AddPolicy(rule)
+		wants = append(wants, rule)
+	}
+
+	if err := e.LoadPolicy(); err != nil {
+		t.Fatalf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	actual, _ := e.GetPolicy()
+	// The rules of initPolicy have no seq and come first, in any order.
+	if len(actual) != 24 {
+		t.Fatalf("got: %v, wants 24 rules", actual)
+	}
+	if fmt.Sprint(actual[4:]) != fmt.Sprint(wants) {
+		t.Error("got: ", actual[4:], ", wants ", wants)
+	}
+}
+
+func TestSortMerged(t *testing.T) {
+	a := &Adapter{config: withDefaults(Config{InsertionOrder: true})}
+	ctx := a.recordSeqs(context.Background())
+
+	// Two shards, each in order on its own.
+	shard1 := []*ruleEntity{
+		{PropertyLoadSaver: &CasbinRule{PType: "p", V0: "zoe"}, Seq: 1},
+		{PropertyLoadSaver: &CasbinRule{PType: "p", V0: "bob"}, Seq: 4},
+	}
+	shard2 := []*ruleEntity{
+		{PropertyLoadSaver: &CasbinRule{PType: "p", V0: "alice"}},
+		{PropertyLoadSaver: &CasbinRule{PType: "p", V0: "carol"}, Seq: 2},
+		{PropertyLoadSaver: &CasbinRule{PType: "p", V0: "dave"}, Seq: 3},
+	}
+	record(ctx, shard1)
+	record(ctx, shard2)
+	var rules []*CasbinRule
+	for _, e := range append(shard1, shard2...) {
+		rules = append(rules, e.rule())
+	}
+
+	a.sortMerged(ctx, rules)
+	var names []string
+	for _, rule := range rules {
+		names = append(names, rule.V0)
+	}
+	if wants := []string{"alice", "zoe", "carol", "dave", "bob"}; fmt.Sprint(names) != fmt.Sprint(wants) {
+		t.Errorf("got %v, wants %v", names, wants)
+	}
+}
+
+func TestStampCreated(t *testing.T) {
+	a := &Adapter{config: withDefaults(Config{CreatedProperty: "created"})}
+	earlier, now := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC), time.Now()
+	entities := []interface{}{&CasbinRule{V0: "alice"}, &CasbinRule{V0: "bob"}, &CasbinRule{V0: "carol"}}
+	existing := []ruleEntity{
+		{extra: []datastore.Property{{Name: "created", Value: earlier}}},
+		{},
+		{},
+	}
+	// bob is stored without a creation time, carol isn't stored.
+	a.stampCreated(entities, existing, []bool{true, true, false}, now)
+
+	for i, wants := range []time.Time{earlier, now, now} {
+		props, err := entities[i].(datastore.PropertyLoadSaver).Save()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var created interface{}
+		for _, p := range props {
+			if p.Name == "created" {
+				created = p.Value
+			}
+		}
+		if created != wants {
+			t.Errorf("got %v created for rule %d, wants %v", created, i, wants)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package datastoreadapter
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/casbin/casbin/v2"
+	"github.com/casbin/casbin/v2/model"
+)
+
+// StartAutoReload reloads the policy of e every interval until ctx is
+// cancelled. Reload errors are logged and don't stop the reloading, so a
+// transient Datastore failure keeps the previously loaded policy in place.
+// e is expected to use a as its adapter. It fails if interval isn't
+// positive.
+func (a *Adapter) StartAutoReload(ctx context.Context, e casbin.IEnforcer, interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("datastoreadapter: reload interval must be positive, got %v", interval)
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				if a.config.Debug {
+					a.logPrintln("[AutoReload] stopped:", ctx.Err())
+				}
+				return
+			case <-ticker.C:
+				if err := e.LoadPolicy(); err != nil {
+					a.logPrintln("[AutoReload] failed to reload policy:", err)
+				} else if a.config.Debug {
+					a.logPrintln("[AutoReload] policy reloaded")
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// DeltaEnforcer is the part of an enforcer ApplyPolicyDelta needs. casbin's
+// DistributedEnforcer implements it; its *Self methods change the policy
+// without writing the change back to the adapter.
+type DeltaEnforcer interface {
+	GetModel() model.Model
+	GetNamedPolicy(ptype string) ([][]string, error)
+	GetNamedGroupingPolicy(ptype string) ([][]string, error)
+	AddPoliciesSelf(shouldPersist func() bool, sec string, ptype string, rules [][]string) (affected [][]string, err error)
+	RemovePoliciesSelf(shouldPersist func() bool, sec string, ptype string, rules [][]string) (affected [][]string, err error)
+}
+
+// ApplyPolicyDelta updates the policy of e to the stored one by adding the
+// rules it lacks and then removing the ones no longer stored, instead of
+// clearing and reloading it, so that unchanged rules are enforced throughout.
+// It returns the number of rules added and removed.
+func (a *Adapter) ApplyPolicyDelta(ctx context.Context, e DeltaEnforcer) (added, removed int, err error) {
+	defer a.observe(ctx, "ApplyPolicyDelta", time.Now(), &err)
+	if a.config.Debug {
+		a.logPrintln("[ApplyPolicyDelta] called")
+	}
+
+	lines, err := a.queryNamespaces(ctx, func(ctx context.Context) *datastore.Query {
+		return a.projected(a.newQuery(ctx))
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	m := e.GetModel()
+	stored := make(map[string][][]string)
+	for _, line := range lines {
+		if !definesPType(m, line.PType) {
+			continue
+		}
+		if tokens := a.modelLine(line, m); tokens != nil {
+			stored[line.PType] = append(stored[line.PType], tokens[1:])
+		}
+	}
+
+	for _, sec := range []string{"p", "g"} {
+		for ptype := range m[sec] {
+			var current [][]string
+			if sec == "p" {
+				current, err = e.GetNamedPolicy(ptype)
+			} else {
+				current, err = e.GetNamedGroupingPolicy(ptype)
+			}
+			if err != nil {
+				return added, removed, err
+			}
+
+			toAdd := ruleDifference(stored[ptype], current)
+			toRemove := ruleDifference(current, stored[ptype])
+			if len(toAdd) > 0 {
+				affected, err := e.AddPoliciesSelf(nil, sec, ptype, toAdd)
+				added += len(affected)
+				if err != nil {
+					return added, removed, err
+				}
+			}
+			if len(toRemove) > 0 {
+				affected, err := e.RemovePoliciesSelf(nil, sec, ptype, toRemove)
+				removed += len(affected)
+				if err != nil {
+					return added, removed, err
+				}
+			}
+		}
+	}
+
+	if a.config.Debug {
+		a.logPrintln("[ApplyPolicyDelta] done:", added, "added,", removed, "removed")
+	}
+	return added, removed, nil
+}
+
+// ruleDifference returns the rules of a that aren't in b, ignoring trailing
+// empty fields.
+func ruleDifference(a, b [][]string) [][]string {
+	name := func(rule []string) string {
+		line := savePolicyLine("", rule)
+		return line.String()
+	}
+
+	in := make(map[string]bool, len(b))
+	for _, rule := range b {
+		in[name(rule)] = true
+	}
+	var diff [][]string
+	for _, rule := range a {
+		if !in[name(rule)] {
+			diff = append(diff, rule)
+		}
+	}
+	return diff
+}
@@ -0,0 +1,89 @@
+package datastoreadapter
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/casbin/casbin/v2"
+)
+
+func TestStartAutoReloadInterval(t *testing.T) {
+	a := &Adapter{config: withDefaults(Config{})}
+	e, _ := casbin.NewSyncedEnforcer("examples/rbac_model.conf", "examples/rbac_policy.csv")
+	if err := a.StartAutoReload(context.Background(), e, 0); err == nil {
+		t.Error("Expected StartAutoReload() without an interval to fail")
+	}
+}
+
+func TestStartAutoReload(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	// The reload runs concurrently with the checks below.
+	e, _ := casbin.NewSyncedEnforcer("examples/rbac_model.conf", a)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := a.StartAutoReload(ctx, e, 100*time.Millisecond); err != nil {
+		t.Fatalf("Expected StartAutoReload() to be successful; got %v", err)
+	}
+
+	// Write through a second adapter so only a reload makes the rule visible.
+	other := NewAdapterWithConfig(getDatastore(t), config)
+	if err := other.AddPolicy("p", "p", []string{"alice", "data1", "write"}); err != nil {
+		t.Fatalf("Expected AddPolicy() to be successful; got %v", err)
+	}
+	defer other.RemovePolicy("p", "p", []string{"alice", "data1", "write"})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if ok, _ := e.HasPolicy("alice", "data1", "write"); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("policy was not reloaded")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestRuleDifference(t *testing.T) {
+	a := [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write", ""}}
+	b := [][]string{{"bob", "data2", "write"}}
+	if diff := ruleDifference(a, b); !SamePolicy(diff, [][]string{{"alice", "data1", "read"}}) {
+		t.Errorf("got %v, wants only alice's rule", diff)
+	}
+	if diff := ruleDifference(b, a); len(diff) != 0 {
+		t.Errorf("got %v, wants none", diff)
+	}
+}
+
+func TestApplyPolicyDelta(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	e, _ := casbin.NewDistributedEnforcer("examples/rbac_model.conf", a)
+
+	other := NewAdapterWithConfig(getDatastore(t), config)
+	other.AddPolicy("p", "p", []string{"alice", "data1", "write"})
+	other.RemovePolicy("p", "p", []string{"bob", "data2", "write"})
+	other.RemovePolicy("g", "g", []string{"alice", "data2_admin"})
+	defer initPolicy(t, config)
+
+	added, removed, err := a.ApplyPolicyDelta(context.Background(), e)
+	if err != nil {
+		t.Fatalf("Expected ApplyPolicyDelta() to be successful; got %v", err)
+	}
+	if added != 1 || removed != 2 {
+		t.Errorf("got %d added and %d removed, wants 1 and 2", added, removed)
+	}
+	testGetPolicy(e.Enforcer, [][]string{{"alice", "data1", "read"}, {"alice", "data1", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}}, func(actual, wants [][]string) {
+		t.Error("got: ", actual, ", wants ", wants)
+	})
+	if ok, _ := e.Enforce("alice", "data2", "read"); ok {
+		t.Errorf("Expected the removed role to be unlinked")
+	}
+}
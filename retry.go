@@ -0,0 +1,121 @@
+package datastoreadapter
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// maxAttempts is how many times a retriable operation is tried.
+	maxAttempts = 3
+	// initialBackoff is the wait before the first retry; it doubles on
+	// every further retry.
+	initialBackoff = 100 * time.Millisecond
+	// quotaBackoff is the wait before the first retry of a quota error
+	// without a RetryInfo, which only clears once the rate drops; it doubles
+	// like initialBackoff.
+	quotaBackoff = time.Second
+)
+
+// DefaultIsRetriable reports whether err is a transient Datastore error:
+// Unavailable, DeadlineExceeded or ResourceExhausted, the code of exceeded
+// quotas. It is used when Config.IsRetriable is nil.
+func DefaultIsRetriable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted:
+		return true
+	default:
+		return false
+	}
+}
+
+// retry runs op with the adapter's client until it succeeds, fails with an
+// error that isn't retriable, maxAttempts is reached or ctx is done. A retry
+// that would only start after the deadline of ctx isn't attempted.
+func (a *Adapter) retry(ctx context.Context, op func(db *datastore.Client) error) error {
+	isRetriable := a.config.IsRetriable
+	if isRetriable == nil {
+		isRetriable = DefaultIsRetriable
+	}
+
+	backoff := initialBackoff
+	for attempt := 1; ; attempt++ {
+		db, err := a.client(ctx)
+		if err == nil {
+			err = a.limited(ctx, func() error { return op(db) })
+		}
+		if err == nil || attempt == maxAttempts || !isRetriable(err) {
+			return err
+		}
+		wait := a.retryDelay(err, backoff)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return err
+		}
+		if a.config.Debug {
+			a.logPrintln("[retry] attempt", attempt, "failed:", err, "- retrying in", wait)
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		backoff *= 2
+	}
+}
+
+// retryDelay returns how long to wait before retrying after err, where
+// backoff is the wait for a generic transient error. The wait returned by
+// Config.RetryAfter takes precedence, then the one the server asks for in
+// the RetryInfo of the status details of err; quota errors otherwise wait
+// quotaBackoff/initialBackoff times longer.
+func (a *Adapter) retryDelay(err error, backoff time.Duration) time.Duration {
+	if a.config.RetryAfter != nil {
+		if wait := a.config.RetryAfter(err); wait > 0 {
+			return wait
+		}
+	}
+	if wait, ok := retryInfoDelay(err); ok {
+		return wait
+	}
+	if status.Code(err) == codes.ResourceExhausted {
+		return backoff * (quotaBackoff / initialBackoff)
+	}
+	return backoff
+}
+
+// retryInfoDelay returns the retry delay of the RetryInfo in the status
+// details of err, and whether there is a positive one.
+func retryInfoDelay(err error) (time.Duration, bool) {
+	s, ok := status.FromError(err)
+	if !ok {
+		return 0, false
+	}
+	for _, detail := range s.Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok && info.GetRetryDelay() != nil {
+			wait := info.GetRetryDelay().AsDuration()
+			return wait, wait > 0
+		}
+	}
+	return 0, false
+}
+
+// limited runs op once a slot of Config.MaxConcurrency is free, or fails
+// with the error of ctx if it is done first.
+func (a *Adapter) limited(ctx context.Context, op func() error) error {
+	if a.slots == nil {
+		return op()
+	}
+	select {
+	case a.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-a.slots }()
+	return op()
+}
@@ -0,0 +1,159 @@
+package datastoreadapter
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+func TestDefaultIsRetriable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{status.Error(codes.Unavailable, "unavailable"), true},
+		{status.Error(codes.DeadlineExceeded, "deadline"), true},
+		{status.Error(codes.ResourceExhausted, "quota exceeded"), true},
+		{status.Error(codes.Aborted, "aborted"), false},
+		{status.Error(codes.InvalidArgument, "invalid"), false},
+		{errors.New("plain"), false},
+	}
+	for _, tt := range tests {
+		if got := DefaultIsRetriable(tt.err); got != tt.want {
+			t.Errorf("DefaultIsRetriable(%v) = %v, wants %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	unavailable := status.Error(codes.Unavailable, "unavailable")
+	aborted := status.Error(codes.Aborted, "aborted")
+
+	tests := []struct {
+		name        string
+		isRetriable func(error) bool
+		errs        []error
+		wantCalls   int
+		wantErr     error
+	}{
+		{"success", nil, []error{nil}, 1, nil},
+		{"transient", nil, []error{unavailable, nil}, 2, nil},
+		{"gives up", nil, []error{unavailable, unavailable, unavailable}, maxAttempts, unavailable},
+		{"not retriable", nil, []error{aborted}, 1, aborted},
+		{"custom", func(err error) bool { return status.Code(err) == codes.Aborted }, []error{aborted, nil}, 2, nil},
+	}
+	for _, tt := range tests {
+		a := &Adapter{config: Config{IsRetriable: tt.isRetriable}}
+		calls := 0
+		err := a.retry(context.Background(), func(*datastore.Client) error {
+			err := tt.errs[calls]
+			calls++
+			return err
+		})
+		if err != tt.wantErr {
+			t.Errorf("%s: got error %v, wants %v", tt.name, err, tt.wantErr)
+		}
+		if calls != tt.wantCalls {
+			t.Errorf("%s: got %d calls, wants %d", tt.name, calls, tt.wantCalls)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	unavailable := status.Error(codes.Unavailable, "unavailable")
+	quota := status.Error(codes.ResourceExhausted, "quota exceeded")
+
+	a := &Adapter{}
+	if got := a.retryDelay(unavailable, 2*initialBackoff); got != 2*initialBackoff {
+		t.Errorf("got %v, wants %v", got, 2*initialBackoff)
+	}
+	if got := a.retryDelay(quota, 2*initialBackoff); got != 2*quotaBackoff {
+		t.Errorf("got %v, wants %v for a quota error", got, 2*quotaBackoff)
+	}
+	hinted, detailsErr := status.New(codes.ResourceExhausted, "quota exceeded").WithDetails(&errdetails.RetryInfo{
+		RetryDelay: durationpb.New(7 * time.Second),
+	})
+	if detailsErr != nil {
+		t.Fatal(detailsErr)
+	}
+	if got := a.retryDelay(hinted.Err(), initialBackoff); got != 7*time.Second {
+		t.Errorf("got %v, wants the 7s of the RetryInfo", got)
+	}
+
+	a.config.RetryAfter = func(err error) time.Duration {
+		if err == quota {
+			return 30 * time.Second
+		}
+		return 0
+	}
+	if got := a.retryDelay(quota, initialBackoff); got != 30*time.Second {
+		t.Errorf("got %v, wants the hinted 30s", got)
+	}
+	if got := a.retryDelay(unavailable, initialBackoff); got != initialBackoff {
+		t.Errorf("got %v, wants %v without a hint", got, initialBackoff)
+	}
+
+	// A retry past the deadline fails right away instead of waiting.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	calls := 0
+	start := time.Now()
+	err := a.retry(ctx, func(*datastore.Client) error {
+		calls++
+		return quota
+	})
+	if err != quota || calls != 1 || time.Since(start) > 100*time.Millisecond {
+		t.Errorf("got %v after %d calls in %v, wants %v after 1 call at once", err, calls, time.Since(start), quota)
+	}
+}
+
+func TestMaxConcurrency(t *testing.T) {
+	a := newAdapter(nil, Config{MaxConcurrency: 2})
+	var mu sync.Mutex
+	inFlight, peak := 0, 0
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.retry(context.Background(), func(*datastore.Client) error {
+				mu.Lock()
+				inFlight++
+				if inFlight > peak {
+					peak = inFlight
+				}
+				mu.Unlock()
+				time.Sleep(10 * time.Millisecond)
+				mu.Lock()
+				inFlight--
+				mu.Unlock()
+				return nil
+			})
+		}()
+	}
+	wg.Wait()
+	if peak != 2 {
+		t.Errorf("got %d operations in flight, wants at most 2", peak)
+	}
+
+	// Waiting for a slot ends with the context.
+	a.slots <- struct{}{}
+	a.slots <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := a.retry(ctx, func(*datastore.Client) error {
+		t.Error("Expected the operation to wait for a slot")
+		return nil
+	})
+	if err != context.DeadlineExceeded {
+		t.Errorf("got %v, wants %v", err, context.DeadlineExceeded)
+	}
+}
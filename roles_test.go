@@ -0,0 +1,35 @@
+package datastoreadapter
+
+import (
+	"context"
+	"testing"
+
+	defaultrolemanager "github.com/casbin/casbin/v2/rbac/default-role-manager"
+)
+
+func TestLoadRoleLinks(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	if err := a.AddPolicy("g", "g", []string{"bob", "data2_admin"}); err != nil {
+		t.Fatalf("Expected AddPolicy() to be successful; got %v", err)
+	}
+
+	rm := defaultrolemanager.NewRoleManager(10)
+	n, err := a.LoadRoleLinks(context.Background(), "g", rm)
+	if err != nil {
+		t.Fatalf("Expected LoadRoleLinks() to be successful; got %v", err)
+	}
+	if n != 2 {
+		t.Errorf("got %d links, wants 2", n)
+	}
+	for _, user := range []string{"alice", "bob"} {
+		if ok, _ := rm.HasLink(user, "data2_admin"); !ok {
+			t.Errorf("got no link from %s to data2_admin", user)
+		}
+	}
+	if ok, _ := rm.HasLink("data2_admin", "alice"); ok {
+		t.Error("got a link from data2_admin to alice")
+	}
+}
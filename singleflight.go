@@ -0,0 +1,44 @@
+package datastoreadapter
+
+import "context"
+
+// loadCall is a load in flight, shared by the LoadPolicy calls arriving
+// while it runs, see Config.SingleFlightLoad.
+type loadCall struct {
+	done      chan struct{}
+	rules     []*CasbinRule
+	truncated bool
+	err       error
+}
+
+// sharedLoad runs load, unless a load for namespace is already in flight, in
+// which case it waits for that one's result instead. A waiting caller whose
+// ctx ends stops waiting; the load itself is bound to the context of the
+// caller that started it.
+func (a *Adapter) sharedLoad(ctx context.Context, namespace string, load loadFunc) ([]*CasbinRule, bool, error) {
+	a.loadMu.Lock()
+	if call, ok := a.loads[namespace]; ok {
+		a.loadMu.Unlock()
+		select {
+		case <-call.done:
+			return call.rules, call.truncated, call.err
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+	}
+	call := &loadCall{done: make(chan struct{})}
+	if a.loads == nil {
+		a.loads = make(map[string]*loadCall)
+	}
+	a.loads[namespace] = call
+	a.loadMu.Unlock()
+
+	call.rules, call.truncated, call.err = load()
+
+	a.loadMu.Lock()
+	delete(a.loads, namespace)
+	a.loadMu.Unlock()
+	close(call.done)
+
+	return call.rules, call.truncated, call.err
+}
@@ -0,0 +1,56 @@
+package datastoreadapter
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSharedLoad(t *testing.T) {
+	a := &Adapter{}
+	var calls int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	load := func() ([]*CasbinRule, bool, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(started)
+		}
+		<-release
+		return []*CasbinRule{{PType: "p", V0: "alice"}}, true, nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([][]*CasbinRule, 10)
+	truncated := make([]bool, len(results))
+	call := func(i int) {
+		defer wg.Done()
+		results[i], truncated[i], _ = a.sharedLoad(context.Background(), "ns", load)
+	}
+	wg.Add(len(results))
+	go call(0)
+	<-started
+	for i := 1; i < len(results); i++ {
+		go call(i)
+	}
+	// Give the other calls time to join the load in flight.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("got %d loads, wants 1", calls)
+	}
+	for i, rules := range results {
+		if len(rules) != 1 || rules[0].V0 != "alice" || !truncated[i] {
+			t.Errorf("call %d got %v, truncated %v, wants the shared result", i, rules, truncated[i])
+		}
+	}
+
+	// A finished load isn't reused.
+	a.sharedLoad(context.Background(), "ns", load)
+	if calls != 2 {
+		t.Errorf("got %d loads, wants 2", calls)
+	}
+}
@@ -0,0 +1,135 @@
+package datastoreadapter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// snapshotKindSuffix is appended to Config.Kind for the kind of the
+// snapshots written with Config.SnapshotRetention, so that loads never read
+// them.
+const snapshotKindSuffix = "_snapshot"
+
+// policySnapshot is the entity of a snapshot: the rules of a saved policy,
+// each with its ptype first, as gzip-compressed JSON.
+type policySnapshot struct {
+	Time time.Time `datastore:"time"`
+	Data []byte    `datastore:"data,noindex"`
+}
+
+// snapshotKind returns the kind of the adapter's snapshots.
+func (a *Adapter) snapshotKind() string {
+	return a.config.Kind + snapshotKindSuffix
+}
+
+// writeSnapshot stores a snapshot of lines, the rules just saved, in the
+// namespace of ctx and deletes the snapshots beyond Config.SnapshotRetention.
+func (a *Adapter) writeSnapshot(ctx context.Context, lines []*CasbinRule) error {
+	rules := make([][]string, len(lines))
+	for i, line := range lines {
+		rules[i] = trimTrailingEmpty(line.fields())
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(rules); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	// Zero-padded nanoseconds make key names sort by time.
+	key := datastore.NameKey(a.snapshotKind(), fmt.Sprintf("%020d", now.UnixNano()), nil)
+	key.Namespace = a.baseNamespace(ctx)
+	snapshot := policySnapshot{Time: now, Data: buf.Bytes()}
+	if size := len(snapshot.Data); size > a.config.MaxEntitySize {
+		return fmt.Errorf("%w: snapshot of %d compressed bytes, the limit is %d", ErrEntityTooLarge, size, a.config.MaxEntitySize)
+	}
+
+	return a.retry(ctx, func(db *datastore.Client) error {
+		if _, err := db.Put(ctx, key, &snapshot); err != nil {
+			return err
+		}
+		query := datastore.NewQuery(a.snapshotKind()).Namespace(key.Namespace).Order("-time").KeysOnly()
+		keys, err := db.GetAll(ctx, query, nil)
+		if err != nil || len(keys) <= a.config.SnapshotRetention {
+			return err
+		}
+		return db.DeleteMulti(ctx, keys[a.config.SnapshotRetention:])
+	})
+}
+
+// RestoreSnapshot replaces the stored policy with the latest snapshot taken
+// at or before at, see Config.SnapshotRetention, e.g. to undo a SavePolicy.
+// It fails with ErrNoSnapshot if there is none. Like SavePolicy, only the
+// difference is written, in one transaction unless it is too large for one.
+// The snapshot's rules are restored as stored, without Config.SaveTransform.
+// Enforcers must reload the policy to see the restored rules.
+func (a *Adapter) RestoreSnapshot(ctx context.Context, at time.Time) (err error) {
+	defer a.observe(ctx, "RestoreSnapshot", time.Now(), &err)
+	if err := a.checkWritable(); err != nil {
+		return err
+	}
+
+	ctx, cancel := withDeadline(ctx, a.config.LoadSaveFilterDeadline)
+	defer cancel()
+	if a.config.Debug {
+		a.logPrintln("[RestoreSnapshot] called:", at)
+	}
+
+	var snapshots []policySnapshot
+	query := datastore.NewQuery(a.snapshotKind()).Namespace(a.baseNamespace(ctx)).
+		Filter("time <=", at).Order("-time").Limit(1)
+	err = a.retry(ctx, func(db *datastore.Client) error {
+		snapshots = nil
+		_, err := db.GetAll(ctx, query, &snapshots)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if len(snapshots) == 0 {
+		return fmt.Errorf("%w at or before %s", ErrNoSnapshot, at.Format(time.RFC3339))
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(snapshots[0].Data))
+	if err != nil {
+		return fmt.Errorf("datastoreadapter: reading snapshot of %s: %w", snapshots[0].Time.Format(time.RFC3339), err)
+	}
+	data, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return fmt.Errorf("datastoreadapter: reading snapshot of %s: %w", snapshots[0].Time.Format(time.RFC3339), err)
+	}
+	var rules [][]string
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return fmt.Errorf("datastoreadapter: reading snapshot of %s: %w", snapshots[0].Time.Format(time.RFC3339), err)
+	}
+
+	wanted := make(map[string]*CasbinRule)
+	var order []string
+	for _, rule := range rules {
+		if len(rule) == 0 {
+			continue
+		}
+		line := savePolicyLine(rule[0], rule[1:])
+		if order, err = a.addWanted(wanted, order, &line); err != nil {
+			return err
+		}
+	}
+	m := Mutation{Op: "RestoreSnapshot"}
+	if err := a.beforeMutate(ctx, m); err != nil {
+		return err
+	}
+	defer a.afterMutate(ctx, m, &err)
+
+	_, err = a.saveRules(ctx, wanted, order, a.storedRules)
+	return err
+}
@@ -0,0 +1,63 @@
+package datastoreadapter
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/casbin/casbin/v2"
+)
+
+func TestRestoreSnapshot(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest", SnapshotRetention: 2}
+	initPolicy(t, config)
+
+	ctx := context.Background()
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	if err := a.RestoreSnapshot(ctx, time.Now()); !errors.Is(err, ErrNoSnapshot) {
+		t.Errorf("got %v, wants %v", err, ErrNoSnapshot)
+	}
+
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	if err := e.SavePolicy(); err != nil {
+		t.Fatalf("Expected SavePolicy() to be successful; got %v", err)
+	}
+	saved := time.Now()
+	var carolSaved time.Time
+	for _, rule := range [][]string{{"carol", "data1", "read"}, {"dave", "data1", "read"}} {
+		time.Sleep(time.Millisecond)
+		if _, err := e.AddPolicy(rule); err != nil {
+			t.Fatal(err)
+		}
+		if err := e.SavePolicy(); err != nil {
+			t.Fatalf("Expected SavePolicy() to be successful; got %v", err)
+		}
+		if carolSaved.IsZero() {
+			carolSaved = time.Now()
+		}
+	}
+
+	keys, err := getDatastore(t).GetAll(ctx, datastore.NewQuery(a.snapshotKind()).Namespace(config.Namespace).KeysOnly(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Errorf("got %d snapshots, wants 2", len(keys))
+	}
+	// The snapshot of the first save was deleted.
+	if err := a.RestoreSnapshot(ctx, saved); !errors.Is(err, ErrNoSnapshot) {
+		t.Errorf("got %v, wants %v", err, ErrNoSnapshot)
+	}
+
+	if err := a.RestoreSnapshot(ctx, carolSaved); err != nil {
+		t.Fatalf("Expected RestoreSnapshot() to be successful; got %v", err)
+	}
+	if err := e.LoadPolicy(); err != nil {
+		t.Fatalf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}, {"carol", "data1", "read"}}, func(actual, wants [][]string) {
+		t.Error("got: ", actual, ", wants ", wants)
+	})
+}
@@ -0,0 +1,170 @@
+package datastoreadapter
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// stagedMutation is a write recorded between Begin and Commit.
+type stagedMutation struct {
+	key    *datastore.Key
+	line   *CasbinRule
+	delete bool
+}
+
+// staging holds the mutations recorded since Begin, in order, keeping only
+// the last mutation of each entity, see stagedID, and the namespaces whose
+// caches Commit drops, see baseNamespace.
+type staging struct {
+	order      []string
+	mutations  map[string]stagedMutation
+	namespaces map[string]bool
+}
+
+// Begin starts staging: until Commit or Rollback, AddPolicy, AddPolicies,
+// RemovePolicy, RemovePolicies, UpdatePolicy and UpdatePolicies only record
+// their mutations instead of writing them. RemoveFilteredPolicy,
+// UpdateFilteredPolicies and SavePolicy are not staged.
+func (a *Adapter) Begin() error {
+	a.stageMu.Lock()
+	defer a.stageMu.Unlock()
+
+	if a.staged != nil {
+		return ErrAlreadyStaging
+	}
+	a.staged = &staging{mutations: make(map[string]stagedMutation), namespaces: make(map[string]bool)}
+	return nil
+}
+
+// Rollback discards the mutations staged since Begin and stops staging.
+func (a *Adapter) Rollback() {
+	a.stageMu.Lock()
+	defer a.stageMu.Unlock()
+
+	a.staged = nil
+}
+
+func (a *Adapter) Commit() error {
+	return a.CommitCtx(context.Background())
+}
+
+// CommitCtx writes the mutations staged since Begin in a single transaction
+// and stops staging. Staging also stops if the commit fails, in which case
+// none of the mutations is written.
+func (a *Adapter) CommitCtx(ctx context.Context) (err error) {
+	defer a.observe(ctx, "Commit", time.Now(), &err)
+	a.stageMu.Lock()
+	staged := a.staged
+	a.staged = nil
+	a.stageMu.Unlock()
+
+	if staged == nil {
+		return ErrNotStaging
+	}
+	if len(staged.order) > maxPutsPerTx {
+		return fmt.Errorf("%w: %d staged mutations, the limit is %d",
+			ErrTooManyMutations, len(staged.order), maxPutsPerTx)
+	}
+	if len(staged.order) == 0 {
+		return nil
+	}
+
+	ctx, cancel := withDeadline(ctx, a.config.LoadSaveFilterDeadline)
+	defer cancel()
+
+	if a.config.Debug {
+		a.logPrintln("[Commit] called:", len(staged.order), "mutations")
+	}
+
+	// Only the last mutation of each key is staged, so the order between
+	// puts and deletes doesn't matter.
+	var putKeys, deleteKeys []*datastore.Key
+	var putLines []*CasbinRule
+	for _, name := range staged.order {
+		m := staged.mutations[name]
+		if m.delete {
+			deleteKeys = append(deleteKeys, m.key)
+		} else {
+			putKeys = append(putKeys, m.key)
+			putLines = append(putLines, m.line)
+		}
+	}
+
+	err = a.retry(ctx, func(db *datastore.Client) error {
+		_, err := db.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+			if len(deleteKeys) > 0 {
+				if err := tx.DeleteMulti(deleteKeys); err != nil {
+					return err
+				}
+			}
+			if len(putKeys) == 0 {
+				return nil
+			}
+			return a.putRules(ctx, tx, putKeys, putLines, a.config.InsertOnly)
+		})
+		return insertConflict(err, putLines)
+	})
+	if err != nil {
+		return err
+	}
+	for namespace := range staged.namespaces {
+		a.invalidateNamespace(namespace)
+	}
+
+	if a.config.Publisher == nil {
+		return nil
+	}
+	events := make([]PolicyEvent, 0, len(staged.order))
+	for _, name := range staged.order {
+		m := staged.mutations[name]
+		event := PolicyEvent{Op: "AddPolicy", Namespace: m.key.Namespace, PType: m.line.PType, Rule: trimTrailingEmpty(m.line.fields()[1:])}
+		if m.delete {
+			event.Op = "RemovePolicy"
+		}
+		events = append(events, event)
+	}
+	return a.publish(ctx, events)
+}
+
+// isStaging reports whether writes are being staged, see Begin.
+func (a *Adapter) isStaging() bool {
+	a.stageMu.Lock()
+	defer a.stageMu.Unlock()
+	return a.staged != nil
+}
+
+// stage records a mutation of the namespace of ctx if staging is active,
+// and reports whether it did.
+func (a *Adapter) stage(ctx context.Context, key *datastore.Key, line *CasbinRule, delete bool) bool {
+	return a.stageAll(ctx, []*datastore.Key{key}, []*CasbinRule{line}, delete)
+}
+
+// stageAll records a mutation of the namespace of ctx per key if staging is
+// active, and reports whether it did.
+func (a *Adapter) stageAll(ctx context.Context, keys []*datastore.Key, lines []*CasbinRule, delete bool) bool {
+	a.stageMu.Lock()
+	defer a.stageMu.Unlock()
+
+	if a.staged == nil {
+		return false
+	}
+	a.staged.namespaces[a.baseNamespace(ctx)] = true
+	for i, key := range keys {
+		id := stagedID(key)
+		if _, ok := a.staged.mutations[id]; !ok {
+			a.staged.order = append(a.staged.order, id)
+		}
+		a.staged.mutations[id] = stagedMutation{key: key, line: lines[i], delete: delete}
+	}
+	return true
+}
+
+// stagedID identifies the entity of key among the staged mutations, which
+// may span namespaces, kinds and ancestors. Key.String leaves out the
+// namespace, which can't contain the '/' the path starts with.
+func stagedID(key *datastore.Key) string {
+	return key.Namespace + key.String()
+}
@@ -0,0 +1,133 @@
+package datastoreadapter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/casbin/casbin/v2"
+)
+
+func TestStaging(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	original := [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}}
+
+	if err := a.Commit(); err == nil {
+		t.Errorf("Expected Commit() without Begin() to fail")
+	}
+
+	// Rolled back mutations are never written.
+	if err := a.Begin(); err != nil {
+		t.Fatalf("Expected Begin() to be successful; got %v", err)
+	}
+	if err := a.Begin(); err == nil {
+		t.Errorf("Expected a nested Begin() to fail")
+	}
+	e.AddPolicy("alice", "data1", "write")
+	a.Rollback()
+	if err := e.LoadPolicy(); err != nil {
+		t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(e, original, func(actual, wants [][]string) {
+		t.Error("got: ", actual, ", wants ", wants)
+	})
+
+	// Committed mutations are written together.
+	if err := a.Begin(); err != nil {
+		t.Fatalf("Expected Begin() to be successful; got %v", err)
+	}
+	e.AddPolicy("alice", "data1", "write")
+	e.AddPolicies([][]string{{"carol", "data1", "read"}, {"carol", "data2", "read"}})
+	e.RemovePolicy("bob", "data2", "write")
+	e.RemovePolicy("carol", "data2", "read")
+
+	// Nothing is visible before the commit.
+	other := NewAdapterWithConfig(getDatastore(t), config)
+	e2, _ := casbin.NewEnforcer("examples/rbac_model.conf", other)
+	testGetPolicy(e2, original, func(actual, wants [][]string) {
+		t.Error("got: ", actual, ", wants ", wants)
+	})
+
+	if err := a.Commit(); err != nil {
+		t.Fatalf("Expected Commit() to be successful; got %v", err)
+	}
+	if err := e2.LoadPolicy(); err != nil {
+		t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(e2, [][]string{{"alice", "data1", "read"}, {"alice", "data1", "write"}, {"carol", "data1", "read"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}}, func(actual, wants [][]string) {
+		t.Error("got: ", actual, ", wants ", wants)
+	})
+}
+
+func TestCommitLimit(t *testing.T) {
+	a := &Adapter{config: withDefaults(Config{})}
+	if err := a.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	// A full transaction leaves no room for the InsertionOrder counter.
+	rules := make([][]string, maxMutationsPerTx)
+	for i := range rules {
+		rules[i] = []string{fmt.Sprintf("user%d", i), "data1", "read"}
+	}
+	if err := a.AddPolicies("p", "p", rules); err != nil {
+		t.Fatalf("Expected AddPolicies() to be successful; got %v", err)
+	}
+	if err := a.Commit(); !errors.Is(err, ErrTooManyMutations) {
+		t.Errorf("got %v, wants %v", err, ErrTooManyMutations)
+	}
+}
+
+func TestStagingNamespaces(t *testing.T) {
+	a := &Adapter{config: withDefaults(Config{})}
+	if err := a.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	defer a.Rollback()
+
+	// The same rule of two tenants is two entities.
+	for _, ns := range []string{"a", "b"} {
+		ctx := ContextWithNamespace(context.Background(), ns)
+		if err := a.AddPolicyCtx(ctx, "p", "p", []string{"alice", "data1", "read"}); err != nil {
+			t.Fatalf("Expected AddPolicyCtx() to be successful; got %v", err)
+		}
+	}
+	if n := len(a.staged.order); n != 2 {
+		t.Errorf("got %d staged mutations, wants one per namespace", n)
+	}
+}
+
+func TestCommitNamespaces(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+	initPolicy(t, Config{Kind: config.Kind, Namespace: "unittest2"})
+
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	if err := a.Begin(); err != nil {
+		t.Fatalf("Expected Begin() to be successful; got %v", err)
+	}
+	for _, ns := range []string{"unittest", "unittest2"} {
+		ctx := ContextWithNamespace(context.Background(), ns)
+		if err := a.AddPolicyCtx(ctx, "p", "p", []string{"carol", "data1", "read"}); err != nil {
+			t.Fatalf("Expected AddPolicyCtx() to be successful; got %v", err)
+		}
+	}
+	if err := a.Commit(); err != nil {
+		t.Fatalf("Expected Commit() to be successful; got %v", err)
+	}
+
+	for _, ns := range []string{"unittest", "unittest2"} {
+		ctx := ContextWithNamespace(context.Background(), ns)
+		rules, err := a.QueryPolicy(ctx, "p", 0, "carol")
+		if err != nil {
+			t.Fatalf("Expected QueryPolicy() to be successful; got %v", err)
+		}
+		if !SamePolicy(rules, [][]string{{"carol", "data1", "read"}}) {
+			t.Errorf("got %v in namespace %s, wants carol's rule", rules, ns)
+		}
+	}
+}
@@ -0,0 +1,540 @@
+package datastoreadapter
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	// StorageFormatFields stores every field of a rule in its own indexed
+	// property (ptype, v0 to v5), keyed by the rule's String().
+	StorageFormatFields = "fields"
+	// StorageFormatCSV stores a rule as its indexed ptype plus a single
+	// unindexed "rule" property holding the rule's String(), keyed by a hash
+	// of it. Filtered operations can't be served by Datastore in this
+	// format; they load all rules of the ptype and filter in memory.
+	StorageFormatCSV = "csv"
+)
+
+const (
+	// ChecksumSkip skips rules whose checksum doesn't match their fields,
+	// logging a warning.
+	ChecksumSkip = "skip"
+	// ChecksumError fails loads with ErrChecksumMismatch on rules whose
+	// checksum doesn't match their fields.
+	ChecksumError = "error"
+)
+
+const (
+	// DuplicateSkip saves only the first of rules mapping to the same key,
+	// logging the others.
+	DuplicateSkip = "skip"
+	// DuplicateError fails saves of rules mapping to the same key with
+	// ErrDuplicateRule.
+	DuplicateError = "error"
+)
+
+// checksumProperty is the unindexed property holding a rule's checksum.
+const checksumProperty = "checksum"
+
+// Load implements datastore.PropertyLoadSaver. It reads both storage formats,
+// and ignores properties it doesn't know.
+func (cr *CasbinRule) Load(props []datastore.Property) error {
+	for _, p := range props {
+		v, _ := p.Value.(string)
+		switch p.Name {
+		case "ptype":
+			cr.PType = v
+		case "v0":
+			cr.V0 = v
+		case "v1":
+			cr.V1 = v
+		case "v2":
+			cr.V2 = v
+		case "v3":
+			cr.V3 = v
+		case "v4":
+			cr.V4 = v
+		case "v5":
+			cr.V5 = v
+		case "rule":
+			*cr = *ParseString(v)
+			return nil
+		}
+	}
+	return nil
+}
+
+// Save implements datastore.PropertyLoadSaver, writing StorageFormatFields.
+func (cr *CasbinRule) Save() ([]datastore.Property, error) {
+	return []datastore.Property{
+		{Name: "ptype", Value: cr.PType},
+		{Name: "v0", Value: cr.V0},
+		{Name: "v1", Value: cr.V1},
+		{Name: "v2", Value: cr.V2},
+		{Name: "v3", Value: cr.V3},
+		{Name: "v4", Value: cr.V4},
+		{Name: "v5", Value: cr.V5},
+	}, nil
+}
+
+// csvRule saves a rule in StorageFormatCSV.
+type csvRule struct {
+	*CasbinRule
+}
+
+func (r *csvRule) Load(props []datastore.Property) error {
+	if r.CasbinRule == nil {
+		r.CasbinRule = &CasbinRule{}
+	}
+	return r.CasbinRule.Load(props)
+}
+
+func (r *csvRule) Save() ([]datastore.Property, error) {
+	return []datastore.Property{
+		{Name: "ptype", Value: r.PType},
+		{Name: "rule", Value: r.String(), NoIndex: true},
+	}, nil
+}
+
+// ruleEntity is a rule entity with properties beyond the rule's fields.
+type ruleEntity struct {
+	datastore.PropertyLoadSaver
+	// Seq is the sequence number recording when the rule was first
+	// inserted, see Config.InsertionOrder; 0 if it has none.
+	Seq int64
+	// extra are the properties saved in addition to the rule's. On load, it
+	// holds all of the entity's properties.
+	extra []datastore.Property
+}
+
+func (e *ruleEntity) Load(props []datastore.Property) error {
+	for _, p := range props {
+		if p.Name == "seq" {
+			e.Seq, _ = p.Value.(int64)
+		}
+	}
+	e.extra = props
+	if e.PropertyLoadSaver == nil {
+		e.PropertyLoadSaver = &CasbinRule{}
+	}
+	return e.PropertyLoadSaver.Load(props)
+}
+
+func (e *ruleEntity) Save() ([]datastore.Property, error) {
+	props, err := e.PropertyLoadSaver.Save()
+	if err != nil {
+		return nil, err
+	}
+	if e.Seq != 0 {
+		props = append(props, datastore.Property{Name: "seq", Value: e.Seq, NoIndex: true})
+	}
+	return append(props, e.extra...), nil
+}
+
+// rule returns the rule held by e.
+func (e *ruleEntity) rule() *CasbinRule {
+	switch r := e.PropertyLoadSaver.(type) {
+	case *CasbinRule:
+		return r
+	case *csvRule:
+		return r.CasbinRule
+	case *ruleEntity:
+		return r.rule()
+	}
+	return nil
+}
+
+// checksumValid reports whether e's checksum matches its fields, or it has
+// none.
+func (e *ruleEntity) checksumValid() bool {
+	for _, p := range e.extra {
+		if s, ok := p.Value.(string); ok && p.Name == checksumProperty {
+			return s == ruleChecksum(e.rule())
+		}
+	}
+	return true
+}
+
+// ruleChecksum returns the checksum of line's fields.
+func ruleChecksum(line *CasbinRule) string {
+	sum := sha256.Sum256([]byte(line.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// expired reports whether e's expiry, stored in the TTL property, has
+// passed.
+func (e *ruleEntity) expired(ttlProperty string, now time.Time) bool {
+	for _, p := range e.extra {
+		if t, ok := p.Value.(time.Time); ok && p.Name == ttlProperty {
+			return !now.Before(t)
+		}
+	}
+	return false
+}
+
+func (a *Adapter) csvFormat() bool {
+	return a.config.StorageFormat == StorageFormatCSV
+}
+
+// keyName returns the key name of the entity storing line.
+func (a *Adapter) keyName(line *CasbinRule) string {
+	if a.csvFormat() {
+		sum := sha256.Sum256([]byte(line.String()))
+		return hex.EncodeToString(sum[:])
+	}
+	if a.config.HashPrefixKeys {
+		s := line.String()
+		h := fnv.New32a()
+		h.Write([]byte(s))
+		return fmt.Sprintf("%04x:%s", h.Sum32()>>16, s)
+	}
+	return line.String()
+}
+
+// keyPrefixLen is the length of the hash prefix of key names, see
+// Config.HashPrefixKeys.
+const keyPrefixLen = len("0000:")
+
+// trimKeyPrefix returns the key name name without its hash prefix, if
+// Config.HashPrefixKeys adds one.
+func (a *Adapter) trimKeyPrefix(name string) string {
+	if a.config.HashPrefixKeys && !a.csvFormat() && len(name) >= keyPrefixLen && name[keyPrefixLen-1] == ':' {
+		return name[keyPrefixLen:]
+	}
+	return name
+}
+
+// entity returns the value to put for line in the configured format, with
+// the metadata of ctx.
+func (a *Adapter) entity(ctx context.Context, line *CasbinRule) datastore.PropertyLoadSaver {
+	var entity datastore.PropertyLoadSaver = line
+	if a.csvFormat() {
+		entity = &csvRule{line}
+	}
+	extra := metaProperties(ctx)
+	if a.config.ChecksumAction != "" {
+		extra = append(extra, datastore.Property{Name: checksumProperty, Value: ruleChecksum(line), NoIndex: true})
+	}
+	if a.config.TTLProperty != "" && a.config.TTL > 0 {
+		expiry := datastore.Property{Name: a.config.TTLProperty, Value: time.Now().Add(a.config.TTL), NoIndex: true}
+		extra = append(extra, expiry)
+	}
+	if len(extra) > 0 {
+		entity = &ruleEntity{PropertyLoadSaver: entity, extra: extra}
+	}
+	return entity
+}
+
+// maxEntitySize is the maximum size in bytes of a Datastore entity.
+const maxEntitySize = 1<<20 - 4
+
+// checkEntitySize returns a RuleError wrapping ErrEntityTooLarge if entity,
+// the entity of line stored under key, would exceed Config.MaxEntitySize.
+func (a *Adapter) checkEntitySize(key *datastore.Key, line *CasbinRule, entity datastore.PropertyLoadSaver) error {
+	props, err := entity.Save()
+	if err != nil {
+		return err
+	}
+	if size := entitySize(key, props); size > a.config.MaxEntitySize {
+		err := fmt.Errorf("%w: about %d bytes, the limit is %d", ErrEntityTooLarge, size, a.config.MaxEntitySize)
+		return RuleError{Rule: line, Err: err}
+	}
+	return nil
+}
+
+// entitySize estimates the size of an entity with key and props the way
+// Datastore accounts it: strings and names take their length plus one byte,
+// numbers and times eight bytes, plus 32 bytes for the entity itself.
+func entitySize(key *datastore.Key, props []datastore.Property) int {
+	size := 32
+	for k := key; k != nil; k = k.Parent {
+		size += len(k.Kind) + 1
+		if k.Name != "" {
+			size += len(k.Name) + 1
+		} else {
+			size += 8
+		}
+	}
+	if key != nil {
+		size += len(key.Namespace) + 1
+	}
+	for _, p := range props {
+		size += len(p.Name) + 1
+		switch v := p.Value.(type) {
+		case string:
+			size += len(v) + 1
+		case []byte:
+			size += len(v) + 1
+		case bool, nil:
+			size++
+		default:
+			size += 8
+		}
+	}
+	return size
+}
+
+// getRules runs query and returns the resulting rules. Rules whose TTL has
+// expired are dropped, rules failing their checksum are handled per
+// Config.ChecksumAction, and with Config.InsertionOrder the rules are
+// ordered by their sequence numbers, rules without one first; the numbers
+// are recorded for sortMerged, see recordSeqs.
+func (a *Adapter) getRules(ctx context.Context, db *datastore.Client, query *datastore.Query) ([]*CasbinRule, error) {
+	if !a.config.InsertionOrder && a.config.TTLProperty == "" && a.config.ChecksumAction == "" {
+		var rules []*CasbinRule
+		_, err := db.GetAll(ctx, query, &rules)
+		a.checkLoadLimit(ctx, len(rules))
+		_, rules = rulesOnly(nil, rules)
+		return rules, err
+	}
+
+	var entities []*ruleEntity
+	if _, err := db.GetAll(ctx, query, &entities); err != nil {
+		return nil, err
+	}
+	a.checkLoadLimit(ctx, len(entities))
+	if a.config.InsertionOrder {
+		sort.SliceStable(entities, func(i, j int) bool {
+			return entities[i].Seq < entities[j].Seq
+		})
+		record(ctx, entities)
+	}
+
+	now := time.Now()
+	rules := make([]*CasbinRule, 0, len(entities))
+	for _, e := range entities {
+		if ok, err := a.loadable(e, now); err != nil {
+			return nil, err
+		} else if ok {
+			rules = append(rules, e.rule())
+		}
+	}
+	return rules, nil
+}
+
+// checkLoadLimit sets the flag of LoadPolicy's ctx, see loadLimitKey, if
+// its query returned rows, counting those skipped afterwards, up to
+// Config.LoadLimit.
+func (a *Adapter) checkLoadLimit(ctx context.Context, rows int) {
+	limited, ok := ctx.Value(loadLimitKey{}).(*int32)
+	if ok && a.config.LoadLimit > 0 && rows >= a.config.LoadLimit {
+		atomic.StoreInt32(limited, 1)
+	}
+}
+
+// loadable reports whether loads return the rule of e: whether e is a rule
+// that didn't expire by now, see Config.TTLProperty, and passes its
+// checksum, see Config.ChecksumAction.
+func (a *Adapter) loadable(e *ruleEntity, now time.Time) (bool, error) {
+	if e.rule().PType == "" {
+		// Not a rule, see newQuery.
+		return false, nil
+	}
+	if a.config.TTLProperty != "" && e.expired(a.config.TTLProperty, now) {
+		return false, nil
+	}
+	if a.config.ChecksumAction != "" && !e.checksumValid() {
+		if a.config.ChecksumAction == ChecksumError {
+			return false, fmt.Errorf("%w: %s", ErrChecksumMismatch, e.rule())
+		}
+		a.logPrintln("[LoadPolicy] skipping rule failing its checksum:", e.rule().String())
+		return false, nil
+	}
+	return true, nil
+}
+
+// streamRules calls fn with every rule the query made by build returns, as
+// it is read, instead of collecting them, so that memory doesn't grow with
+// the number of rules. Rules are filtered like getRules does. A retried
+// query resumes after the last rule read.
+func (a *Adapter) streamRules(ctx context.Context, build func() *datastore.Query, fn func(rule *CasbinRule) error) error {
+	query := build()
+	now := time.Now()
+	return a.retry(ctx, func(db *datastore.Client) error {
+		it := db.Run(ctx, query)
+		for {
+			var e ruleEntity
+			_, err := it.Next(&e)
+			if err == iterator.Done {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if ok, err := a.loadable(&e, now); err != nil {
+				return err
+			} else if ok {
+				if err := fn(e.rule()); err != nil {
+					return err
+				}
+			}
+			cursor, err := it.Cursor()
+			if err != nil {
+				return err
+			}
+			query = build().Start(cursor)
+		}
+	})
+}
+
+// findFiltered returns the keys and rules of ptype matching fieldIndex and
+// fieldValues, with the semantics of RemoveFilteredPolicy.
+func (a *Adapter) findFiltered(ctx context.Context, ptype string, fieldIndex int, fieldValues ...string) ([]*datastore.Key, []*CasbinRule, error) {
+	var keys []*datastore.Key
+	var rules []*CasbinRule
+	err := a.retry(ctx, func(db *datastore.Client) error {
+		var err error
+		keys, rules, err = a.findFilteredTx(ctx, db, nil, ptype, fieldIndex, fieldValues...)
+		return err
+	})
+	return keys, rules, err
+}
+
+// findFilteredTx is findFiltered running its queries within tx, unless tx
+// is nil.
+func (a *Adapter) findFilteredTx(ctx context.Context, db *datastore.Client, tx *datastore.Transaction,
+	ptype string, fieldIndex int, fieldValues ...string) ([]*datastore.Key, []*CasbinRule, error) {
+
+	var keys []*datastore.Key
+	var rules []*CasbinRule
+	for _, ctx := range a.ancestorContexts(ctx) {
+		found, foundRules, err := a.findFilteredAncestor(ctx, db, tx, ptype, fieldIndex, fieldValues...)
+		if err != nil {
+			return nil, nil, err
+		}
+		keys = append(keys, found...)
+		rules = append(rules, foundRules...)
+	}
+	return keys, rules, nil
+}
+
+// findFilteredAncestor is findFilteredTx for the ancestor of ctx. Like
+// loads, it skips rules whose TTL has expired and handles rules failing
+// their checksum per Config.ChecksumAction.
+func (a *Adapter) findFilteredAncestor(ctx context.Context, db *datastore.Client, tx *datastore.Transaction,
+	ptype string, fieldIndex int, fieldValues ...string) ([]*datastore.Key, []*CasbinRule, error) {
+
+	query := a.filteredQuery(ctx, ptype, fieldIndex, fieldValues...)
+	if a.csvFormat() {
+		query = a.newQuery(ctx).Filter("ptype =", ptype)
+		if a.config.Debug {
+			a.logPrintln("[findFiltered] CSV format, filtering in memory:", fmt.Sprintf("ptype = %q", ptype))
+		}
+	}
+	if tx != nil {
+		query = query.Transaction(tx)
+	}
+
+	keys, rules, err := a.getLoadable(ctx, db, query)
+	if err != nil || !a.csvFormat() {
+		return keys, rules, err
+	}
+
+	n := 0
+	for i, rule := range rules {
+		if matchesFilter(rule, fieldIndex, fieldValues...) {
+			keys[n], rules[n] = keys[i], rule
+			n++
+		}
+	}
+	return keys[:n], rules[:n], nil
+}
+
+// getLoadable runs query and returns the keys and rules of its results that
+// loads return, see loadable.
+func (a *Adapter) getLoadable(ctx context.Context, db *datastore.Client, query *datastore.Query) ([]*datastore.Key, []*CasbinRule, error) {
+	if a.config.TTLProperty == "" && a.config.ChecksumAction == "" {
+		var rules []*CasbinRule
+		keys, err := db.GetAll(ctx, query, &rules)
+		return keys, rules, err
+	}
+
+	var entities []*ruleEntity
+	keys, err := db.GetAll(ctx, query, &entities)
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	rules := make([]*CasbinRule, 0, len(entities))
+	n := 0
+	for i, e := range entities {
+		if ok, err := a.loadable(e, now); err != nil {
+			return nil, nil, err
+		} else if ok {
+			keys[n] = keys[i]
+			rules = append(rules, e.rule())
+			n++
+		}
+	}
+	return keys[:n], rules, nil
+}
+
+// rulesOnly drops the entities without ptype from the results of newQuery,
+// which aren't rules, keeping keys in step unless it is nil.
+func rulesOnly(keys []*datastore.Key, rules []*CasbinRule) ([]*datastore.Key, []*CasbinRule) {
+	n := 0
+	for i, rule := range rules {
+		if rule.PType == "" {
+			continue
+		}
+		if keys != nil {
+			keys[n] = keys[i]
+		}
+		rules[n] = rule
+		n++
+	}
+	if keys != nil {
+		keys = keys[:n]
+	}
+	return keys, rules[:n]
+}
+
+// matchesFilter reports whether rule's fields, starting at fieldIndex, equal
+// fieldValues. Empty values match anything.
+func matchesFilter(rule *CasbinRule, fieldIndex int, fieldValues ...string) bool {
+	fields := rule.fields()[1:]
+	for i, value := range fieldValues {
+		j := fieldIndex + i
+		if value == "" || j < 0 || j >= len(fields) {
+			continue
+		}
+		if fields[j] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// unconstrained reports whether a filter with the semantics of matchesFilter
+// matches every rule.
+func unconstrained(fieldIndex int, fieldValues ...string) bool {
+	for i, value := range fieldValues {
+		if j := fieldIndex + i; value != "" && j >= 0 && j < 6 {
+			return false
+		}
+	}
+	return true
+}
+
+// sortRules orders rules by ptype, then v0 to v5.
+func sortRules(rules []*CasbinRule) {
+	sort.Slice(rules, func(i, j int) bool {
+		a, b := rules[i].fields(), rules[j].fields()
+		for k := range a {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return false
+	})
+}
@@ -0,0 +1,202 @@
+package datastoreadapter
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/casbin/casbin/v2"
+)
+
+func TestStorageFormatRoundTrip(t *testing.T) {
+	rule := &CasbinRule{PType: "p", V0: "a,b", V2: "read"}
+
+	fields, _ := rule.Save()
+	csv, _ := (&csvRule{rule}).Save()
+	for _, props := range [][]datastore.Property{fields, csv} {
+		var loaded CasbinRule
+		if err := loaded.Load(props); err != nil {
+			t.Fatalf("Expected Load() to be successful; got %v", err)
+		}
+		if loaded != *rule {
+			t.Errorf("got %#v, wants %#v", loaded, *rule)
+		}
+	}
+
+	for _, p := range csv {
+		if p.Name == "rule" && !p.NoIndex {
+			t.Errorf("the rule property must not be indexed")
+		}
+	}
+}
+
+func TestMatchesFilter(t *testing.T) {
+	rule := &CasbinRule{PType: "p", V0: "domain1", V1: "alice", V2: "data3", V3: "read"}
+	tests := []struct {
+		fieldIndex  int
+		fieldValues []string
+		want        bool
+	}{
+		{0, []string{"domain1"}, true},
+		{0, []string{"domain1", "", "", "read"}, true},
+		{1, []string{"alice", "data3"}, true},
+		{1, []string{"bob"}, false},
+		{3, []string{"write"}, false},
+		{5, []string{"", "ignored"}, true},
+	}
+	for _, tt := range tests {
+		if got := matchesFilter(rule, tt.fieldIndex, tt.fieldValues...); got != tt.want {
+			t.Errorf("matchesFilter(%d, %q) = %v, wants %v", tt.fieldIndex, tt.fieldValues, got, tt.want)
+		}
+	}
+}
+
+func TestCSVStorageFormat(t *testing.T) {
+	config := Config{Kind: "casbin_test_csv", Namespace: "unittest", StorageFormat: StorageFormatCSV}
+	initPolicy(t, config)
+
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf", a)
+
+	e.AddPolicy("alice", "data1", "write")
+	if err := e.LoadPolicy(); err != nil {
+		t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(e, [][]string{{"alice", "data1", "read"}, {"alice", "data1", "write"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}}, func(actual, wants [][]string) {
+		t.Error("got: ", actual, ", wants ", wants)
+	})
+
+	// Filtered removes fall back to in-memory filtering.
+	e.RemoveFilteredPolicy(0, "data2_admin")
+	e.RemovePolicy("alice", "data1", "write")
+	if err := e.LoadPolicy(); err != nil {
+		t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}}, func(actual, wants [][]string) {
+		t.Error("got: ", actual, ", wants ", wants)
+	})
+}
+
+func TestRuleEntityRoundTrip(t *testing.T) {
+	rule := &CasbinRule{PType: "p", V0: "alice", V1: "data1", V2: "read"}
+	for _, entity := range []*ruleEntity{{rule, 0, nil}, {rule, 7, nil}, {&csvRule{rule}, 7, nil}} {
+		props, err := entity.Save()
+		if err != nil {
+			t.Fatalf("Expected Save() to be successful; got %v", err)
+		}
+		var loaded ruleEntity
+		if err := loaded.Load(props); err != nil {
+			t.Fatalf("Expected Load() to be successful; got %v", err)
+		}
+		if loaded.Seq != entity.Seq || *loaded.rule() != *rule {
+			t.Errorf("got %v %d, wants %v %d", loaded.rule(), loaded.Seq, rule, entity.Seq)
+		}
+	}
+}
+
+func TestRuleEntityExpired(t *testing.T) {
+	now := time.Now()
+	entity := &ruleEntity{extra: []datastore.Property{{Name: "expires", Value: now}}}
+	if !entity.expired("expires", now) {
+		t.Errorf("Expected the entity to be expired at its expiry")
+	}
+	if entity.expired("expires", now.Add(-time.Second)) {
+		t.Errorf("Expected the entity not to be expired before its expiry")
+	}
+	if entity.expired("other", now) {
+		t.Errorf("Expected an entity without the TTL property never to expire")
+	}
+}
+
+func TestRuleEntityChecksum(t *testing.T) {
+	rule := &CasbinRule{PType: "p", V0: "alice", V1: "data1", V2: "read"}
+	a := &Adapter{config: withDefaults(Config{ChecksumAction: ChecksumError})}
+	props, err := a.entity(context.Background(), rule).Save()
+	if err != nil {
+		t.Fatalf("Expected Save() to be successful; got %v", err)
+	}
+
+	var entity ruleEntity
+	if err := entity.Load(props); err != nil {
+		t.Fatalf("Expected Load() to be successful; got %v", err)
+	}
+	if !entity.checksumValid() {
+		t.Errorf("Expected the checksum of %v to match", entity.rule())
+	}
+
+	// An edit made outside the adapter.
+	for i, p := range props {
+		if p.Name == "v2" {
+			props[i].Value = "write"
+		}
+	}
+	entity = ruleEntity{}
+	if err := entity.Load(props); err != nil {
+		t.Fatalf("Expected Load() to be successful; got %v", err)
+	}
+	if entity.checksumValid() {
+		t.Errorf("Expected the checksum of %v not to match", entity.rule())
+	}
+
+	entity = ruleEntity{}
+	entity.Load(props[:7])
+	if !entity.checksumValid() {
+		t.Errorf("Expected a rule without checksum to be accepted")
+	}
+}
+
+func TestCheckLoadLimit(t *testing.T) {
+	a := &Adapter{config: withDefaults(Config{LoadLimit: 3})}
+	var limited int32
+	ctx := context.WithValue(context.Background(), loadLimitKey{}, &limited)
+
+	a.checkLoadLimit(ctx, 2)
+	if limited != 0 {
+		t.Error("got a query under the limit flagged")
+	}
+	a.checkLoadLimit(context.Background(), 3)
+	a.checkLoadLimit(ctx, 3)
+	if limited != 1 {
+		t.Error("got a query at the limit not flagged")
+	}
+}
+
+func TestRulesOnly(t *testing.T) {
+	root := datastore.IDKey("casbin", 1, nil)
+	keys := []*datastore.Key{root, datastore.NameKey("casbin", "p,alice", root), datastore.NameKey("casbin", "g,alice", root)}
+	rules := []*CasbinRule{{}, {PType: "p", V0: "alice"}, {PType: "g", V0: "alice"}}
+
+	keys, rules = rulesOnly(keys, rules)
+	if len(keys) != 2 || len(rules) != 2 || keys[0].Name != "p,alice" || rules[1].PType != "g" {
+		t.Errorf("got %v, %v; wants the rules only", keys, rules)
+	}
+	if _, rules = rulesOnly(nil, []*CasbinRule{{}}); len(rules) != 0 {
+		t.Errorf("got %v, wants no rules", rules)
+	}
+}
+
+func TestCheckEntitySize(t *testing.T) {
+	ctx := context.Background()
+	a := &Adapter{config: withDefaults(Config{StorageFormat: StorageFormatCSV})}
+	small := &CasbinRule{PType: "p", V0: "alice", V1: "data1", V2: "read"}
+	if err := a.checkEntitySize(a.ruleKey(ctx, small), small, a.entity(ctx, small)); err != nil {
+		t.Errorf("got %v, wants nil", err)
+	}
+
+	large := &CasbinRule{PType: "p", V0: "alice", V1: strings.Repeat("x", maxEntitySize)}
+	err := a.checkEntitySize(a.ruleKey(ctx, large), large, a.entity(ctx, large))
+	if !errors.Is(err, ErrEntityTooLarge) {
+		t.Fatalf("got %v, wants %v", err, ErrEntityTooLarge)
+	}
+	if ruleErr, ok := err.(RuleError); !ok || ruleErr.Rule != large {
+		t.Errorf("got %v, wants the error to name the rule", err)
+	}
+
+	a = &Adapter{config: withDefaults(Config{MaxEntitySize: 100})}
+	if err := a.checkEntitySize(a.ruleKey(ctx, small), small, a.entity(ctx, small)); !errors.Is(err, ErrEntityTooLarge) {
+		t.Errorf("got %v, wants %v with a configured limit", err, ErrEntityTooLarge)
+	}
+}
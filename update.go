@@ -0,0 +1,363 @@
+package datastoreadapter
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// UpdateOutcome is the outcome of a single rule update.
+type UpdateOutcome struct {
+	OldRule []string
+	NewRule []string
+	// Err is the failure of the update, or nil if it persisted.
+	Err error
+}
+
+// UpdateResult reports the outcome of every update of
+// UpdatePoliciesWithResult, in the order of the rules passed.
+type UpdateResult struct {
+	Outcomes []UpdateOutcome
+}
+
+// Updated returns the number of updates that persisted.
+func (r UpdateResult) Updated() int {
+	n := 0
+	for _, o := range r.Outcomes {
+		if o.Err == nil {
+			n++
+		}
+	}
+	return n
+}
+
+func (a *Adapter) UpdatePolicy(sec string, ptype string, oldRule, newRule []string) error {
+	return a.UpdatePolicyCtx(context.Background(), sec, ptype, oldRule, newRule)
+}
+
+// UpdatePolicyCtx replaces oldRule with newRule in one transaction. A
+// missing oldRule is not an error.
+func (a *Adapter) UpdatePolicyCtx(ctx context.Context, sec string, ptype string, oldRule, newRule []string) (err error) {
+	defer a.observe(a.ptypeContext(ctx, ptype), "UpdatePolicy", time.Now(), &err)
+	_, err = a.updatePolicies(ctx, "UpdatePolicy", ptype, [][]string{oldRule}, [][]string{newRule})
+	return err
+}
+
+func (a *Adapter) UpdatePolicies(sec string, ptype string, oldRules, newRules [][]string) error {
+	return a.UpdatePoliciesCtx(context.Background(), sec, ptype, oldRules, newRules)
+}
+
+// UpdatePoliciesCtx is UpdatePoliciesWithResult without the result.
+func (a *Adapter) UpdatePoliciesCtx(ctx context.Context, sec string, ptype string, oldRules, newRules [][]string) (err error) {
+	defer a.observe(a.ptypeContext(ctx, ptype), "UpdatePolicies", time.Now(), &err)
+	_, err = a.updatePolicies(ctx, "UpdatePolicies", ptype, oldRules, newRules)
+	return err
+}
+
+// UpdatePoliciesWithResult replaces every rule of oldRules with the rule of
+// newRules at the same index, in one transaction. Batches too large for one
+// transaction are split unless Config.BatchAtomic is set, so some updates
+// may persist while others fail; the result tells which did, and err is the
+// first failure.
+func (a *Adapter) UpdatePoliciesWithResult(ctx context.Context, sec string, ptype string, oldRules, newRules [][]string) (result UpdateResult, err error) {
+	defer a.observe(a.ptypeContext(ctx, ptype), "UpdatePolicies", time.Now(), &err)
+	return a.updatePolicies(ctx, "UpdatePolicies", ptype, oldRules, newRules)
+}
+
+// maxUpdatesPerTx is the maximum number of updates, a delete and a put
+// each, in a single commit.
+const maxUpdatesPerTx = maxPutsPerTx / 2
+
+// updatePolicies implements the update methods, op being the name of the
+// method called.
+func (a *Adapter) updatePolicies(ctx context.Context, op string, ptype string, oldRules, newRules [][]string) (result UpdateResult, err error) {
+	if err := a.checkWritable(); err != nil {
+		return UpdateResult{}, err
+	}
+	if len(oldRules) != len(newRules) {
+		return UpdateResult{}, fmt.Errorf("datastoreadapter: %d old rules but %d new rules", len(oldRules), len(newRules))
+	}
+	for _, rule := range newRules {
+		if err := a.validateRule(ptype, rule); err != nil {
+			return UpdateResult{}, err
+		}
+	}
+	m := Mutation{Op: op, PType: ptype, Rules: newRules, OldRules: oldRules}
+	if err := a.beforeMutate(ctx, m); err != nil {
+		return UpdateResult{}, err
+	}
+	defer a.afterMutate(ctx, m, &err)
+
+	ctx, cancel := withDeadline(a.ptypeContext(ctx, ptype), a.config.AddRemoveDeadline)
+	defer cancel()
+
+	if a.config.Debug {
+		a.logPrintln("[UpdatePolicies] called:", len(oldRules), "rules")
+	}
+
+	result = UpdateResult{Outcomes: make([]UpdateOutcome, len(oldRules))}
+	oldKeys := make([]*datastore.Key, len(oldRules))
+	oldLines := make([]*CasbinRule, len(oldRules))
+	newKeys := make([]*datastore.Key, len(newRules))
+	newLines := make([]*CasbinRule, len(newRules))
+	for i := range oldRules {
+		result.Outcomes[i] = UpdateOutcome{OldRule: oldRules[i], NewRule: newRules[i]}
+		oldLine, newLine := a.storedLine(ptype, oldRules[i]), a.storedLine(ptype, newRules[i])
+		oldKeys[i], oldLines[i] = a.ruleKey(ctx, &oldLine), &oldLine
+		newKeys[i], newLines[i] = a.ruleKey(ctx, &newLine), &newLine
+	}
+
+	if a.stageAll(ctx, oldKeys, oldLines, true) {
+		a.stageAll(ctx, newKeys, newLines, false)
+		return result, nil
+	}
+	if len(oldKeys) > maxUpdatesPerTx && a.config.BatchAtomic {
+		err := fmt.Errorf("%w: %d updates, the limit is %d", ErrTooManyMutations, len(oldKeys), maxUpdatesPerTx)
+		for i := range result.Outcomes {
+			result.Outcomes[i].Err = err
+		}
+		return result, err
+	}
+
+	var firstErr error
+	for start := 0; start < len(oldKeys); start += maxUpdatesPerTx {
+		end := start + maxUpdatesPerTx
+		if end > len(oldKeys) {
+			end = len(oldKeys)
+		}
+		err := a.updateChunk(ctx, oldKeys[start:end], newKeys[start:end], newLines[start:end])
+		for i := start; i < end; i++ {
+			result.Outcomes[i].Err = err
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return result, firstErr
+}
+
+// updateChunk deletes oldKeys and puts newLines under newKeys in one
+// transaction.
+func (a *Adapter) updateChunk(ctx context.Context, oldKeys, newKeys []*datastore.Key, newLines []*CasbinRule) error {
+	return a.retry(ctx, func(db *datastore.Client) error {
+		_, err := db.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+			return a.updateTx(ctx, tx, oldKeys, newKeys, newLines)
+		})
+		return err
+	})
+}
+
+// updateTx deletes oldKeys and puts newLines under newKeys within tx. A
+// commit can't mutate the same entity twice, so rules that are both deleted
+// and put are only put, and only once.
+func (a *Adapter) updateTx(ctx context.Context, tx *datastore.Transaction, oldKeys, newKeys []*datastore.Key, newLines []*CasbinRule) error {
+	put := make(map[string]bool, len(newKeys))
+	var putKeys []*datastore.Key
+	var putLines []*CasbinRule
+	for i, key := range newKeys {
+		if !put[key.Name] {
+			put[key.Name] = true
+			putKeys = append(putKeys, key)
+			putLines = append(putLines, newLines[i])
+		}
+	}
+	deleted := make(map[string]bool, len(oldKeys))
+	var deleteKeys []*datastore.Key
+	for _, key := range oldKeys {
+		if !put[key.Name] && !deleted[key.Name] {
+			deleted[key.Name] = true
+			deleteKeys = append(deleteKeys, key)
+		}
+	}
+
+	if len(deleteKeys) > 0 {
+		if err := tx.DeleteMulti(deleteKeys); err != nil {
+			return err
+		}
+	}
+	if len(putKeys) == 0 {
+		return nil
+	}
+	return a.putRules(ctx, tx, putKeys, putLines, false)
+}
+
+func (a *Adapter) UpdateFilteredPolicies(sec string, ptype string, newRules [][]string, fieldIndex int, fieldValues ...string) ([][]string, error) {
+	return a.UpdateFilteredPoliciesCtx(context.Background(), sec, ptype, newRules, fieldIndex, fieldValues...)
+}
+
+// UpdateFilteredPoliciesCtx replaces the rules matching the filter, with the
+// semantics of RemoveFilteredPolicy, with newRules in one transaction, and
+// returns the replaced rules. Trailing empty fields are dropped from every
+// returned rule.
+func (a *Adapter) UpdateFilteredPoliciesCtx(ctx context.Context, sec string, ptype string, newRules [][]string,
+	fieldIndex int, fieldValues ...string) (oldRules [][]string, err error) {
+
+	defer a.observe(a.ptypeContext(ctx, ptype), "UpdateFilteredPolicies", time.Now(), &err)
+	if err := a.checkWritable(); err != nil {
+		return nil, err
+	}
+	if err := a.checkBroadDelete(ctx, ptype, fieldIndex, fieldValues...); err != nil {
+		return nil, err
+	}
+	for _, rule := range newRules {
+		if err := a.validateRule(ptype, rule); err != nil {
+			return nil, err
+		}
+	}
+	m := Mutation{Op: "UpdateFilteredPolicies", PType: ptype, Rules: newRules, Filter: &FilterSpec{FieldIndex: fieldIndex, FieldValues: fieldValues}}
+	if err := a.beforeMutate(ctx, m); err != nil {
+		return nil, err
+	}
+	defer a.afterMutate(ctx, m, &err)
+	if a.config.Debug {
+		a.logPrintln("[UpdateFilteredPolicies] called:", len(newRules), "rules")
+	}
+
+	ctx, cancel := withDeadline(a.ptypeContext(ctx, ptype), a.config.LoadSaveFilterDeadline)
+	defer cancel()
+
+	newKeys, newLines := a.batchLines(ctx, ptype, newRules)
+	var old []*CasbinRule
+	err = a.retry(ctx, func(db *datastore.Client) error {
+		_, err := db.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+			var keys []*datastore.Key
+			var err error
+			keys, old, err = a.findFilteredTx(ctx, db, tx, ptype, fieldIndex, fieldValues...)
+			if err != nil {
+				return err
+			}
+			if len(keys)+len(newKeys) > maxPutsPerTx {
+				return fmt.Errorf("%w: %d rules to delete and %d to put, the limit is %d",
+					ErrTooManyMutations, len(keys), len(newKeys), maxPutsPerTx)
+			}
+			return a.updateTx(ctx, tx, keys, newKeys, newLines)
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	oldRules = make([][]string, len(old))
+	for i, rule := range old {
+		oldRules[i] = trimTrailingEmpty(rule.fields()[1:])
+	}
+	return oldRules, nil
+}
+
+// RenameSubject replaces oldValue with newValue in the field at fieldIndex
+// (0 for v0 up to 5 for v5) of every rule of ptype, e.g. to rename a user
+// or role, and returns the number of renamed rules. The rules are found and
+// rewritten under their new keys in one transaction, so it fails with
+// ErrTooManyMutations if more rules match than a transaction can rewrite.
+// Values are matched and written as stored, see Config.SaveTransform.
+// Renamed rules already stored under their new name are kept once.
+func (a *Adapter) RenameSubject(ctx context.Context, ptype string, fieldIndex int, oldValue, newValue string) (renamed int, err error) {
+	defer a.observe(a.ptypeContext(ctx, ptype), "RenameSubject", time.Now(), &err)
+	if err := a.checkWritable(); err != nil {
+		return 0, err
+	}
+	if fieldIndex < 0 || fieldIndex > 5 {
+		return 0, fmt.Errorf("%w: %d", ErrInvalidFieldIndex, fieldIndex)
+	}
+	if oldValue == newValue {
+		return 0, nil
+	}
+	m := Mutation{Op: "RenameSubject", PType: ptype, Filter: &FilterSpec{FieldIndex: fieldIndex, FieldValues: []string{oldValue}}}
+	if err := a.beforeMutate(ctx, m); err != nil {
+		return 0, err
+	}
+	defer a.afterMutate(ctx, m, &err)
+	if a.config.Debug {
+		a.logPrintln("[RenameSubject] called:", ptype, fieldIndex, oldValue, newValue)
+	}
+
+	ctx, cancel := withDeadline(a.ptypeContext(ctx, ptype), a.config.LoadSaveFilterDeadline)
+	defer cancel()
+
+	err = a.retry(ctx, func(db *datastore.Client) error {
+		_, err := db.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+			oldKeys, rules, err := a.findFilteredTx(ctx, db, tx, ptype, fieldIndex, oldValue)
+			if err != nil {
+				return err
+			}
+			if len(oldKeys)*2 > maxPutsPerTx {
+				return fmt.Errorf("%w: %d rules to rename, the limit is %d",
+					ErrTooManyMutations, len(oldKeys), maxPutsPerTx/2)
+			}
+			newKeys := make([]*datastore.Key, len(rules))
+			newLines := make([]*CasbinRule, len(rules))
+			for i, rule := range rules {
+				fields := rule.fields()[1:]
+				fields[fieldIndex] = newValue
+				if err := a.validateRule(ptype, fields); err != nil {
+					return err
+				}
+				line := savePolicyLine(ptype, fields)
+				newKeys[i], newLines[i] = a.ruleKey(ctx, &line), &line
+			}
+			renamed = len(oldKeys)
+			if renamed == 0 {
+				return nil
+			}
+			return a.updateTx(ctx, tx, oldKeys, newKeys, newLines)
+		})
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return renamed, nil
+}
+
+// UpdateField replaces the field at fieldIndex (0 for v0 up to 5 for v5) of
+// oldRule with newValue, e.g. to change the effect of a rule, rewriting the
+// rule under its new key in one transaction. It fails with ErrRuleNotFound
+// if oldRule isn't stored.
+func (a *Adapter) UpdateField(ctx context.Context, ptype string, oldRule []string, fieldIndex int, newValue string) (err error) {
+	defer a.observe(a.ptypeContext(ctx, ptype), "UpdateField", time.Now(), &err)
+	if err := a.checkWritable(); err != nil {
+		return err
+	}
+	if fieldIndex < 0 || fieldIndex > 5 {
+		return fmt.Errorf("%w: %d", ErrInvalidFieldIndex, fieldIndex)
+	}
+	newRule := make([]string, len(oldRule))
+	copy(newRule, oldRule)
+	for len(newRule) <= fieldIndex {
+		newRule = append(newRule, "")
+	}
+	newRule[fieldIndex] = newValue
+	newRule = trimTrailingEmpty(newRule)
+	if err := a.validateRule(ptype, newRule); err != nil {
+		return err
+	}
+	m := Mutation{Op: "UpdateField", PType: ptype, Rules: [][]string{newRule}, OldRules: [][]string{oldRule}}
+	if err := a.beforeMutate(ctx, m); err != nil {
+		return err
+	}
+	defer a.afterMutate(ctx, m, &err)
+	if a.config.Debug {
+		a.logPrintln("[UpdateField] called:", ptype, oldRule, fieldIndex, newValue)
+	}
+
+	ctx, cancel := withDeadline(a.ptypeContext(ctx, ptype), a.config.AddRemoveDeadline)
+	defer cancel()
+
+	oldLine, newLine := a.storedLine(ptype, oldRule), a.storedLine(ptype, newRule)
+	oldKey, newKey := a.ruleKey(ctx, &oldLine), a.ruleKey(ctx, &newLine)
+	return a.retry(ctx, func(db *datastore.Client) error {
+		_, err := db.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+			var props datastore.PropertyList
+			if err := tx.Get(oldKey, &props); err == datastore.ErrNoSuchEntity {
+				return fmt.Errorf("%w: %s", ErrRuleNotFound, oldLine.String())
+			} else if err != nil {
+				return err
+			}
+			return a.updateTx(ctx, tx, []*datastore.Key{oldKey}, []*datastore.Key{newKey}, []*CasbinRule{&newLine})
+		})
+		return err
+	})
+}
@@ -0,0 +1,121 @@
+package datastoreadapter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/casbin/casbin/v2"
+)
+
+func TestUpdatePolicies(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+	defer initPolicy(t, config)
+
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf", a)
+
+	if _, err := e.UpdatePolicy([]string{"alice", "data1", "read"}, []string{"alice", "data1", "write"}); err != nil {
+		t.Fatalf("Expected UpdatePolicy() to be successful; got %v", err)
+	}
+	result, err := a.UpdatePoliciesWithResult(context.Background(), "p", "p",
+		[][]string{{"bob", "data2", "write"}, {"data2_admin", "data2", "read"}},
+		[][]string{{"bob", "data3", "write"}, {"data2_admin", "data2", "read"}})
+	if err != nil {
+		t.Fatalf("Expected UpdatePoliciesWithResult() to be successful; got %v", err)
+	}
+	if result.Updated() != 2 {
+		t.Errorf("got %v, wants 2 updates", result.Outcomes)
+	}
+	if _, err := e.UpdateFilteredPolicies([][]string{{"data2_admin", "data4", "read"}}, 0, "data2_admin"); err != nil {
+		t.Fatalf("Expected UpdateFilteredPolicies() to be successful; got %v", err)
+	}
+
+	if err := e.LoadPolicy(); err != nil {
+		t.Fatalf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(e, [][]string{{"alice", "data1", "write"}, {"bob", "data3", "write"}, {"data2_admin", "data4", "read"}}, func(actual, wants [][]string) {
+		t.Error("got: ", actual, ", wants ", wants)
+	})
+}
+
+func TestUpdateResult(t *testing.T) {
+	a := &Adapter{config: withDefaults(Config{BatchAtomic: true})}
+	ctx := context.Background()
+
+	if _, err := a.UpdatePoliciesWithResult(ctx, "p", "p", [][]string{{"alice"}}, nil); err == nil {
+		t.Error("Expected rule counts that differ to fail")
+	}
+
+	var oldRules, newRules [][]string
+	for i := 0; i < maxUpdatesPerTx+1; i++ {
+		oldRules = append(oldRules, []string{"user" + fmt.Sprint(i), "data1", "read"})
+		newRules = append(newRules, []string{"user" + fmt.Sprint(i), "data1", "write"})
+	}
+	result, err := a.UpdatePoliciesWithResult(ctx, "p", "p", oldRules, newRules)
+	if !errors.Is(err, ErrTooManyMutations) {
+		t.Errorf("got %v, wants %v", err, ErrTooManyMutations)
+	}
+	if len(result.Outcomes) != len(oldRules) || result.Updated() != 0 {
+		t.Errorf("got %d outcomes and %d updates, wants %d and 0", len(result.Outcomes), result.Updated(), len(oldRules))
+	}
+	if o := result.Outcomes[1]; o.OldRule[0] != "user1" || o.NewRule[2] != "write" {
+		t.Errorf("got outcome %v, wants the rules of index 1", o)
+	}
+}
+
+func TestRenameSubject(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	renamed, err := a.RenameSubject(context.Background(), "p", 0, "data2_admin", "data2_owner")
+	if err != nil {
+		t.Fatalf("Expected RenameSubject() to be successful; got %v", err)
+	}
+	if renamed != 2 {
+		t.Errorf("got %d renamed, wants 2", renamed)
+	}
+	if _, err := a.RenameSubject(context.Background(), "g", 1, "data2_admin", "data2_owner"); err != nil {
+		t.Fatalf("Expected RenameSubject() to be successful; got %v", err)
+	}
+
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	testGetPolicy(e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_owner", "data2", "read"}, {"data2_owner", "data2", "write"}}, func(actual, wants [][]string) {
+		t.Error("got: ", actual, ", wants ", wants)
+	})
+	if ok, _ := e.Enforce("alice", "data2", "write"); !ok {
+		t.Error("got alice denied, wants the role renamed in the grouping rules too")
+	}
+}
+
+func TestRenameSubjectInvalidIndex(t *testing.T) {
+	a := &Adapter{config: withDefaults(Config{})}
+	if _, err := a.RenameSubject(context.Background(), "p", 6, "alice", "bob"); !errors.Is(err, ErrInvalidFieldIndex) {
+		t.Errorf("got %v, wants %v", err, ErrInvalidFieldIndex)
+	}
+}
+
+func TestUpdateField(t *testing.T) {
+	config := Config{Kind: "casbin_test", Namespace: "unittest"}
+	initPolicy(t, config)
+
+	ctx := context.Background()
+	a := NewAdapterWithConfig(getDatastore(t), config)
+	if err := a.UpdateField(ctx, "p", []string{"bob", "data2", "write"}, 2, "read"); err != nil {
+		t.Fatalf("Expected UpdateField() to be successful; got %v", err)
+	}
+	if err := a.UpdateField(ctx, "p", []string{"carol", "data2", "write"}, 2, "read"); !errors.Is(err, ErrRuleNotFound) {
+		t.Errorf("got %v, wants %v", err, ErrRuleNotFound)
+	}
+	if err := a.UpdateField(ctx, "p", []string{"bob", "data2", "read"}, 6, "x"); !errors.Is(err, ErrInvalidFieldIndex) {
+		t.Errorf("got %v, wants %v", err, ErrInvalidFieldIndex)
+	}
+
+	e, _ := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	testGetPolicy(e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "read"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}}, func(actual, wants [][]string) {
+		t.Error("got: ", actual, ", wants ", wants)
+	})
+}